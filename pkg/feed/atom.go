@@ -0,0 +1,91 @@
+package feed
+
+import (
+	"strings"
+)
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	Id         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Links      []atomLink     `xml:"link"`
+	Authors    []atomPerson   `xml:"author"`
+	Categories []atomCategory `xml:"category"`
+	Summary    string         `xml:"summary"`
+	Content    string         `xml:"content"`
+	Published  string         `xml:"published"`
+	Updated    string         `xml:"updated"`
+}
+
+type atomFeed struct {
+	Id      string       `xml:"id"`
+	Title   string       `xml:"title"`
+	Links   []atomLink   `xml:"link"`
+	Updated string       `xml:"updated"`
+	Entries []*atomEntry `xml:"entry"`
+}
+
+// alternateLink returns the link to the HTML version, which is the one
+// with rel=alternate or without rel.
+func alternateLink(links []atomLink) string {
+	for _, l := range links {
+		if l.Rel == "" || l.Rel == "alternate" {
+			return l.Href
+		}
+	}
+	return ""
+}
+
+func parseAtom(body []byte) (*Feed, error) {
+	var af atomFeed
+	if err := newXMLDecoder(body).Decode(&af); err != nil {
+		return nil, err
+	}
+
+	f := &Feed{
+		Format:  FormatAtom,
+		Id:      strings.TrimSpace(af.Id),
+		Title:   strings.TrimSpace(af.Title),
+		Link:    alternateLink(af.Links),
+		Updated: parseDate(af.Updated),
+		Entries: make([]*Entry, 0, len(af.Entries)),
+	}
+
+	for _, ae := range af.Entries {
+		e := &Entry{
+			Id:        strings.TrimSpace(ae.Id),
+			Title:     strings.TrimSpace(ae.Title),
+			Link:      alternateLink(ae.Links),
+			Summary:   strings.TrimSpace(ae.Summary),
+			Content:   strings.TrimSpace(ae.Content),
+			Published: parseDate(ae.Published),
+			Updated:   parseDate(ae.Updated),
+		}
+
+		names := make([]string, 0, len(ae.Authors))
+		for _, a := range ae.Authors {
+			names = append(names, strings.TrimSpace(a.Name))
+		}
+		e.Author = strings.Join(names, ", ")
+
+		for _, c := range ae.Categories {
+			e.Categories = append(e.Categories, c.Term)
+		}
+
+		f.Entries = append(f.Entries, e)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,139 @@
+package feed
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Zone names found in RFC 822 dates and in the wild, with their
+// offset. Go only knows the offset of the local zone's abbreviations.
+var zoneOffsets = map[string]string{
+	"UT": "+0000", "UTC": "+0000", "GMT": "+0000", "Z": "+0000",
+	"EST": "-0500", "EDT": "-0400",
+	"CST": "-0600", "CDT": "-0500",
+	"MST": "-0700", "MDT": "-0600",
+	"PST": "-0800", "PDT": "-0700",
+	"BST": "+0100", "CET": "+0100", "CEST": "+0200",
+	"EET": "+0200", "EEST": "+0300",
+	"IST": "+0530", "JST": "+0900",
+	"AEST": "+1000", "AEDT": "+1100",
+}
+
+var weekdays = []string{
+	"monday", "tuesday", "wednesday", "thursday", "friday", "saturday", "sunday",
+	"mon", "tue", "tues", "wed", "thu", "thur", "thurs", "fri", "sat", "sun",
+}
+
+// Layouts tried once the date is normalized: no weekday, numeric
+// zones, single spaces. Fractional seconds are accepted after seconds
+// even if the layout doesn't have them.
+var dateLayouts = []string{
+	// RFC 3339 and ISO 8601 variants
+	time.RFC3339,
+	"2006-01-02T15:04:05Z0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04:05 Z07:00",
+	"2006-01-02T15:04:05 -0700",
+	"2006-01-02T15:04Z07:00",
+	"2006-01-02T15:04",
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05 Z07:00",
+	"2006-01-02 15:04:05 -0700",
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+
+	// RFC 822 and RFC 1123 variants, without the weekday
+	"2 Jan 2006 15:04:05 -0700",
+	"2 Jan 2006 15:04:05 -07:00",
+	"2 Jan 2006 15:04 -0700",
+	"2 Jan 06 15:04:05 -0700",
+	"2 Jan 06 15:04 -0700",
+	"2 January 2006 15:04:05 -0700",
+	"2 January 2006 15:04 -0700",
+	"2 Jan 2006 15:04:05",
+	"2 January 2006 15:04:05",
+	"2 Jan 2006",
+	"2 January 2006",
+
+	// Other formats seen in feeds
+	"Jan 2 15:04:05 2006",
+	"Jan 2 15:04:05 -0700 2006",
+	"Jan 2, 2006 15:04:05 -0700",
+	"Jan 2, 2006 15:04:05",
+	"January 2, 2006 15:04:05",
+	"Jan 2, 2006",
+	"January 2, 2006",
+}
+
+// ParseDate parses the dates found in feeds: RFC 3339 with or without
+// fractional seconds or zone, RFC 822 and RFC 1123 with their many
+// variants (named zones, two-digit years, missing seconds or weekday,
+// trailing comments), and a few common broken forms. Dates without a
+// zone are taken as UTC.
+func ParseDate(raw string) (time.Time, error) {
+	normalized := normalizeDate(raw)
+	if normalized == "" {
+		return time.Time{}, fmt.Errorf("empty date")
+	}
+
+	for _, layout := range dateLayouts {
+		if t, err := time.Parse(layout, normalized); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("unrecognized date %q", raw)
+}
+
+// parseDate is ParseDate, with the zero time for dates we don't
+// understand.
+func parseDate(raw string) time.Time {
+	t, _ := ParseDate(raw)
+	return t
+}
+
+func normalizeDate(raw string) string {
+	// A comment at the end, as RFC 822 allows, usually repeats the zone:
+	// "+0000 (UTC)"
+	raw = strings.TrimSpace(raw)
+	if start := strings.LastIndex(raw, "("); start > 0 && strings.HasSuffix(raw, ")") {
+		raw = raw[:start]
+	}
+
+	fields := strings.Fields(raw)
+	if len(fields) == 0 {
+		return ""
+	}
+
+	// The weekday only gets in the way, and is often wrong anyway
+	first := strings.ToLower(strings.TrimRight(fields[0], ",."))
+	for _, day := range weekdays {
+		if first == day {
+			fields = fields[1:]
+			break
+		}
+	}
+	if len(fields) == 0 {
+		return ""
+	}
+
+	for i, f := range fields {
+		// Zones are usually last, but asctime-like dates have them
+		// before the year
+		if offset, ok := zoneOffsets[strings.ToUpper(f)]; ok && i > 0 {
+			fields[i] = offset
+			continue
+		}
+		// "Sept" isn't understood, "Sep" is
+		if strings.EqualFold(f, "sept") {
+			fields[i] = "Sep"
+		}
+		// ISO dates with a lower-case separator or zone
+		if len(f) > 10 && f[4] == '-' && (f[10] == 't' || f[len(f)-1] == 'z') {
+			fields[i] = strings.ToUpper(f)
+		}
+	}
+
+	return strings.Join(fields, " ")
+}
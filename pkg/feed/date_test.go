@@ -0,0 +1,69 @@
+package feed
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	utc := time.Date(2003, time.June, 3, 9, 39, 21, 0, time.UTC)
+
+	cases := []struct {
+		raw      string
+		expected time.Time
+	}{
+		// RFC 3339 and friends
+		{"2003-06-03T09:39:21Z", utc},
+		{"2003-06-03T09:39:21.123456Z", utc.Add(123456 * time.Microsecond)},
+		{"2003-06-03T11:39:21+02:00", utc},
+		{"2003-06-03T11:39:21+0200", utc},
+		{"2003-06-03T09:39:21", utc},
+		{"2003-06-03t09:39:21z", utc},
+		{"2003-06-03 09:39:21", utc},
+		{"2003-06-03 11:39:21 +0200", utc},
+		{"2003-06-03T09:39Z", utc.Truncate(time.Minute)},
+		{"2003-06-03", utc.Truncate(24 * time.Hour)},
+
+		// RFC 822 and RFC 1123 variants
+		{"Tue, 03 Jun 2003 09:39:21 GMT", utc},
+		{"Tue, 03 Jun 2003 09:39:21 +0000", utc},
+		{"Tue, 3 Jun 2003 05:39:21 EDT", utc},
+		{"Tue, 03 Jun 2003 02:39:21 PDT", utc},
+		{"Tue, 03 Jun 03 09:39:21 UT", utc},
+		{"Tue, 03 Jun 2003 09:39 GMT", utc.Truncate(time.Minute)},
+		{"03 Jun 2003 09:39:21 Z", utc},
+		{"Tuesday, 03 June 2003 09:39:21 GMT", utc},
+		{"Tue, 03 Jun 2003 11:39:21 +02:00", utc},
+
+		// Broken forms
+		{"  Tue,  03 Jun 2003   09:39:21   GMT ", utc},
+		{"Mon, 03 Jun 2003 09:39:21 GMT", utc},
+		{"Tues, 03 Jun 2003 09:39:21 GMT", utc},
+		{"03 Jun 2003 09:39:21", utc},
+		{"3 SEPT 2003", time.Date(2003, time.September, 3, 0, 0, 0, 0, time.UTC)},
+		{"Jun 3, 2003", utc.Truncate(24 * time.Hour)},
+		{"Tue Jun 3 09:39:21 2003", utc},
+		{"Tue Jun 3 02:39:21 MST 2003", utc},
+		{"Tue, 03 Jun 2003 09:39:21 +0000 (UTC)", utc},
+		{"2003-06-03T10:39:21 +01:00", utc},
+	}
+
+	for _, c := range cases {
+		got, err := ParseDate(c.raw)
+		if err != nil {
+			t.Errorf("Couldn't parse %q: %v", c.raw, err)
+			continue
+		}
+		if !got.Equal(c.expected) {
+			t.Errorf("Parsed %q as %s, expected %s", c.raw, got, c.expected)
+		}
+	}
+}
+
+func TestParseDateInvalid(t *testing.T) {
+	for _, raw := range []string{"", "   ", "yesterday", "Tue,", "32 Jun 2003"} {
+		if got, err := ParseDate(raw); err == nil {
+			t.Errorf("Expected an error for %q, got %s", raw, got)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+// Parsing of syndication formats (Atom, RSS and JSON Feed) into a
+// common representation.
+
+package feed
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"time"
+)
+
+type Format string
+
+const (
+	FormatUnknown Format = ""
+	FormatAtom    Format = "atom"
+	FormatRSS     Format = "rss"
+	FormatJSON    Format = "json"
+)
+
+// The canonical media type of each format.
+var mediaTypes = map[Format]string{
+	FormatAtom: "application/atom+xml",
+	FormatRSS:  "application/rss+xml",
+	FormatJSON: "application/feed+json",
+}
+
+// MediaType returns the media type a document in this format should be
+// served with, or the empty string for FormatUnknown.
+func (f Format) MediaType() string {
+	return mediaTypes[f]
+}
+
+var ErrUnknownFormat = errors.New("unknown feed format")
+
+type Feed struct {
+	Format  Format    `json:"format"`
+	Id      string    `json:"id,omitempty"`
+	Title   string    `json:"title,omitempty"`
+	Link    string    `json:"link,omitempty"`
+	Updated time.Time `json:"updated,omitempty"`
+	Entries []*Entry  `json:"entries"`
+}
+
+type Entry struct {
+	Id         string    `json:"id"`
+	Title      string    `json:"title,omitempty"`
+	Link       string    `json:"link,omitempty"`
+	Author     string    `json:"author,omitempty"`
+	Categories []string  `json:"categories,omitempty"`
+	Summary    string    `json:"summary,omitempty"`
+	Content    string    `json:"content,omitempty"`
+	Published  time.Time `json:"published,omitempty"`
+	Updated    time.Time `json:"updated,omitempty"`
+}
+
+// Detect finds out the format of body. The Content-Type is trusted
+// when it's specific; generic XML or JSON types, or no type at all,
+// are resolved by looking at the document itself.
+func Detect(contentType string, body []byte) Format {
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	switch mediaType {
+	case "application/atom+xml":
+		return FormatAtom
+	case "application/rss+xml", "application/rdf+xml":
+		return FormatRSS
+	case "application/feed+json":
+		return FormatJSON
+	}
+
+	trimmed := bytes.TrimSpace(body)
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		if bytes.Contains(trimmed, []byte("jsonfeed.org/version")) {
+			return FormatJSON
+		}
+		return FormatUnknown
+	}
+
+	switch rootElement(trimmed) {
+	case "feed":
+		return FormatAtom
+	case "rss", "RDF":
+		return FormatRSS
+	}
+
+	return FormatUnknown
+}
+
+// rootElement returns the local name of the first element of an XML
+// document, if any.
+func rootElement(body []byte) string {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	d.Strict = false
+	d.CharsetReader = passthroughCharsetReader
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return ""
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			return se.Name.Local
+		}
+	}
+}
+
+// Parse parses body as a feed. The format is found with Detect.
+func Parse(contentType string, body []byte) (*Feed, error) {
+	switch Detect(contentType, body) {
+	case FormatAtom:
+		return parseAtom(body)
+	case FormatRSS:
+		return parseRSS(body)
+	case FormatJSON:
+		return parseJSON(body)
+	}
+
+	return nil, ErrUnknownFormat
+}
+
+func newXMLDecoder(body []byte) *xml.Decoder {
+	d := xml.NewDecoder(bytes.NewReader(body))
+	d.CharsetReader = passthroughCharsetReader
+	return d
+}
+
+// encoding/xml only knows UTF-8; feeds that say they're in some latin
+// charset are almost always ASCII-compatible, so read them as is
+// rather than failing.
+func passthroughCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	return input, nil
+}
@@ -0,0 +1,150 @@
+package feed
+
+import (
+	"testing"
+	"time"
+)
+
+const atomDoc = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Example Feed</title>
+  <link href="http://example.org/"/>
+  <updated>2003-12-13T18:30:02Z</updated>
+  <id>urn:uuid:60a76c80-d399-11d9-b93C-0003939e0af6</id>
+  <entry>
+    <title>Atom-Powered Robots Run Amok</title>
+    <link rel="alternate" href="http://example.org/2003/12/13/atom03"/>
+    <id>urn:uuid:1225c695-cfb8-4ebb-aaaa-80da344efa6a</id>
+    <updated>2003-12-13T18:30:02Z</updated>
+    <author><name>John Doe</name></author>
+    <category term="robots"/>
+    <summary>Some text.</summary>
+  </entry>
+</feed>`
+
+const rssDoc = `<?xml version="1.0" encoding="ISO-8859-1"?>
+<rss version="2.0" xmlns:dc="http://purl.org/dc/elements/1.1/">
+  <channel>
+    <title>Liftoff News</title>
+    <link>http://liftoff.msfc.nasa.gov/</link>
+    <item>
+      <title>Star City</title>
+      <link>http://liftoff.msfc.nasa.gov/news/2003/news-starcity.asp</link>
+      <description>How do Americans get ready to work with Russians aboard the ISS?</description>
+      <pubDate>Tue, 03 Jun 2003 09:39:21 GMT</pubDate>
+      <guid>http://liftoff.msfc.nasa.gov/2003/06/03.html#item573</guid>
+      <dc:creator>Jane Doe</dc:creator>
+      <category>space</category>
+    </item>
+  </channel>
+</rss>`
+
+const jsonDoc = `{
+  "version": "https://jsonfeed.org/version/1.1",
+  "title": "My Example Feed",
+  "home_page_url": "https://example.org/",
+  "feed_url": "https://example.org/feed.json",
+  "items": [
+    {
+      "id": 2,
+      "content_text": "This is a second item.",
+      "url": "https://example.org/second-item",
+      "date_published": "2010-02-07T14:04:00-05:00",
+      "authors": [{"name": "Jane"}],
+      "tags": ["misc"]
+    }
+  ]
+}`
+
+func TestDetect(t *testing.T) {
+	cases := []struct {
+		contentType string
+		body        string
+		expected    Format
+	}{
+		{"application/atom+xml", atomDoc, FormatAtom},
+		{"application/atom+xml; charset=utf-8", atomDoc, FormatAtom},
+		{"application/xml", atomDoc, FormatAtom},
+		{"text/xml; charset=\"utf-8\"", rssDoc, FormatRSS},
+		{"", rssDoc, FormatRSS},
+		{"application/rss+xml", rssDoc, FormatRSS},
+		{"application/json", jsonDoc, FormatJSON},
+		{"application/json", `{"some": "document"}`, FormatUnknown},
+		{"text/html", "<html><body></body></html>", FormatUnknown},
+	}
+
+	for _, c := range cases {
+		if f := Detect(c.contentType, []byte(c.body)); f != c.expected {
+			t.Errorf("Detect(%q) = %q, expected %q", c.contentType, f, c.expected)
+		}
+	}
+}
+
+func TestParseAtom(t *testing.T) {
+	f, err := Parse("application/atom+xml", []byte(atomDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Entries) != 1 {
+		t.Fatal("Got an unexpected number of entries:", len(f.Entries))
+	}
+
+	e := f.Entries[0]
+	if e.Id != "urn:uuid:1225c695-cfb8-4ebb-aaaa-80da344efa6a" {
+		t.Errorf("Didn't parse the correct id, got %s", e.Id)
+	}
+	if e.Link != "http://example.org/2003/12/13/atom03" {
+		t.Errorf("Didn't parse the correct link, got %s", e.Link)
+	}
+	if e.Author != "John Doe" {
+		t.Errorf("Didn't parse the correct author, got %s", e.Author)
+	}
+	if len(e.Categories) != 1 || e.Categories[0] != "robots" {
+		t.Errorf("Didn't parse the correct categories, got %v", e.Categories)
+	}
+	if !e.Updated.Equal(time.Date(2003, 12, 13, 18, 30, 2, 0, time.UTC)) {
+		t.Errorf("Didn't parse the correct date, got %s", e.Updated)
+	}
+}
+
+func TestParseRSS(t *testing.T) {
+	f, err := Parse("application/rss+xml", []byte(rssDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Entries) != 1 {
+		t.Fatal("Got an unexpected number of entries:", len(f.Entries))
+	}
+
+	e := f.Entries[0]
+	if e.Id != "http://liftoff.msfc.nasa.gov/2003/06/03.html#item573" {
+		t.Errorf("Didn't parse the correct id, got %s", e.Id)
+	}
+	if e.Author != "Jane Doe" {
+		t.Errorf("Didn't parse the correct author, got %s", e.Author)
+	}
+	if !e.Published.Equal(time.Date(2003, 6, 3, 9, 39, 21, 0, time.UTC)) {
+		t.Errorf("Didn't parse the correct date, got %s", e.Published)
+	}
+}
+
+func TestParseJSON(t *testing.T) {
+	f, err := Parse("application/feed+json", []byte(jsonDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Entries) != 1 {
+		t.Fatal("Got an unexpected number of entries:", len(f.Entries))
+	}
+
+	e := f.Entries[0]
+	if e.Id != "2" {
+		t.Errorf("Didn't parse the correct id, got %s", e.Id)
+	}
+	if e.Content != "This is a second item." {
+		t.Errorf("Didn't parse the correct content, got %s", e.Content)
+	}
+	if e.Author != "Jane" {
+		t.Errorf("Didn't parse the correct author, got %s", e.Author)
+	}
+}
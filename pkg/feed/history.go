@@ -0,0 +1,62 @@
+package feed
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+)
+
+// Namespace of the RFC 5005 elements
+const HistoryNamespace = "http://purl.org/syndication/history/1.0"
+
+// A HistoryLink points from one document of a feed's history to
+// another, as in RFC 5005: Rel is "current", "prev-archive" or
+// "next-archive".
+type HistoryLink struct {
+	Rel  string
+	Href string
+}
+
+// WithHistory returns a copy of the skeleton with links to other
+// documents of the feed's history and, if archive is true, marked as an
+// archive document.
+//
+// Atom and RSS get atom:link elements and fh:archive. JSON Feed has no
+// such thing, so only prev-archive is kept, as next_url, replacing the
+// one the feed may have.
+func (s *Skeleton) WithHistory(archive bool, links ...HistoryLink) *Skeleton {
+	var extra bytes.Buffer
+
+	switch s.Format {
+	case FormatAtom, FormatRSS:
+		// Explicit namespaces work whatever prefixes the document uses
+		for _, l := range links {
+			extra.WriteString(`<link xmlns="http://www.w3.org/2005/Atom" rel="` + l.Rel + `" href="`)
+			xml.EscapeText(&extra, []byte(l.Href))
+			extra.WriteString(`"/>`)
+		}
+		if archive {
+			extra.WriteString(`<archive xmlns="` + HistoryNamespace + `"/>`)
+		}
+
+		head := append(bytes.Clone(s.Head), extra.Bytes()...)
+		return &Skeleton{Format: s.Format, Head: head, Tail: s.Tail}
+
+	case FormatJSON:
+		for _, l := range links {
+			if l.Rel != "prev-archive" {
+				continue
+			}
+			// The skeleton is a whole document once closed
+			var doc map[string]json.RawMessage
+			if err := json.Unmarshal(s.Assemble(nil), &doc); err != nil {
+				return s
+			}
+			delete(doc, "items")
+			doc["next_url"], _ = json.Marshal(l.Href)
+			return &Skeleton{Format: s.Format, Head: jsonHead(doc), Tail: s.Tail}
+		}
+	}
+
+	return s
+}
@@ -0,0 +1,91 @@
+package feed
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestWithHistoryAtom(t *testing.T) {
+	sk, entries, err := Split(FormatAtom, []byte(atomDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := sk.WithHistory(true,
+		HistoryLink{Rel: "current", Href: "http://hub/archive?hub.topic=x"},
+		HistoryLink{Rel: "prev-archive", Href: "http://hub/archive?hub.topic=x&page=0"},
+	).Assemble([][]byte{entries[0].Raw})
+
+	var parsed struct {
+		Links []struct {
+			Rel  string `xml:"rel,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"http://www.w3.org/2005/Atom link"`
+		Archive *struct{} `xml:"http://purl.org/syndication/history/1.0 archive"`
+	}
+	if err := xml.Unmarshal(doc, &parsed); err != nil {
+		t.Fatalf("Document isn't valid XML anymore: %v\n%s", err, doc)
+	}
+	if parsed.Archive == nil {
+		t.Error("Document isn't marked as an archive")
+	}
+
+	found := false
+	for _, l := range parsed.Links {
+		if l.Rel == "prev-archive" && l.Href == "http://hub/archive?hub.topic=x&page=0" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Didn't find the prev-archive link in %+v", parsed.Links)
+	}
+
+	// The original skeleton is left alone
+	if strings.Contains(string(sk.Head), "archive") {
+		t.Error("Original skeleton was modified")
+	}
+}
+
+func TestWithHistoryJSON(t *testing.T) {
+	sk, entries, err := Split(FormatJSON, []byte(jsonDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := sk.WithHistory(true, HistoryLink{Rel: "prev-archive", Href: "http://hub/older"}).Assemble([][]byte{entries[0].Raw})
+
+	var parsed struct {
+		NextUrl string            `json:"next_url"`
+		Items   []json.RawMessage `json:"items"`
+	}
+	if err := json.Unmarshal(doc, &parsed); err != nil {
+		t.Fatalf("Document isn't valid JSON anymore: %v\n%s", err, doc)
+	}
+	if parsed.NextUrl != "http://hub/older" || len(parsed.Items) != 1 {
+		t.Errorf("Unexpected document: %s", doc)
+	}
+}
+
+func TestWithHistoryJSONReplacesNextUrl(t *testing.T) {
+	sk, _, err := Split(FormatJSON, []byte(`{"version":"https://jsonfeed.org/version/1.1","title":"t","next_url":"http://publisher/page2","items":[]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	doc := sk.WithHistory(true, HistoryLink{Rel: "prev-archive", Href: "http://hub/older"}).Assemble(nil)
+	if n := strings.Count(string(doc), `"next_url"`); n != 1 {
+		t.Fatalf("Expected a single next_url, got %d in %s", n, doc)
+	}
+
+	var parsed struct {
+		NextUrl string `json:"next_url"`
+	}
+	if err := json.Unmarshal(doc, &parsed); err != nil {
+		t.Fatalf("Document isn't valid JSON anymore: %v\n%s", err, doc)
+	}
+	if parsed.NextUrl != "http://hub/older" {
+		t.Errorf("Expected next_url to point to the archive, got %s", doc)
+	}
+}
@@ -0,0 +1,85 @@
+package feed
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// As specified by https://www.jsonfeed.org/version/1.1/, with the
+// single author of 1.0 too
+type jsonAuthor struct {
+	Name string `json:"name"`
+}
+
+type jsonItem struct {
+	Id            json.RawMessage `json:"id"`
+	Url           string          `json:"url"`
+	Title         string          `json:"title"`
+	ContentHtml   string          `json:"content_html"`
+	ContentText   string          `json:"content_text"`
+	Summary       string          `json:"summary"`
+	DatePublished string          `json:"date_published"`
+	DateModified  string          `json:"date_modified"`
+	Author        *jsonAuthor     `json:"author"`
+	Authors       []jsonAuthor    `json:"authors"`
+	Tags          []string        `json:"tags"`
+}
+
+type jsonFeed struct {
+	Version     string      `json:"version"`
+	Title       string      `json:"title"`
+	HomePageUrl string      `json:"home_page_url"`
+	FeedUrl     string      `json:"feed_url"`
+	Items       []*jsonItem `json:"items"`
+}
+
+func parseJSON(body []byte) (*Feed, error) {
+	var jf jsonFeed
+	if err := json.Unmarshal(body, &jf); err != nil {
+		return nil, err
+	}
+
+	f := &Feed{
+		Format:  FormatJSON,
+		Id:      firstNonEmpty(jf.FeedUrl, jf.HomePageUrl),
+		Title:   jf.Title,
+		Link:    jf.HomePageUrl,
+		Entries: make([]*Entry, 0, len(jf.Items)),
+	}
+
+	for _, item := range jf.Items {
+		e := &Entry{
+			Id:         jsonId(item.Id),
+			Title:      item.Title,
+			Link:       item.Url,
+			Categories: item.Tags,
+			Summary:    item.Summary,
+			Content:    firstNonEmpty(item.ContentHtml, item.ContentText),
+			Published:  parseDate(item.DatePublished),
+			Updated:    parseDate(firstNonEmpty(item.DateModified, item.DatePublished)),
+		}
+
+		authors := item.Authors
+		if item.Author != nil {
+			authors = append(authors, *item.Author)
+		}
+		names := make([]string, 0, len(authors))
+		for _, a := range authors {
+			names = append(names, a.Name)
+		}
+		e.Author = strings.Join(names, ", ")
+
+		f.Entries = append(f.Entries, e)
+	}
+
+	return f, nil
+}
+
+// Ids are supposed to be strings, but numbers are common.
+func jsonId(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	return strings.TrimSpace(string(raw))
+}
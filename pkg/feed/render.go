@@ -0,0 +1,74 @@
+package feed
+
+import (
+	"encoding/xml"
+	"time"
+)
+
+type atomText struct {
+	Type string `xml:"type,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+type atomOutSource struct {
+	Id    string   `xml:"id,omitempty"`
+	Title string   `xml:"title,omitempty"`
+	Link  atomLink `xml:"link"`
+}
+
+type atomOutEntry struct {
+	XMLName    xml.Name       `xml:"http://www.w3.org/2005/Atom entry"`
+	Id         string         `xml:"id"`
+	Title      atomText       `xml:"title"`
+	Links      []atomLink     `xml:"link"`
+	Authors    []atomPerson   `xml:"author"`
+	Categories []atomCategory `xml:"category"`
+	Summary    *atomText      `xml:"summary,omitempty"`
+	Content    *atomText      `xml:"content,omitempty"`
+	Published  string         `xml:"published,omitempty"`
+	Updated    string         `xml:"updated"`
+	Source     *atomOutSource `xml:"source,omitempty"`
+}
+
+// AtomEntry renders e as an Atom entry, whatever format it came from,
+// updated at the given date. If source isn't empty, the entry gets an
+// atom:source element pointing to the feed it comes from, as done by
+// aggregators.
+func AtomEntry(e *Entry, updated time.Time, source string) ([]byte, error) {
+	out := &atomOutEntry{
+		Id:        e.Id,
+		Title:     atomText{Type: "html", Text: e.Title},
+		Published: formatAtomDate(e.Published),
+		Updated:   updated.UTC().Format(time.RFC3339Nano),
+	}
+	if e.Link != "" {
+		out.Links = []atomLink{{Href: e.Link, Rel: "alternate"}}
+	}
+	if e.Author != "" {
+		out.Authors = []atomPerson{{Name: e.Author}}
+	}
+	for _, c := range e.Categories {
+		out.Categories = append(out.Categories, atomCategory{Term: c})
+	}
+	if e.Summary != "" {
+		out.Summary = &atomText{Type: "html", Text: e.Summary}
+	}
+	if e.Content != "" {
+		out.Content = &atomText{Type: "html", Text: e.Content}
+	}
+	if source != "" {
+		out.Source = &atomOutSource{
+			Id:   source,
+			Link: atomLink{Href: source, Rel: "self"},
+		}
+	}
+
+	return xml.Marshal(out)
+}
+
+func formatAtomDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
@@ -0,0 +1,38 @@
+package feed
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAtomEntry(t *testing.T) {
+	f, err := Parse("application/rss+xml", []byte(rssDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := f.Entries[0]
+	updated := time.Date(2003, time.June, 3, 9, 39, 21, 0, time.UTC)
+
+	raw, err := AtomEntry(original, updated, "http://example.com/rss")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Put in a feed, it reads back the same
+	doc := `<feed xmlns="http://www.w3.org/2005/Atom"><title>Aggregate</title>` + string(raw) + `</feed>`
+	back, err := Parse("application/atom+xml", []byte(doc))
+	if err != nil {
+		t.Fatalf("Rendered entry isn't valid: %v\n%s", err, raw)
+	}
+	if len(back.Entries) != 1 {
+		t.Fatalf("Expected one entry, got %d", len(back.Entries))
+	}
+
+	e := back.Entries[0]
+	if e.Id != original.Id || e.Title != original.Title || e.Link != original.Link || e.Summary != original.Summary {
+		t.Errorf("Entry changed when rendered:\n%+v\n%+v", original, e)
+	}
+	if !e.Updated.Equal(updated) {
+		t.Errorf("Expected updated %s, got %s", updated, e.Updated)
+	}
+}
@@ -0,0 +1,83 @@
+package feed
+
+import (
+	"strings"
+)
+
+const (
+	nsContent = "http://purl.org/rss/1.0/modules/content/"
+	nsDC      = "http://purl.org/dc/elements/1.1/"
+)
+
+type rssItem struct {
+	Guid        string   `xml:"guid"`
+	Title       string   `xml:"title"`
+	Link        string   `xml:"link"`
+	Author      string   `xml:"author"`
+	Creator     string   `xml:"http://purl.org/dc/elements/1.1/ creator"`
+	Categories  []string `xml:"category"`
+	Description string   `xml:"description"`
+	Content     string   `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+	PubDate     string   `xml:"pubDate"`
+	DCDate      string   `xml:"http://purl.org/dc/elements/1.1/ date"`
+}
+
+type rssChannel struct {
+	Title         string     `xml:"title"`
+	Link          string     `xml:"link"`
+	PubDate       string     `xml:"pubDate"`
+	LastBuildDate string     `xml:"lastBuildDate"`
+	Items         []*rssItem `xml:"item"`
+}
+
+// RSS 2.0 puts items in the channel, RSS 1.0 (RDF) next to it.
+type rssDocument struct {
+	Channel rssChannel `xml:"channel"`
+	Items   []*rssItem `xml:"item"`
+}
+
+func parseRSS(body []byte) (*Feed, error) {
+	var doc rssDocument
+	if err := newXMLDecoder(body).Decode(&doc); err != nil {
+		return nil, err
+	}
+
+	ch := doc.Channel
+	items := append(ch.Items, doc.Items...)
+
+	f := &Feed{
+		Format:  FormatRSS,
+		Id:      strings.TrimSpace(ch.Link),
+		Title:   strings.TrimSpace(ch.Title),
+		Link:    strings.TrimSpace(ch.Link),
+		Updated: parseDate(firstNonEmpty(ch.LastBuildDate, ch.PubDate)),
+		Entries: make([]*Entry, 0, len(items)),
+	}
+
+	for _, item := range items {
+		e := &Entry{
+			Id:         strings.TrimSpace(firstNonEmpty(item.Guid, item.Link)),
+			Title:      strings.TrimSpace(item.Title),
+			Link:       strings.TrimSpace(item.Link),
+			Author:     strings.TrimSpace(firstNonEmpty(item.Author, item.Creator)),
+			Categories: item.Categories,
+			Summary:    strings.TrimSpace(item.Description),
+			Content:    strings.TrimSpace(item.Content),
+			Published:  parseDate(firstNonEmpty(item.PubDate, item.DCDate)),
+		}
+		e.Updated = e.Published
+
+		f.Entries = append(f.Entries, e)
+	}
+
+	return f, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,260 @@
+package feed
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"mime"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A Skeleton is a feed document with its entries taken out, kept
+// byte for byte as the publisher wrote it. Entries go between Head and
+// Tail.
+type Skeleton struct {
+	Format Format
+	Head   []byte
+	Tail   []byte
+}
+
+// A RawEntry is one entry of a document, byte for byte, with the few
+// fields needed to index it.
+type RawEntry struct {
+	Id        string
+	Updated   string
+	Published string
+	Raw       []byte
+}
+
+// Assemble builds a complete document with the given entries.
+func (s *Skeleton) Assemble(entries [][]byte) []byte {
+	sep := []byte{}
+	if s.Format == FormatJSON {
+		sep = []byte(",")
+	}
+
+	var b bytes.Buffer
+	b.Write(s.Head)
+	b.Write(bytes.Join(entries, sep))
+	b.Write(s.Tail)
+	return b.Bytes()
+}
+
+// Split separates a document into its skeleton and its entries.
+func Split(f Format, body []byte) (*Skeleton, []*RawEntry, error) {
+	switch f {
+	case FormatAtom:
+		return splitXML(f, body, "entry")
+	case FormatRSS:
+		return splitXML(f, body, "item")
+	case FormatJSON:
+		return splitJSON(body)
+	}
+
+	return nil, nil, ErrUnknownFormat
+}
+
+type xmlEntryIndex struct {
+	Id        string `xml:"id"`
+	Guid      string `xml:"guid"`
+	Link      string `xml:"link"`
+	Updated   string `xml:"updated"`
+	Published string `xml:"published"`
+	PubDate   string `xml:"pubDate"`
+	DCDate    string `xml:"http://purl.org/dc/elements/1.1/ date"`
+}
+
+// splitXML takes out all elements named entryName that are children of
+// the root (Atom, RSS 1.0) or of the channel (RSS 2.0). Entries go back
+// where the first one was, or at the end of their container if there
+// weren't any.
+func splitXML(f Format, body []byte, entryName string) (*Skeleton, []*RawEntry, error) {
+	d := newXMLDecoder(body)
+
+	var (
+		entries   []*RawEntry
+		kept      bytes.Buffer // the document without its entries
+		keptFrom  int64        // start of the range we'll keep next
+		insertAt  = -1
+		container = -1 // where entries would go in an empty document
+		depth     int  // the root element is at depth 1
+		inChannel bool // whether the root is <rss>, with entries in <channel>
+	)
+
+	for {
+		start := d.InputOffset()
+		tok, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			depth++
+			if depth == 1 {
+				inChannel = t.Name.Local == "rss"
+			}
+			entryDepth := 2
+			if inChannel {
+				entryDepth = 3
+			}
+			if t.Name.Local != entryName || depth != entryDepth {
+				continue
+			}
+
+			if err := d.Skip(); err != nil {
+				return nil, nil, err
+			}
+			depth--
+			end := d.InputOffset()
+
+			raw := body[start:end]
+			var idx xmlEntryIndex
+			if err := xml.Unmarshal(raw, &idx); err != nil {
+				return nil, nil, err
+			}
+			entries = append(entries, &RawEntry{
+				Id:        strings.TrimSpace(firstNonEmpty(idx.Id, idx.Guid, idx.Link)),
+				Updated:   strings.TrimSpace(idx.Updated),
+				Published: strings.TrimSpace(firstNonEmpty(idx.Published, idx.PubDate, idx.DCDate)),
+				Raw:       raw,
+			})
+
+			kept.Write(body[keptFrom:start])
+			keptFrom = end
+			if insertAt < 0 {
+				insertAt = kept.Len()
+			}
+
+		case xml.EndElement:
+			isContainer := (!inChannel && depth == 1) ||
+				(inChannel && depth == 2 && t.Name.Local == "channel")
+			if isContainer && container < 0 {
+				container = kept.Len() + int(start-keptFrom)
+			}
+			depth--
+		}
+	}
+	kept.Write(body[keptFrom:])
+
+	if insertAt < 0 {
+		insertAt = container
+	}
+	if insertAt < 0 {
+		return nil, nil, errors.New("no root element")
+	}
+
+	doc := kept.Bytes()
+	return &Skeleton{
+		Format: f,
+		Head:   doc[:insertAt],
+		Tail:   doc[insertAt:],
+	}, entries, nil
+}
+
+type jsonEntryIndex struct {
+	Id            json.RawMessage `json:"id"`
+	DatePublished string          `json:"date_published"`
+	DateModified  string          `json:"date_modified"`
+}
+
+// splitJSON takes out the items of a JSON Feed. The rest of the
+// document is re-encoded, with the items last.
+func splitJSON(body []byte) (*Skeleton, []*RawEntry, error) {
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, nil, err
+	}
+
+	var items []json.RawMessage
+	if raw, ok := doc["items"]; ok {
+		if err := json.Unmarshal(raw, &items); err != nil {
+			return nil, nil, err
+		}
+	}
+	delete(doc, "items")
+
+	entries := make([]*RawEntry, 0, len(items))
+	for _, item := range items {
+		var idx jsonEntryIndex
+		if err := json.Unmarshal(item, &idx); err != nil {
+			return nil, nil, err
+		}
+		entries = append(entries, &RawEntry{
+			Id:        jsonId(idx.Id),
+			Updated:   idx.DateModified,
+			Published: idx.DatePublished,
+			Raw:       item,
+		})
+	}
+
+	return &Skeleton{
+		Format: FormatJSON,
+		Head:   jsonHead(doc),
+		Tail:   []byte("]}"),
+	}, entries, nil
+}
+
+// jsonHead encodes the members of a JSON Feed other than its items,
+// followed by the opening of the items.
+func jsonHead(doc map[string]json.RawMessage) []byte {
+	keys := make([]string, 0, len(doc))
+	for k := range doc {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var head bytes.Buffer
+	head.WriteString("{")
+	for _, k := range keys {
+		name, _ := json.Marshal(k)
+		head.Write(name)
+		head.WriteString(":")
+		head.Write(doc[k])
+		head.WriteString(",")
+	}
+	head.WriteString(`"items":[`)
+	return head.Bytes()
+}
+
+var xmlEncodingDecl = regexp.MustCompile(`^\s*<\?xml[^>]*encoding=["']([A-Za-z0-9._-]+)["']`)
+
+// ContentType returns the Content-Type a document in format f should
+// be distributed with, given the one it was served with. A media type
+// that fits the format is kept; otherwise the canonical one is used.
+// The charset is kept, or taken from the XML declaration, so that
+// subscribers decode the bytes the way the publisher meant them.
+func ContentType(f Format, original string, body []byte) string {
+	mediaType, params, _ := mime.ParseMediaType(original)
+
+	fits := false
+	switch f {
+	case FormatAtom, FormatRSS:
+		fits = mediaType == f.MediaType() || mediaType == "application/xml" || mediaType == "text/xml"
+	case FormatJSON:
+		fits = mediaType == f.MediaType() || mediaType == "application/json"
+	}
+	if !fits {
+		mediaType = f.MediaType()
+	}
+
+	charset := params["charset"]
+	if charset == "" && (f == FormatAtom || f == FormatRSS) {
+		charset = "utf-8"
+		if m := xmlEncodingDecl.FindSubmatch(body); m != nil {
+			charset = strings.ToLower(string(m[1]))
+		}
+	}
+
+	if charset == "" {
+		return mediaType
+	}
+	return mime.FormatMediaType(mediaType, map[string]string{"charset": charset})
+}
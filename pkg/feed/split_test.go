@@ -0,0 +1,123 @@
+package feed
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestSplitAtom(t *testing.T) {
+	sk, entries, err := Split(FormatAtom, []byte(atomDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatal("Got an unexpected number of entries:", len(entries))
+	}
+	if entries[0].Id != "urn:uuid:1225c695-cfb8-4ebb-aaaa-80da344efa6a" {
+		t.Errorf("Didn't find the correct id, got %s", entries[0].Id)
+	}
+	if entries[0].Updated != "2003-12-13T18:30:02Z" {
+		t.Errorf("Didn't find the correct date, got %s", entries[0].Updated)
+	}
+	if !bytes.HasPrefix(entries[0].Raw, []byte("<entry>")) || !bytes.HasSuffix(entries[0].Raw, []byte("</entry>")) {
+		t.Errorf("Raw entry isn't the whole element: %s", entries[0].Raw)
+	}
+
+	// Putting everything back gives the original document
+	if doc := sk.Assemble([][]byte{entries[0].Raw}); string(doc) != atomDoc {
+		t.Errorf("Assembled document differs from the original:\n%s", doc)
+	}
+
+	// Without entries, we still have a valid feed
+	f, err := Parse("application/atom+xml", sk.Assemble(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Title != "Example Feed" || len(f.Entries) != 0 {
+		t.Errorf("Unexpected empty feed: %+v", f)
+	}
+}
+
+func TestSplitRSS(t *testing.T) {
+	sk, entries, err := Split(FormatRSS, []byte(rssDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatal("Got an unexpected number of entries:", len(entries))
+	}
+	if entries[0].Published != "Tue, 03 Jun 2003 09:39:21 GMT" {
+		t.Errorf("Didn't find the correct date, got %s", entries[0].Published)
+	}
+
+	doc := sk.Assemble([][]byte{entries[0].Raw, entries[0].Raw})
+	f, err := Parse("application/rss+xml", doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Entries) != 2 {
+		t.Errorf("Expected 2 entries in assembled document, got %d", len(f.Entries))
+	}
+}
+
+func TestSplitEmptyRSS(t *testing.T) {
+	empty := `<rss version="2.0"><channel><title>Nothing</title></channel></rss>`
+	sk, entries, err := Split(FormatRSS, []byte(empty))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Fatal("Got an unexpected number of entries:", len(entries))
+	}
+
+	doc := string(sk.Assemble([][]byte{[]byte("<item><guid>1</guid></item>")}))
+	if !strings.Contains(doc, "<item><guid>1</guid></item></channel>") {
+		t.Errorf("Entry wasn't put in the channel: %s", doc)
+	}
+}
+
+func TestSplitJSON(t *testing.T) {
+	sk, entries, err := Split(FormatJSON, []byte(jsonDoc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Id != "2" {
+		t.Fatalf("Unexpected entries: %+v", entries)
+	}
+
+	doc := sk.Assemble([][]byte{entries[0].Raw, entries[0].Raw})
+	if !json.Valid(doc) {
+		t.Fatalf("Assembled document isn't valid JSON: %s", doc)
+	}
+	f, err := Parse("application/feed+json", doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.Title != "My Example Feed" || len(f.Entries) != 2 {
+		t.Errorf("Unexpected assembled feed: %+v", f)
+	}
+}
+
+func TestContentType(t *testing.T) {
+	cases := []struct {
+		format   Format
+		original string
+		body     string
+		expected string
+	}{
+		{FormatAtom, "application/atom+xml", atomDoc, "application/atom+xml; charset=utf-8"},
+		{FormatAtom, "text/xml; charset=UTF-8", atomDoc, "text/xml; charset=UTF-8"},
+		{FormatRSS, "", rssDoc, "application/rss+xml; charset=iso-8859-1"},
+		{FormatRSS, "text/plain", rssDoc, "application/rss+xml; charset=iso-8859-1"},
+		{FormatJSON, "application/json", jsonDoc, "application/json"},
+		{FormatJSON, "", jsonDoc, "application/feed+json"},
+	}
+
+	for _, c := range cases {
+		if ct := ContentType(c.format, c.original, []byte(c.body)); ct != c.expected {
+			t.Errorf("ContentType(%s, %q) = %q, expected %q", c.format, c.original, ct, c.expected)
+		}
+	}
+}
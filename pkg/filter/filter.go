@@ -0,0 +1,359 @@
+// Filters selecting feed entries, written in a small expression
+// language:
+//
+//	golang release                 entries containing both words
+//	"release candidate"            entries containing the phrase
+//	category:security OR cve       either of them
+//	author:rakoo -title:draft      negation, with - or NOT
+//	(tag:go OR tag:rust) AND NOT beta
+//
+// Words without a field are looked for in the title, summary, content,
+// author and categories. Fields are title, author, category (or tag),
+// summary, content, id and link. Everything is case-insensitive;
+// categories must match exactly, other fields only contain the value.
+package filter
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/rakoo/psgb/pkg/feed"
+)
+
+const (
+	// Filters come from subscribers; these keep parsing and matching
+	// them cheap
+	MAX_FILTER_LENGTH = 1024
+	MAX_FILTER_DEPTH  = 32 // nested parentheses and negations
+)
+
+// A Filter decides which entries go through.
+type Filter struct {
+	source string
+	root   node
+}
+
+// Parse parses a filter expression.
+func Parse(expr string) (*Filter, error) {
+	if len(expr) > MAX_FILTER_LENGTH {
+		return nil, fmt.Errorf("filter is longer than %d bytes", MAX_FILTER_LENGTH)
+	}
+
+	tokens, err := tokenize(expr)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 0 {
+		return nil, errors.New("empty filter")
+	}
+
+	p := &parser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %s", p.tokens[p.pos])
+	}
+
+	return &Filter{source: expr, root: root}, nil
+}
+
+// Match tells whether e goes through the filter.
+func (f *Filter) Match(e *feed.Entry) bool {
+	return f.root.match(e)
+}
+
+// String returns the expression the filter was parsed from, or "" for
+// a nil filter.
+func (f *Filter) String() string {
+	if f == nil {
+		return ""
+	}
+	return f.source
+}
+
+type node interface {
+	match(e *feed.Entry) bool
+}
+
+type andNode struct{ left, right node }
+type orNode struct{ left, right node }
+type notNode struct{ operand node }
+
+// A termNode looks for value in field, or in any text if field is empty.
+type termNode struct {
+	field string
+	value string // lower-cased
+}
+
+func (n *andNode) match(e *feed.Entry) bool { return n.left.match(e) && n.right.match(e) }
+func (n *orNode) match(e *feed.Entry) bool  { return n.left.match(e) || n.right.match(e) }
+func (n *notNode) match(e *feed.Entry) bool { return !n.operand.match(e) }
+
+func (n *termNode) match(e *feed.Entry) bool {
+	contains := func(s string) bool {
+		return strings.Contains(strings.ToLower(s), n.value)
+	}
+
+	switch n.field {
+	case "title":
+		return contains(e.Title)
+	case "author":
+		return contains(e.Author)
+	case "summary":
+		return contains(e.Summary)
+	case "content":
+		return contains(e.Content)
+	case "id":
+		return contains(e.Id)
+	case "link":
+		return contains(e.Link)
+	case "category", "tag":
+		for _, c := range e.Categories {
+			if strings.ToLower(strings.TrimSpace(c)) == n.value {
+				return true
+			}
+		}
+		return false
+	}
+
+	if contains(e.Title) || contains(e.Summary) || contains(e.Content) || contains(e.Author) {
+		return true
+	}
+	for _, c := range e.Categories {
+		if contains(c) {
+			return true
+		}
+	}
+	return false
+}
+
+var fields = map[string]bool{
+	"title": true, "author": true, "summary": true, "content": true,
+	"id": true, "link": true, "category": true, "tag": true,
+}
+
+type tokenKind int
+
+const (
+	tokenTerm tokenKind = iota
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind  tokenKind
+	field string
+	value string
+}
+
+func (t token) String() string {
+	switch t.kind {
+	case tokenAnd:
+		return "AND"
+	case tokenOr:
+		return "OR"
+	case tokenNot:
+		return "NOT"
+	case tokenOpen:
+		return `"("`
+	case tokenClose:
+		return `")"`
+	}
+	if t.field != "" {
+		return fmt.Sprintf("%s:%q", t.field, t.value)
+	}
+	return fmt.Sprintf("%q", t.value)
+}
+
+func tokenize(expr string) ([]token, error) {
+	var tokens []token
+	rs := []rune(expr)
+
+	for i := 0; i < len(rs); {
+		r := rs[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+			continue
+		case r == '(':
+			tokens = append(tokens, token{kind: tokenOpen})
+			i++
+			continue
+		case r == ')':
+			tokens = append(tokens, token{kind: tokenClose})
+			i++
+			continue
+		case r == '-':
+			tokens = append(tokens, token{kind: tokenNot})
+			i++
+			continue
+		}
+
+		// A word, maybe with a field, maybe quoted
+		start := i
+		for i < len(rs) && !unicode.IsSpace(rs[i]) && rs[i] != '(' && rs[i] != ')' && rs[i] != '"' && rs[i] != ':' {
+			i++
+		}
+		word := string(rs[start:i])
+
+		field := ""
+		if i < len(rs) && rs[i] == ':' {
+			field = strings.ToLower(word)
+			if !fields[field] {
+				return nil, fmt.Errorf("unknown field %q", word)
+			}
+			i++
+			start = i
+			for i < len(rs) && !unicode.IsSpace(rs[i]) && rs[i] != '(' && rs[i] != ')' && rs[i] != '"' {
+				i++
+			}
+			word = string(rs[start:i])
+		}
+
+		quoted := false
+		if word == "" && i < len(rs) && rs[i] == '"' {
+			end := i + 1
+			for end < len(rs) && rs[end] != '"' {
+				end++
+			}
+			if end == len(rs) {
+				return nil, errors.New("unterminated quote")
+			}
+			word = string(rs[i+1 : end])
+			quoted = true
+			i = end + 1
+		}
+
+		if word == "" {
+			return nil, fmt.Errorf("missing value at position %d", start)
+		}
+
+		if !quoted && field == "" {
+			switch word {
+			case "AND":
+				tokens = append(tokens, token{kind: tokenAnd})
+				continue
+			case "OR":
+				tokens = append(tokens, token{kind: tokenOr})
+				continue
+			case "NOT":
+				tokens = append(tokens, token{kind: tokenNot})
+				continue
+			}
+		}
+
+		tokens = append(tokens, token{kind: tokenTerm, field: field, value: strings.ToLower(word)})
+	}
+
+	return tokens, nil
+}
+
+// A recursive descent parser for:
+//
+//	or    = and { "OR" and }
+//	and   = unary { [ "AND" ] unary }
+//	unary = ( "NOT" | "-" ) unary | "(" or ")" | term
+type parser struct {
+	tokens []token
+	pos    int
+	depth  int // of nested unary expressions
+}
+
+func (p *parser) peek() (token, bool) {
+	if p.pos >= len(p.tokens) {
+		return token{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+func (p *parser) parseOr() (node, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind != tokenOr {
+			return left, nil
+		}
+		p.pos++
+
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &orNode{left, right}
+	}
+}
+
+func (p *parser) parseAnd() (node, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t, ok := p.peek()
+		if !ok || t.kind == tokenOr || t.kind == tokenClose {
+			return left, nil
+		}
+		if t.kind == tokenAnd {
+			p.pos++
+		}
+
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &andNode{left, right}
+	}
+}
+
+func (p *parser) parseUnary() (node, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, errors.New("unexpected end of filter")
+	}
+	p.pos++
+
+	if t.kind == tokenNot || t.kind == tokenOpen {
+		p.depth++
+		defer func() { p.depth-- }()
+		if p.depth > MAX_FILTER_DEPTH {
+			return nil, fmt.Errorf("filter is nested more than %d times", MAX_FILTER_DEPTH)
+		}
+	}
+
+	switch t.kind {
+	case tokenNot:
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand}, nil
+
+	case tokenOpen:
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if t, ok := p.peek(); !ok || t.kind != tokenClose {
+			return nil, errors.New(`missing ")"`)
+		}
+		p.pos++
+		return inner, nil
+
+	case tokenTerm:
+		return &termNode{field: t.field, value: t.value}, nil
+	}
+
+	return nil, fmt.Errorf("unexpected %s", t)
+}
@@ -0,0 +1,122 @@
+package filter
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/rakoo/psgb/pkg/feed"
+)
+
+var testEntry = &feed.Entry{
+	Id:         "urn:entry:1",
+	Title:      "Go 1.22 Release Candidate",
+	Link:       "https://example.com/go-1.22-rc",
+	Author:     "Jane Doe",
+	Categories: []string{"Golang", "Releases"},
+	Summary:    "The first release candidate is out.",
+	Content:    "<p>Please test it and report e-mail issues.</p>",
+}
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		expr     string
+		expected bool
+	}{
+		{"release", true},
+		{"RELEASE candidate", true},
+		{"release rust", false},
+		{`"release candidate"`, true},
+		{`"candidate release"`, false},
+		{"rust OR candidate", true},
+		{"rust OR python", false},
+		{"release AND NOT rust", true},
+		{"release -candidate", false},
+		{"e-mail", true},
+		{"title:release", true},
+		{"title:test", false},
+		{"content:test", true},
+		{`author:"jane doe"`, true},
+		{"author:john", false},
+		{"category:golang", true},
+		{"tag:releases", true},
+		{"category:go", false},
+		{"id:urn:entry:1", true},
+		{"link:example.com", true},
+		{"summary:out", true},
+		{"(category:rust OR category:golang) AND candidate", true},
+		{"(category:rust OR category:python) AND candidate", false},
+		{"NOT (rust OR python)", true},
+		{"-(golang)", false},
+	}
+
+	for _, c := range cases {
+		f, err := Parse(c.expr)
+		if err != nil {
+			t.Errorf("Couldn't parse %q: %v", c.expr, err)
+			continue
+		}
+		if got := f.Match(testEntry); got != c.expected {
+			t.Errorf("%q: expected %v, got %v", c.expr, c.expected, got)
+		}
+	}
+}
+
+func TestPrecedence(t *testing.T) {
+	// AND binds tighter than OR
+	f, err := Parse("rust OR release candidate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Match(testEntry) {
+		t.Error("Expected rust OR (release AND candidate) to match")
+	}
+
+	f, err = Parse("release candidate OR rust python")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.Match(testEntry) {
+		t.Error("Expected (release AND candidate) OR (rust AND python) to match")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"   ",
+		"(release",
+		"release)",
+		`"release`,
+		"nosuchfield:x",
+		"title:",
+		"release OR",
+		"AND release",
+		"NOT",
+		strings.Repeat("(", 3<<20) + "x",
+		strings.Repeat("-", 3<<20) + "x",
+		strings.Repeat("(", MAX_FILTER_DEPTH+1) + "x" + strings.Repeat(")", MAX_FILTER_DEPTH+1),
+		strings.Repeat("NOT ", MAX_FILTER_DEPTH+1) + "x",
+		strings.Repeat("x ", MAX_FILTER_LENGTH),
+	} {
+		if _, err := Parse(expr); err == nil {
+			t.Errorf("Expected an error for %q", expr)
+		}
+	}
+}
+
+func TestNestingLimit(t *testing.T) {
+	expr := strings.Repeat("(", MAX_FILTER_DEPTH) + "release" + strings.Repeat(")", MAX_FILTER_DEPTH)
+	if _, err := Parse(expr); err != nil {
+		t.Fatalf("Expected %d levels to be accepted, got %v", MAX_FILTER_DEPTH, err)
+	}
+}
+
+func TestString(t *testing.T) {
+	f, err := Parse("category:go -beta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.String() != "category:go -beta" {
+		t.Errorf("Didn't keep the source, got %q", f.String())
+	}
+}
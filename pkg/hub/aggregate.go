@@ -0,0 +1,281 @@
+package hub
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/feed"
+	"github.com/rakoo/psgb/pkg/filter"
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+// Aggregate topics don't exist anywhere but in the hub: they are the
+// entries of their source topics merged chronologically, as an Atom
+// feed. Subscribers subscribe to them like to any other topic, and get
+// new content whenever one of the sources has some.
+//
+// Sources can be in any format, so entries are rendered again from
+// their fields; anything the parser doesn't know about is lost.
+
+const AGGREGATE_CONTENT_TYPE = "application/atom+xml; charset=utf-8"
+
+// WithAggregate defines an aggregate topic merging the given sources.
+// Invalid aggregates are logged and ignored.
+func WithAggregate(topic string, sources ...string) Option {
+	return func(h *Hub) {
+		h.initialAggregates = append(h.initialAggregates, append([]string{topic}, sources...))
+	}
+}
+
+// SetAggregate defines topic as merging the given sources, replacing
+// any previous definition. Sources can't be aggregates themselves.
+func (h *Hub) SetAggregate(topic string, sources []string) error {
+	ts := make([]Topic, len(sources))
+	for i, s := range sources {
+		ts[i] = Topic(s)
+	}
+	if err := h.store.setAggregate(Topic(topic), ts); err != nil {
+		return err
+	}
+
+	h.logger.Info("Aggregate set", logging.KeyTopic, topic, "sources", len(sources))
+	return nil
+}
+
+// RemoveAggregate removes an aggregate topic. Its subscribers stay,
+// but won't receive anything anymore.
+func (h *Hub) RemoveAggregate(topic string) bool {
+	removed := h.store.removeAggregate(Topic(topic))
+	if removed {
+		h.logger.Info("Aggregate removed", logging.KeyTopic, topic)
+	}
+	return removed
+}
+
+// Aggregates returns all aggregate topics with their sources.
+func (h *Hub) Aggregates() map[string][]string {
+	return h.store.aggregateDefinitions()
+}
+
+func (cs *contentStore) setAggregate(topic Topic, sources []Topic) error {
+	if topic == "" {
+		return errors.New("empty aggregate topic")
+	}
+	if len(sources) == 0 {
+		return errors.New("an aggregate needs sources")
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	if _, ok := cs.content[topic]; ok {
+		return fmt.Errorf("%s is already a topic", topic)
+	}
+	if _, ok := cs.opaque[topic]; ok {
+		return fmt.Errorf("%s is already a topic", topic)
+	}
+
+	seen := make(map[Topic]bool)
+	var unique []Topic
+	for _, s := range sources {
+		if s == topic {
+			return errors.New("an aggregate can't be its own source")
+		}
+		if _, ok := cs.aggregates[s]; ok {
+			return fmt.Errorf("source %s is an aggregate", s)
+		}
+		if !seen[s] {
+			seen[s] = true
+			unique = append(unique, s)
+		}
+	}
+	for _, other := range cs.aggregates {
+		for _, s := range other {
+			if s == topic {
+				return fmt.Errorf("%s is the source of another aggregate", topic)
+			}
+		}
+	}
+
+	cs.aggregates[topic] = unique
+	return nil
+}
+
+func (cs *contentStore) removeAggregate(topic Topic) bool {
+	cs.Lock()
+	defer cs.Unlock()
+
+	_, ok := cs.aggregates[topic]
+	delete(cs.aggregates, topic)
+	return ok
+}
+
+func (cs *contentStore) aggregateDefinitions() map[string][]string {
+	cs.Lock()
+	defer cs.Unlock()
+
+	defs := make(map[string][]string, len(cs.aggregates))
+	for topic, sources := range cs.aggregates {
+		for _, s := range sources {
+			defs[string(topic)] = append(defs[string(topic)], string(s))
+		}
+	}
+	return defs
+}
+
+func (cs *contentStore) isAggregate(topic Topic) bool {
+	cs.Lock()
+	defer cs.Unlock()
+
+	_, ok := cs.aggregates[topic]
+	return ok
+}
+
+// aggregatesOf returns the aggregates source is part of.
+func (cs *contentStore) aggregatesOf(source Topic) []Topic {
+	cs.Lock()
+	defer cs.Unlock()
+
+	var aggregates []Topic
+	for topic, sources := range cs.aggregates {
+		for _, s := range sources {
+			if s == source {
+				aggregates = append(aggregates, topic)
+				break
+			}
+		}
+	}
+	sort.Slice(aggregates, func(i, j int) bool { return aggregates[i] < aggregates[j] })
+	return aggregates
+}
+
+// aggregateAfterDate is contentAfterDate for an aggregate: the entries
+// of all sources are merged by date. The caller must hold the lock.
+func (cs *contentStore) aggregateAfterDate(topic Topic, sources []Topic, t time.Time, limit int, f *filter.Filter) (rawContent []byte, next time.Time) {
+	type cursor struct {
+		source Topic
+		node   *indexNode
+	}
+	var cursors []*cursor
+	for _, s := range sources {
+		if items := cs.content[s]; items != nil {
+			if n := items.seek(t); n != nil {
+				cursors = append(cursors, &cursor{s, n})
+			}
+		}
+	}
+
+	next = t
+	var entries [][]byte
+	for len(cursors) > 0 {
+		oldest := 0
+		for i, c := range cursors {
+			if c.node.date.Before(cursors[oldest].node.date) {
+				oldest = i
+			}
+		}
+		c := cursors[oldest]
+
+		// Entries at the same date go in the same page, or the cursor
+		// would skip some
+		if limit > 0 && len(entries) >= limit && c.node.date.After(next.Add(-time.Nanosecond)) {
+			break
+		}
+
+		next = c.node.date.Add(time.Nanosecond)
+		parsed := cs.parsedEntry(c.source, c.node.entry)
+		if f == nil || f.Match(parsed) {
+			if c.node.entry.atom == nil {
+				raw, err := feed.AtomEntry(parsed, c.node.date, string(c.source))
+				if err != nil {
+					cs.logger.Warn("Couldn't render entry for aggregate", logging.KeyTopic, topic, "source", c.source, logging.Err(err))
+				}
+				c.node.entry.atom = raw
+			}
+			if c.node.entry.atom != nil {
+				entries = append(entries, c.node.entry.atom)
+			}
+		}
+
+		if c.node = c.node.following(); c.node == nil {
+			cursors = append(cursors[:oldest], cursors[oldest+1:]...)
+		}
+	}
+
+	if len(entries) == 0 {
+		return nil, next
+	}
+
+	header := &feed.Skeleton{
+		Format: feed.FormatAtom,
+		Head: []byte(fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>`+"\n"+
+			`<feed xmlns="http://www.w3.org/2005/Atom"><id>%s</id><title>%s</title><updated>%s</updated><link rel="self" href="%s"/>`,
+			xmlEscape(string(topic)), xmlEscape(fmt.Sprintf("Aggregate of %d topics", len(sources))),
+			time.Now().UTC().Format(time.RFC3339), xmlEscape(string(topic)))),
+		Tail: []byte("</feed>"),
+	}
+	return header.Assemble(entries), next
+}
+
+// adminHandler lets the hub's operator manage aggregates:
+//
+//	GET /aggregates                            all aggregates, as JSON
+//	POST /aggregates hub.topic=...&hub.source=...&hub.source=...
+//	DELETE /aggregates?hub.topic=...
+type adminHandler struct {
+	hub *Hub
+}
+
+// AdminHandler returns the handler of the admin API. It isn't served
+// by the hub itself: mount it somewhere only operators can reach.
+func (h *Hub) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/aggregates", &adminHandler{hub: h})
+	return mux
+}
+
+func (ah *adminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(ah.hub.Aggregates())
+
+	case "POST":
+		topic := r.FormValue("hub.topic")
+		if topic == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Didn't find hub.topic"))
+			return
+		}
+		if err := ah.hub.SetAggregate(topic, r.Form["hub.source"]); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(err.Error()))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case "DELETE":
+		topic := r.FormValue("hub.topic")
+		if !ah.hub.RemoveAggregate(topic) {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte("Didn't find aggregate"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func xmlEscape(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
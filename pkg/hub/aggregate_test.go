@@ -0,0 +1,178 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/feed"
+)
+
+// A publisher whose document can change during the test.
+type changingPublisher struct {
+	*httptest.Server
+	mu   sync.Mutex
+	body string
+}
+
+func newChangingPublisher(t *testing.T, contentType, body string) *changingPublisher {
+	p := &changingPublisher{body: body}
+	p.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		w.Header().Set("Content-Type", contentType)
+		fmt.Fprint(w, p.body)
+	}))
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *changingPublisher) set(body string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.body = body
+}
+
+func testRSS(base time.Time, minutes ...int) string {
+	var b strings.Builder
+	b.WriteString(`<rss version="2.0"><channel><title>RSS source</title>`)
+	for _, m := range minutes {
+		fmt.Fprintf(&b, "<item><guid>rss-%d</guid><title>Item %d</title><pubDate>%s</pubDate></item>",
+			m, m, base.Add(time.Duration(m)*time.Minute).Format(time.RFC1123Z))
+	}
+	b.WriteString(`</channel></rss>`)
+	return b.String()
+}
+
+func deliveredIds(t *testing.T, d *receivedDelivery) []string {
+	if ct := d.header.Get("Content-Type"); ct != AGGREGATE_CONTENT_TYPE {
+		t.Fatalf("Expected %s, got %s", AGGREGATE_CONTENT_TYPE, ct)
+	}
+	f, err := feed.Parse(d.header.Get("Content-Type"), d.body)
+	if err != nil {
+		t.Fatalf("Aggregate isn't a valid feed: %v\n%s", err, d.body)
+	}
+	var ids []string
+	for _, e := range f.Entries {
+		ids = append(ids, e.Id)
+	}
+	return ids
+}
+
+func TestAggregate(t *testing.T) {
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	atom := newChangingPublisher(t, "application/atom+xml", string(testEntriesFeedFrom(future, 1, 1)))
+	// Half a minute later, so no date is shared between the sources
+	rssBase := future.Add(30 * time.Second)
+	rss := newChangingPublisher(t, "application/rss+xml", testRSS(rssBase, 2))
+	aggregate := "urn:psgb:aggregate:news"
+
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub(), WithRetention(noRetention), WithAggregate(aggregate, atom.URL, rss.URL))
+
+	publish(t, hubSrv.URL, atom.URL)
+	publish(t, hubSrv.URL, rss.URL)
+	time.Sleep(100 * time.Millisecond)
+
+	subscribe(t, h, hubSrv.URL, ws, subscribeForm("subscribe", ws.URL, aggregate))
+
+	// Both sources get merged chronologically
+	atom.set(string(testEntriesFeedFrom(future, 1, 3)))
+	publish(t, hubSrv.URL, atom.URL)
+	d := ws.nextDelivery(t)
+	ids := deliveredIds(t, d)
+	if strings.Join(ids, " ") != "entry-1 entry-2 rss-2 entry-3" {
+		t.Fatalf("Expected entries of both sources in order, got %v", ids)
+	}
+	if !strings.Contains(string(d.body), "<source><id>"+rss.URL+"</id>") {
+		t.Fatalf("Expected entries to point to their source, got %s", d.body)
+	}
+	checkLinks(t, d, hubSrv.URL, aggregate)
+
+	// An update to any source reaches the aggregate's subscribers
+	rss.set(testRSS(rssBase, 2, 4))
+	publish(t, hubSrv.URL, rss.URL)
+	ids = deliveredIds(t, ws.nextDelivery(t))
+	if strings.Join(ids, " ") != "rss-4" {
+		t.Fatalf("Expected only the new entry, got %v", ids)
+	}
+	ws.expectNoDelivery(t)
+}
+
+func TestSetAggregateErrors(t *testing.T) {
+	h, _ := newTestHub(t)
+	h.store.processNewContent(testEntriesFeed(1, 1), "application/atom+xml", "http://example.com/feed")
+
+	if err := h.SetAggregate("agg", []string{"http://example.com/a", "http://example.com/b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		topic   string
+		sources []string
+	}{
+		{"", []string{"http://example.com/a"}},
+		{"other", nil},
+		{"http://example.com/feed", []string{"http://example.com/a"}},
+		{"other", []string{"other"}},
+		{"other", []string{"agg"}},
+		{"http://example.com/a", []string{"http://example.com/c"}},
+	} {
+		if err := h.SetAggregate(c.topic, c.sources); err == nil {
+			t.Errorf("Expected an error for %q from %v", c.topic, c.sources)
+		}
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	h, _ := newTestHub(t)
+	admin := httptest.NewServer(h.AdminHandler())
+	t.Cleanup(admin.Close)
+
+	resp := postForm(t, admin.URL+"/aggregates", url.Values{
+		"hub.topic":  {"agg"},
+		"hub.source": {"http://example.com/a", "http://example.com/b"},
+	})
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 when setting an aggregate, got %s", resp.Status)
+	}
+
+	resp = postForm(t, admin.URL+"/aggregates", url.Values{"hub.topic": {"empty"}})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an aggregate without sources, got %s", resp.Status)
+	}
+
+	resp, err := http.Get(admin.URL + "/aggregates")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var aggregates map[string][]string
+	if err := json.NewDecoder(resp.Body).Decode(&aggregates); err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if len(aggregates) != 1 || len(aggregates["agg"]) != 2 {
+		t.Fatalf("Expected the aggregate with its 2 sources, got %v", aggregates)
+	}
+
+	req, _ := http.NewRequest("DELETE", admin.URL+"/aggregates?hub.topic=agg", nil)
+	for _, expected := range []int{http.StatusNoContent, http.StatusNotFound} {
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != expected {
+			t.Fatalf("Expected %d when deleting, got %s", expected, resp.Status)
+		}
+	}
+	if len(h.Aggregates()) != 0 {
+		t.Fatal("Expected the aggregate to be gone")
+	}
+}
@@ -0,0 +1,154 @@
+package hub
+
+import (
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+
+	"github.com/rakoo/psgb/pkg/feed"
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+// The history of a topic is cut in pages of the hub's page size, in
+// the order entries were first stored: page N holds entries N*size to
+// (N+1)*size-1. An entry dated before ones we already have goes in the
+// newest page, so archives never change. Full pages are archive
+// documents; the rest is the current document.
+//
+// An archive is only served while the hub keeps all of its entries:
+// once retention evicted some of them, it can't be the same document
+// anymore. Retention has to keep more than a page of entries for
+// archives to exist at all.
+type historyPage struct {
+	skeleton    *feed.Skeleton
+	contentType string
+	entries     [][]byte
+
+	number   int
+	archives int  // number of full pages
+	hasPrev  bool // the previous archive is served
+	hasNext  bool // the next archive is served
+}
+
+// historyPage returns page number of topic's history, or the current
+// page if number is negative. ok is false if there is no such page.
+func (cs *contentStore) historyPage(topic Topic, number, size int) (page *historyPage, ok bool) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	items := cs.content[topic]
+	header := cs.contentHeader[topic]
+	if items == nil || header == nil || size <= 0 {
+		return nil, false
+	}
+
+	page = &historyPage{
+		skeleton:    header,
+		contentType: cs.contentType[topic],
+		archives:    cs.nextSeq[topic] / size,
+	}
+
+	stored := make(map[int]int) // page -> entries still stored
+	for n := items.first(); n != nil; n = n.following() {
+		stored[n.entry.seq/size]++
+	}
+	served := func(number int) bool {
+		return number >= 0 && number < page.archives && stored[number] == size
+	}
+
+	if number < 0 {
+		number = page.archives
+	} else if !served(number) {
+		return nil, false
+	}
+	page.number = number
+	page.hasPrev = served(number - 1)
+	page.hasNext = served(number + 1)
+
+	var inPage []*storedEntry
+	for n := items.first(); n != nil; n = n.following() {
+		if n.entry.seq/size == number {
+			inPage = append(inPage, n.entry)
+		}
+	}
+	sort.Slice(inPage, func(i, j int) bool { return inPage[i].seq < inPage[j].seq })
+	for _, e := range inPage {
+		page.entries = append(page.entries, e.raw)
+	}
+
+	return page, true
+}
+
+// Serves the history of topics, as RFC 5005 archived feeds:
+// /archive?hub.topic=... is the current document, linking to the
+// previous archive, /archive?hub.topic=...&page=N are archives.
+type archiveHandler struct {
+	hub    *Hub
+	logger *slog.Logger
+}
+
+func newArchiveHandler(h *Hub, logger *slog.Logger) *archiveHandler {
+	return &archiveHandler{hub: h, logger: logger}
+}
+
+func (ah *archiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := ah.logger.With(logging.KeyRequestID, logging.RequestID(r))
+
+	if r.Method != "GET" {
+		logger.Debug("Bad method on archive", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := r.FormValue("hub.topic")
+	if topic == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Didn't find hub.topic"))
+		return
+	}
+
+	number := -1
+	if rawPage := r.FormValue("page"); rawPage != "" {
+		var err error
+		number, err = strconv.Atoi(rawPage)
+		if err != nil || number < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Bad page"))
+			return
+		}
+	}
+
+	page, ok := ah.hub.store.historyPage(Topic(topic), number, ah.hub.pageSize)
+	if !ok {
+		logger.Debug("No such page", logging.KeyTopic, topic, "page", number)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Didn't find this page of the topic's history"))
+		return
+	}
+
+	current := ah.pageUrl(topic, -1)
+	links := []feed.HistoryLink{{Rel: "current", Href: current}}
+	if page.hasPrev {
+		links = append(links, feed.HistoryLink{Rel: "prev-archive", Href: ah.pageUrl(topic, page.number-1)})
+	}
+	if page.hasNext {
+		links = append(links, feed.HistoryLink{Rel: "next-archive", Href: ah.pageUrl(topic, page.number+1)})
+	}
+	isArchive := page.number < page.archives
+
+	w.Header().Set("Content-Type", page.contentType)
+	w.Header().Add("Link", "<"+current+`>; rel="current"`)
+	w.Write(page.skeleton.WithHistory(isArchive, links...).Assemble(page.entries))
+}
+
+// pageUrl is the URL of a page of topic's history, or of the current
+// document if number is negative.
+func (ah *archiveHandler) pageUrl(topic string, number int) string {
+	params := url.Values{"hub.topic": {topic}}
+	if number >= 0 {
+		params.Set("page", strconv.Itoa(number))
+	}
+	return ah.hub.url + "/archive?" + params.Encode()
+}
@@ -0,0 +1,199 @@
+package hub
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/feed"
+	"github.com/rakoo/psgb/pkg/link"
+)
+
+func noRetention(string) Retention { return Retention{} }
+
+func TestBacklogIsDeliveredInPages(t *testing.T) {
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	topic := newWebsubPublisher(t, "application/atom+xml", string(testEntriesFeedFrom(future, 1, 12)))
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub(), WithPageSize(5), WithRetention(noRetention))
+
+	subscribe(t, h, hubSrv.URL, ws, subscribeForm("subscribe", ws.URL, topic.URL))
+	publish(t, hubSrv.URL, topic.URL)
+
+	next := 1
+	for _, expected := range []int{5, 5, 2} {
+		f, err := feed.Parse("application/atom+xml", ws.nextDelivery(t).body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(f.Entries) != expected {
+			t.Fatalf("Expected a page of %d entries, got %d", expected, len(f.Entries))
+		}
+		for _, e := range f.Entries {
+			if e.Id != fmt.Sprintf("entry-%d", next) {
+				t.Fatalf("Expected entry-%d, got %s", next, e.Id)
+			}
+			next++
+		}
+	}
+	ws.expectNoDelivery(t)
+}
+
+type archiveDoc struct {
+	links   map[string]string
+	entries []string
+	archive bool
+}
+
+func getArchive(t *testing.T, hubUrl, topic, page string) (*archiveDoc, int) {
+	params := url.Values{"hub.topic": {topic}}
+	if page != "" {
+		params.Set("page", page)
+	}
+	resp, err := http.Get(hubUrl + "/archive?" + params.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, resp.StatusCode
+	}
+
+	f, err := feed.Parse(resp.Header.Get("Content-Type"), body)
+	if err != nil {
+		t.Fatalf("Archive isn't a valid feed: %v\n%s", err, body)
+	}
+
+	doc := &archiveDoc{links: make(map[string]string)}
+	for _, e := range f.Entries {
+		doc.entries = append(doc.entries, e.Id)
+	}
+	for _, l := range link.Parse(resp.Header.Get("Link")) {
+		doc.links[l.Rel] = l.Uri
+	}
+
+	var history struct {
+		Links []struct {
+			Rel  string `xml:"rel,attr"`
+			Href string `xml:"href,attr"`
+		} `xml:"http://www.w3.org/2005/Atom link"`
+		Archive *struct{} `xml:"http://purl.org/syndication/history/1.0 archive"`
+	}
+	if err := xml.Unmarshal(body, &history); err != nil {
+		t.Fatal(err)
+	}
+	for _, l := range history.Links {
+		doc.links[l.Rel] = l.Href
+	}
+	doc.archive = history.Archive != nil
+	return doc, resp.StatusCode
+}
+
+func TestArchives(t *testing.T) {
+	h, hubSrv := newTestHub(t, WithPageSize(5), WithRetention(noRetention))
+	if _, err := h.store.processNewContent(testEntriesFeed(1, 12), "application/atom+xml", "http://example.com/feed"); err != nil {
+		t.Fatal(err)
+	}
+
+	current, status := getArchive(t, hubSrv.URL, "http://example.com/feed", "")
+	if status != http.StatusOK {
+		t.Fatalf("Expected 200 for the current document, got %d", status)
+	}
+	if current.archive || len(current.entries) != 2 || current.entries[0] != "entry-11" {
+		t.Fatalf("Unexpected current document: %+v", current)
+	}
+	if current.links["prev-archive"] != hubSrv.URL+"/archive?hub.topic=http%3A%2F%2Fexample.com%2Ffeed&page=1" {
+		t.Fatalf("Unexpected prev-archive link: %q", current.links["prev-archive"])
+	}
+
+	first, _ := getArchive(t, hubSrv.URL, "http://example.com/feed", "0")
+	if !first.archive || len(first.entries) != 5 || first.entries[0] != "entry-1" {
+		t.Fatalf("Unexpected first archive: %+v", first)
+	}
+	if _, ok := first.links["prev-archive"]; ok {
+		t.Fatal("First archive has a prev-archive link")
+	}
+	if first.links["next-archive"] == "" || first.links["current"] == "" {
+		t.Fatalf("Missing links in first archive: %+v", first.links)
+	}
+
+	if _, status := getArchive(t, hubSrv.URL, "http://example.com/feed", "2"); status != http.StatusNotFound {
+		t.Fatalf("The current page isn't an archive yet, got %d", status)
+	}
+
+	// Evicting the first 7 entries removes the first archive, and the
+	// second one isn't whole anymore
+	h.store.enforceRetention("http://example.com/feed", Retention{MaxEntries: 5}, time.Time{})
+	for _, number := range []string{"0", "1"} {
+		if _, status := getArchive(t, hubSrv.URL, "http://example.com/feed", number); status != http.StatusNotFound {
+			t.Fatalf("Expected 404 for evicted archive %s, got %d", number, status)
+		}
+	}
+	current, _ = getArchive(t, hubSrv.URL, "http://example.com/feed", "")
+	if len(current.entries) != 2 {
+		t.Fatalf("Unexpected current document: %+v", current)
+	}
+	if _, ok := current.links["prev-archive"]; ok {
+		t.Fatal("Linking to an evicted archive")
+	}
+}
+
+func TestArchivesWithDefaults(t *testing.T) {
+	h, hubSrv := newTestHub(t)
+	if _, err := h.store.processNewContent(testEntriesFeed(1, 4*DEFAULT_RETENTION_ENTRIES), "application/atom+xml", "http://example.com/feed"); err != nil {
+		t.Fatal(err)
+	}
+	h.store.enforceRetention("http://example.com/feed", h.retention("http://example.com/feed"), time.Time{})
+
+	current, _ := getArchive(t, hubSrv.URL, "http://example.com/feed", "")
+	prev := current.links["prev-archive"]
+	if prev == "" {
+		t.Fatalf("No archive with the default options: %+v", current)
+	}
+	u, err := url.Parse(prev)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, status := getArchive(t, hubSrv.URL, "http://example.com/feed", u.Query().Get("page"))
+	if status != http.StatusOK || !archive.archive || len(archive.entries) != DEFAULT_PAGE_SIZE {
+		t.Fatalf("Unexpected archive %s (%d): %+v", prev, status, archive)
+	}
+}
+
+func TestArchivesDontShift(t *testing.T) {
+	h, hubSrv := newTestHub(t, WithPageSize(5), WithRetention(noRetention))
+	if _, err := h.store.processNewContent(testEntriesFeed(1, 10), "application/atom+xml", "http://example.com/feed"); err != nil {
+		t.Fatal(err)
+	}
+
+	// entry-0 is dated before everything we have
+	if _, err := h.store.processNewContent(testEntriesFeed(0, 10), "application/atom+xml", "http://example.com/feed"); err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := getArchive(t, hubSrv.URL, "http://example.com/feed", "0")
+	if len(first.entries) != 5 || first.entries[0] != "entry-1" || first.entries[4] != "entry-5" {
+		t.Fatalf("First archive changed: %+v", first)
+	}
+	second, _ := getArchive(t, hubSrv.URL, "http://example.com/feed", "1")
+	if len(second.entries) != 5 || second.entries[0] != "entry-6" || second.entries[4] != "entry-10" {
+		t.Fatalf("Second archive changed: %+v", second)
+	}
+	current, _ := getArchive(t, hubSrv.URL, "http://example.com/feed", "")
+	if len(current.entries) != 1 || current.entries[0] != "entry-0" {
+		t.Fatalf("Expected the backdated entry in the current document: %+v", current)
+	}
+}
+
+func TestArchiveUnknownTopic(t *testing.T) {
+	_, hubSrv := newTestHub(t)
+
+	if _, status := getArchive(t, hubSrv.URL, "http://example.com/nothing", ""); status != http.StatusNotFound {
+		t.Fatalf("Expected 404 for an unknown topic, got %d", status)
+	}
+}
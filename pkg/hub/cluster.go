@@ -0,0 +1,564 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/filter"
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+// Several hubs can share their state through a Backend and act as one.
+// Topics are spread over shards; each shard is leased to one hub, which
+// is the only one fetching its topics and delivering them to callbacks.
+// Every hub keeps a copy of all subscriptions and content, so any of
+// them can take publish and subscribe requests, serve archives and
+// streams, and take over a shard when its owner goes away.
+//
+// A hub that takes over a shard delivers whatever subscribers didn't
+// acknowledge yet, so during a takeover deliveries are at least once.
+// Aggregates aren't shared: they must be defined the same way on all
+// hubs.
+//
+// The only Backend this package provides is MemoryBackend, for hubs in
+// the same process; hubs in different processes need a Backend on a
+// shared store, supplied by the program embedding them. psgb-hub
+// always runs on its own.
+
+const (
+	DEFAULT_SHARDS    = 64
+	DEFAULT_LEASE_TTL = 15 * time.Second
+
+	// How long a call to the backend can take
+	BACKEND_TIMEOUT = 5 * time.Second
+
+	leasePrefixNode  = "node/"
+	leasePrefixShard = "shard/"
+)
+
+// A Backend is the state shared by the hubs of a cluster: leases,
+// subscriptions, the latest version of every topic, and a feed of the
+// changes made to them. origin is the hub making a change; the changes
+// it makes aren't sent back to it.
+type Backend interface {
+	// Acquire takes or renews the lease called name for holder until
+	// ttl from now. It returns false if someone else holds it.
+	Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error)
+	// Release gives back a lease held by holder.
+	Release(ctx context.Context, name, holder string) error
+	// Holders returns the holder of every current lease whose name
+	// starts with prefix, by lease name.
+	Holders(ctx context.Context, prefix string) (map[string]string, error)
+
+	SaveSubscription(ctx context.Context, origin string, s *SharedSubscription) error
+	DeleteSubscription(ctx context.Context, origin string, topic, callback string) error
+	Subscriptions(ctx context.Context) ([]*SharedSubscription, error)
+
+	SaveContent(ctx context.Context, origin string, c *SharedContent) error
+	Contents(ctx context.Context) ([]*SharedContent, error)
+
+	// RequestFetch asks the hub owning topic to fetch it.
+	RequestFetch(ctx context.Context, origin string, topic string) error
+
+	// Watch returns the changes made by other hubs than node, in the
+	// order they were made, until stop is called.
+	Watch(node string) (changes <-chan *Change, stop func())
+}
+
+type SharedSubscription struct {
+	Topic        string       `json:"topic"`
+	Callback     string       `json:"callback"`
+	LeaseSeconds int          `json:"lease_seconds"`
+	Expires      time.Time    `json:"expires"`
+	Secret       string       `json:"secret,omitempty"`
+	DeliveryMode DeliveryMode `json:"delivery_mode,omitempty"`
+	Filter       string       `json:"filter,omitempty"`
+
+	// Entries updated before it were delivered
+	LastNotified time.Time `json:"last_notified"`
+}
+
+// The latest version of a topic, as it was fetched.
+type SharedContent struct {
+	Topic       string `json:"topic"`
+	ContentType string `json:"content_type,omitempty"`
+	Body        []byte `json:"body"`
+}
+
+type ChangeKind int
+
+const (
+	ChangeSubscription   ChangeKind = iota // Subscription was saved
+	ChangeUnsubscription                   // the subscription of Callback to Topic was deleted
+	ChangeContent                          // Content was saved
+	ChangeFetch                            // Topic must be fetched
+)
+
+type Change struct {
+	Kind   ChangeKind
+	Origin string
+
+	Subscription *SharedSubscription
+	Content      *SharedContent
+	Topic        string
+	Callback     string
+}
+
+// WithCluster makes the hub one of the hubs sharing backend. node
+// identifies it and must be unique in the cluster.
+func WithCluster(backend Backend, node string) Option {
+	return func(h *Hub) {
+		h.cluster = &cluster{backend: backend, node: node}
+	}
+}
+
+// WithShards sets how many shards topics are spread over. All hubs of a
+// cluster must use the same number.
+func WithShards(n int) Option {
+	return func(h *Hub) { h.shards = n }
+}
+
+// WithLeaseTTL sets how long a hub keeps its shards without renewing
+// them; they are renewed every third of it. This is how long a shard
+// can stay without owner when a hub dies.
+func WithLeaseTTL(ttl time.Duration) Option {
+	return func(h *Hub) { h.leaseTTL = ttl }
+}
+
+// A nil *cluster is a hub on its own: it owns every topic and shares
+// nothing.
+type cluster struct {
+	backend Backend
+	node    string
+	shards  int
+	ttl     time.Duration
+
+	hub     *Hub
+	ownedMu sync.RWMutex
+	owned   map[int]time.Time // shard -> when its lease runs out
+
+	stopping    chan struct{}
+	stopWatch   func()
+	loopsDone   sync.WaitGroup
+	stopOnce    sync.Once
+	releaseOnce sync.Once
+
+	logger *slog.Logger
+}
+
+// start loads the shared state, takes a first round of leases and
+// starts following the other hubs.
+func (c *cluster) start(h *Hub, logger *slog.Logger) {
+	if c == nil {
+		return
+	}
+	c.hub = h
+	c.shards = h.shards
+	c.ttl = h.leaseTTL
+	c.logger = logger
+	c.owned = make(map[int]time.Time)
+	c.stopping = make(chan struct{})
+
+	var changes <-chan *Change
+	changes, c.stopWatch = c.backend.Watch(c.node)
+	c.load()
+	for _, topic := range c.renewLeases() {
+		c.hub.ph.newContent <- topic
+	}
+
+	c.loopsDone.Add(2)
+	go func() {
+		defer c.loopsDone.Done()
+		c.leaseLoop()
+	}()
+	go func() {
+		defer c.loopsDone.Done()
+		c.followChanges(changes)
+	}()
+}
+
+// stop stops following the other hubs and renewing leases, which are
+// kept until release.
+func (c *cluster) stop() {
+	if c == nil {
+		return
+	}
+	c.stopOnce.Do(func() {
+		close(c.stopping)
+		c.stopWatch()
+	})
+	c.loopsDone.Wait()
+}
+
+// release gives back all leases, for other hubs to take over.
+func (c *cluster) release() {
+	if c == nil {
+		return
+	}
+	c.releaseOnce.Do(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), BACKEND_TIMEOUT)
+		defer cancel()
+
+		c.ownedMu.Lock()
+		for shard := range c.owned {
+			c.backend.Release(ctx, shardLease(shard), c.node)
+		}
+		c.owned = make(map[int]time.Time)
+		c.ownedMu.Unlock()
+		c.backend.Release(ctx, leasePrefixNode+c.node, c.node)
+	})
+}
+
+func (c *cluster) shardOf(topic Topic) int {
+	h := fnv.New32a()
+	h.Write([]byte(topic))
+	return int(h.Sum32() % uint32(c.shards))
+}
+
+func shardLease(shard int) string {
+	return fmt.Sprintf("%s%d", leasePrefixShard, shard)
+}
+
+// owns tells whether this hub is the one fetching and delivering topic.
+// A shard whose lease ran out isn't owned anymore, even if renewing it
+// failed or is late: another hub can have taken it.
+func (c *cluster) owns(topic Topic) bool {
+	if c == nil {
+		return true
+	}
+	c.ownedMu.RLock()
+	defer c.ownedMu.RUnlock()
+	return time.Now().Before(c.owned[c.shardOf(topic)])
+}
+
+func (c *cluster) leaseLoop() {
+	ticker := time.NewTicker(c.ttl / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.stopping:
+			return
+		case <-ticker.C:
+		}
+
+		for _, topic := range c.renewLeases() {
+			// Subscribers can be behind if the previous owner went away
+			// before delivering everything
+			c.hub.ph.newContent <- topic
+		}
+	}
+}
+
+// renewLeases renews the leases of this hub and balances shards with
+// the other hubs: each one takes its share of the shards that are
+// free, and gives back what it has in excess. Returns the topics with
+// subscribers in the shards it gained.
+func (c *cluster) renewLeases() (gainedTopics []Topic) {
+	ctx, cancel := context.WithTimeout(context.Background(), BACKEND_TIMEOUT)
+	defer cancel()
+
+	// Leases we get run out at the latest ttl after we asked for them
+	start := time.Now()
+	until := start.Add(c.ttl)
+
+	if _, err := c.backend.Acquire(ctx, leasePrefixNode+c.node, c.node, c.ttl); err != nil {
+		c.logger.Warn("Couldn't renew node lease", logging.Err(err))
+		c.dropExpired()
+		return nil
+	}
+	members, err := c.backend.Holders(ctx, leasePrefixNode)
+	if err != nil {
+		c.logger.Warn("Couldn't list cluster members", logging.Err(err))
+		c.dropExpired()
+		return nil
+	}
+	holders, err := c.backend.Holders(ctx, leasePrefixShard)
+	if err != nil {
+		c.logger.Warn("Couldn't list shard owners", logging.Err(err))
+		c.dropExpired()
+		return nil
+	}
+	target := (c.shards + len(members) - 1) / max(len(members), 1)
+
+	owned := make(map[int]time.Time)
+	var free []int
+	for shard := 0; shard < c.shards; shard++ {
+		switch holders[shardLease(shard)] {
+		case c.node:
+			if ok, _ := c.backend.Acquire(ctx, shardLease(shard), c.node, c.ttl); ok {
+				owned[shard] = until
+			}
+		case "":
+			free = append(free, shard)
+		}
+	}
+
+	var extra []int
+	for shard := range owned {
+		extra = append(extra, shard)
+	}
+	sort.Ints(extra)
+	for len(owned) > target {
+		shard := extra[len(extra)-1]
+		extra = extra[:len(extra)-1]
+		c.backend.Release(ctx, shardLease(shard), c.node)
+		delete(owned, shard)
+	}
+
+	for _, shard := range free {
+		if len(owned) >= target {
+			break
+		}
+		if ok, _ := c.backend.Acquire(ctx, shardLease(shard), c.node, c.ttl); ok {
+			owned[shard] = until
+		}
+	}
+
+	c.ownedMu.Lock()
+	previous := c.owned
+	c.owned = owned
+	c.ownedMu.Unlock()
+
+	// A shard whose lease ran out in the meantime can have had another
+	// owner, so it is gained again
+	gained := 0
+	for shard := range owned {
+		if !previous[shard].After(start) {
+			gained++
+		}
+	}
+	if gained > 0 || len(owned) != len(previous) {
+		c.logger.Info("Shards changed", "owned", len(owned), "gained", gained, "members", len(members))
+	}
+	if gained == 0 {
+		return nil
+	}
+
+	for _, topic := range c.hub.sh.topics() {
+		if shard := c.shardOf(topic); !owned[shard].IsZero() && !previous[shard].After(start) {
+			gainedTopics = append(gainedTopics, topic)
+		}
+	}
+	return gainedTopics
+}
+
+// dropExpired forgets the shards whose lease ran out, when they
+// couldn't be renewed.
+func (c *cluster) dropExpired() {
+	c.ownedMu.Lock()
+	defer c.ownedMu.Unlock()
+
+	now := time.Now()
+	for shard, until := range c.owned {
+		if !now.Before(until) {
+			delete(c.owned, shard)
+			c.logger.Warn("Lost shard", "shard", shard)
+		}
+	}
+}
+
+// load copies the shared subscriptions and content.
+func (c *cluster) load() {
+	ctx, cancel := context.WithTimeout(context.Background(), BACKEND_TIMEOUT)
+	defer cancel()
+
+	subs, err := c.backend.Subscriptions(ctx)
+	if err != nil {
+		c.logger.Error("Couldn't load shared subscriptions", logging.Err(err))
+	}
+	for _, s := range subs {
+		c.hub.sh.applySharedSubscription(s)
+	}
+
+	contents, err := c.backend.Contents(ctx)
+	if err != nil {
+		c.logger.Error("Couldn't load shared content", logging.Err(err))
+	}
+	for _, content := range contents {
+		if _, err := c.hub.store.processNewContent(content.Body, content.ContentType, Topic(content.Topic)); err != nil {
+			c.logger.Warn("Couldn't load shared content", logging.KeyTopic, content.Topic, logging.Err(err))
+		}
+	}
+
+	c.logger.Info("Loaded shared state", "subscriptions", len(subs), "topics", len(contents))
+}
+
+// followChanges applies what the other hubs do.
+func (c *cluster) followChanges(changes <-chan *Change) {
+	for change := range changes {
+		logger := c.logger.With("origin", change.Origin)
+
+		switch change.Kind {
+		case ChangeSubscription:
+			c.hub.sh.applySharedSubscription(change.Subscription)
+
+		case ChangeUnsubscription:
+			c.hub.sh.removeSubscriber(Topic(change.Topic), Callback(change.Callback))
+
+		case ChangeContent:
+			topic := Topic(change.Content.Topic)
+			changed, err := c.hub.store.processNewContent(change.Content.Body, change.Content.ContentType, topic)
+			if err != nil {
+				logger.Warn("Couldn't store shared content", logging.KeyTopic, topic, logging.Err(err))
+				continue
+			}
+			if changed {
+				c.hub.ph.newContent <- topic
+			}
+
+		case ChangeFetch:
+			if c.owns(Topic(change.Topic)) {
+				if err := c.hub.ph.toFetch.push(Topic(change.Topic)); err != nil {
+					logger.Warn("Couldn't queue requested fetch", logging.KeyTopic, change.Topic, logging.Err(err))
+				}
+			}
+		}
+	}
+}
+
+// requestFetch has topic fetched by the hub owning it. Returns false
+// if that's this one.
+func (c *cluster) requestFetch(topic Topic) bool {
+	if c.owns(topic) {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), BACKEND_TIMEOUT)
+	defer cancel()
+	if err := c.backend.RequestFetch(ctx, c.node, string(topic)); err != nil {
+		c.logger.Error("Couldn't request fetch", logging.KeyTopic, topic, logging.Err(err))
+	}
+	return true
+}
+
+func (c *cluster) saveContent(topic Topic, contentType string, body []byte) {
+	if c == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), BACKEND_TIMEOUT)
+	defer cancel()
+	err := c.backend.SaveContent(ctx, c.node, &SharedContent{Topic: string(topic), ContentType: contentType, Body: body})
+	if err != nil {
+		c.logger.Error("Couldn't share content", logging.KeyTopic, topic, logging.Err(err))
+	}
+}
+
+func (c *cluster) saveSubscription(s *SharedSubscription) {
+	if c == nil || s == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), BACKEND_TIMEOUT)
+	defer cancel()
+	if err := c.backend.SaveSubscription(ctx, c.node, s); err != nil {
+		c.logger.Error("Couldn't share subscription", logging.KeyTopic, s.Topic, logging.KeyCallback, s.Callback, logging.Err(err))
+	}
+}
+
+func (c *cluster) deleteSubscription(topic Topic, callback Callback) {
+	if c == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), BACKEND_TIMEOUT)
+	defer cancel()
+	if err := c.backend.DeleteSubscription(ctx, c.node, string(topic), string(callback)); err != nil {
+		c.logger.Error("Couldn't share unsubscription", logging.KeyTopic, topic, logging.KeyCallback, callback, logging.Err(err))
+	}
+}
+
+// shared returns what other hubs need to know about sub. The caller
+// must hold the subscribers lock.
+func (sub *subscriber) shared() *SharedSubscription {
+	return &SharedSubscription{
+		Topic:        string(sub.topic),
+		Callback:     string(sub.callback),
+		LeaseSeconds: sub.leaseSeconds,
+		Expires:      sub.expires,
+		Secret:       sub.secret,
+		DeliveryMode: sub.deliveryMode,
+		Filter:       sub.filter.String(),
+		LastNotified: sub.lastNotified,
+	}
+}
+
+// shareSubscription sends the current state of a subscription to the
+// other hubs.
+func (sh *subscribeHandler) shareSubscription(topic Topic, callback Callback) {
+	if sh.hub.cluster == nil {
+		return
+	}
+
+	sh.subscribersMu.Lock()
+	var s *SharedSubscription
+	if sub, ok := sh.subscribers[topic][callback]; ok {
+		s = sub.shared()
+	}
+	sh.subscribersMu.Unlock()
+
+	sh.hub.cluster.saveSubscription(s)
+}
+
+// applySharedSubscription stores a subscription made or updated by
+// another hub. Cursors only move forward.
+func (sh *subscribeHandler) applySharedSubscription(s *SharedSubscription) {
+	if time.Now().After(s.Expires) {
+		return
+	}
+
+	var f *filter.Filter
+	if s.Filter != "" {
+		var err error
+		f, err = filter.Parse(s.Filter)
+		if err != nil {
+			sh.logger.Error("Ignoring shared subscription with a bad filter", logging.KeyTopic, s.Topic, logging.KeyCallback, s.Callback, logging.Err(err))
+			return
+		}
+	}
+
+	topic, callback := Topic(s.Topic), Callback(s.Callback)
+	sub := &subscriber{
+		callback:     callback,
+		topic:        topic,
+		lastNotified: s.LastNotified,
+		leaseSeconds: s.LeaseSeconds,
+		expires:      s.Expires,
+		secret:       s.Secret,
+		deliveryMode: s.DeliveryMode,
+		filter:       f,
+	}
+
+	sh.subscribersMu.Lock()
+	defer sh.subscribersMu.Unlock()
+
+	if _, ok := sh.subscribers[topic]; !ok {
+		sh.subscribers[topic] = make(map[Callback]*subscriber)
+	}
+	if previous, ok := sh.subscribers[topic][callback]; ok {
+		if previous.lastNotified.After(sub.lastNotified) {
+			sub.lastNotified = previous.lastNotified
+		}
+		sub.delivering = previous.delivering
+		sub.missed = previous.missed
+	}
+	sh.subscribers[topic][callback] = sub
+}
+
+// topics returns the topics that have subscribers.
+func (sh *subscribeHandler) topics() []Topic {
+	sh.subscribersMu.Lock()
+	defer sh.subscribersMu.Unlock()
+
+	topics := make([]Topic, 0, len(sh.subscribers))
+	for topic := range sh.subscribers {
+		topics = append(topics, topic)
+	}
+	return topics
+}
@@ -0,0 +1,230 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/feed"
+)
+
+type clusterHub struct {
+	*Hub
+	srv  *httptest.Server
+	stop func()
+}
+
+// newTestCluster starts n hubs sharing a MemoryBackend.
+func newTestCluster(t *testing.T, n int) []*clusterHub {
+	backend := NewMemoryBackend()
+
+	var hubs []*clusterHub
+	for i := 0; i < n; i++ {
+		h := New(WithWebSub(), WithCluster(backend, fmt.Sprintf("node-%d", i)), WithShards(4), WithLeaseTTL(150*time.Millisecond))
+		srv := httptest.NewServer(h)
+		h.url = srv.URL
+
+		var once sync.Once
+		ch := &clusterHub{Hub: h, srv: srv, stop: func() {
+			once.Do(func() {
+				srv.Close()
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				h.Shutdown(ctx)
+			})
+		}}
+		t.Cleanup(ch.stop)
+		hubs = append(hubs, ch)
+	}
+	return hubs
+}
+
+// waitForOwner returns the hub owning topic, once there is one.
+func waitForOwner(t *testing.T, hubs []*clusterHub, topic string) *clusterHub {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, h := range hubs {
+			if h.cluster.owns(Topic(topic)) {
+				return h
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Nobody took over the topic")
+	return nil
+}
+
+func TestClusterFetchesAndDeliversOnce(t *testing.T) {
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+
+	var fetches atomic.Int32
+	publisher := newChangingPublisher(t, "application/atom+xml", string(testEntriesFeedFrom(future, 1, 1)))
+	topic := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		publisher.Config.Handler.ServeHTTP(w, r)
+	}))
+	defer topic.Close()
+
+	hubs := newTestCluster(t, 3)
+	ws := newWebsubSubscriber(t)
+
+	// Subscribing on one hub makes the subscription known everywhere
+	subscribe(t, hubs[0].Hub, hubs[0].srv.URL, ws, subscribeForm("subscribe", ws.URL, topic.URL))
+	for _, h := range hubs {
+		waitForSubscriber(t, h.Hub, Topic(topic.URL), Callback(ws.URL))
+	}
+
+	// Publishing on any hub has the owner fetch and deliver
+	publish(t, hubs[2].srv.URL, topic.URL)
+	ws.nextDelivery(t)
+	ws.expectNoDelivery(t)
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("Expected a single fetch, got %d", n)
+	}
+
+	// Every hub has the content
+	for i, h := range hubs {
+		if page, ok := h.store.historyPage(Topic(topic.URL), -1, h.pageSize); !ok || len(page.entries) != 1 {
+			t.Errorf("Hub %d doesn't have the content", i)
+		}
+	}
+
+	// Another hub takes over when the owner stops, and only delivers
+	// what is new
+	owner := waitForOwner(t, hubs, topic.URL)
+	owner.stop()
+	var rest []*clusterHub
+	for _, h := range hubs {
+		if h != owner {
+			rest = append(rest, h)
+		}
+	}
+	waitForOwner(t, rest, topic.URL)
+
+	publisher.set(string(testEntriesFeedFrom(future, 1, 2)))
+	publish(t, rest[0].srv.URL, topic.URL)
+	f, err := feed.Parse("application/atom+xml", ws.nextDelivery(t).body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Entries) != 1 || f.Entries[0].Id != "entry-2" {
+		t.Fatalf("Expected only the new entry, got %+v", f.Entries)
+	}
+	ws.expectNoDelivery(t)
+}
+
+func TestClusterBalancesShards(t *testing.T) {
+	hubs := newTestCluster(t, 2)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		owned := make([]int, len(hubs))
+		for i, h := range hubs {
+			h.cluster.ownedMu.RLock()
+			owned[i] = len(h.cluster.owned)
+			h.cluster.ownedMu.RUnlock()
+		}
+		if owned[0] == 2 && owned[1] == 2 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Shards weren't balanced")
+}
+
+// A backend that can stop answering.
+type failingBackend struct {
+	*MemoryBackend
+	failing atomic.Bool
+}
+
+func (fb *failingBackend) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	if fb.failing.Load() {
+		return false, fmt.Errorf("backend unreachable")
+	}
+	return fb.MemoryBackend.Acquire(ctx, name, holder, ttl)
+}
+
+func TestClusterDropsExpiredShards(t *testing.T) {
+	backend := &failingBackend{MemoryBackend: NewMemoryBackend()}
+	h := New(WithCluster(backend, "node-0"), WithShards(4), WithLeaseTTL(150*time.Millisecond))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		h.Shutdown(ctx)
+	})
+
+	if !h.cluster.owns("http://example.com/feed") {
+		t.Fatal("A hub on its own should own every shard")
+	}
+
+	backend.failing.Store(true)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		h.cluster.ownedMu.RLock()
+		owned := len(h.cluster.owned)
+		h.cluster.ownedMu.RUnlock()
+		if owned == 0 && !h.cluster.owns("http://example.com/feed") {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Kept shards whose lease couldn't be renewed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// A backend where asking for a fetch takes until release is closed.
+type slowBackend struct {
+	*failingBackend
+	requested chan string
+	release   chan struct{}
+}
+
+func (sb *slowBackend) RequestFetch(ctx context.Context, origin string, topic string) error {
+	sb.requested <- topic
+	<-sb.release
+	return nil
+}
+
+func TestClusterFetchRequestsDontBlock(t *testing.T) {
+	backend := &slowBackend{
+		failingBackend: &failingBackend{MemoryBackend: NewMemoryBackend()},
+		requested:      make(chan string, 1),
+		release:        make(chan struct{}),
+	}
+	// Another hub owns everything
+	backend.failing.Store(true)
+	h := New(WithCluster(backend, "node-0"), WithShards(4), WithLeaseTTL(150*time.Millisecond))
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		h.Shutdown(ctx)
+	})
+	defer close(backend.release)
+
+	queued := make(chan error, 1)
+	go func() { queued <- h.ph.queueFetch("http://example.com/feed") }()
+	select {
+	case err := <-queued:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Queueing a fetch waited for the backend")
+	}
+
+	select {
+	case topic := <-backend.requested:
+		if topic != "http://example.com/feed" {
+			t.Fatalf("Unexpected fetch request for %s", topic)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("The fetch wasn't requested from the owner")
+	}
+}
@@ -0,0 +1,324 @@
+package hub
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/feed"
+	"github.com/rakoo/psgb/pkg/filter"
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+type Topic string
+
+type contentStore struct {
+	sync.Mutex
+
+	contentFormat map[Topic]feed.Format          // topic -> format of the feed
+	contentType   map[Topic]string               // topic -> Content-Type to distribute it with
+	contentHeader map[Topic]*feed.Skeleton       // topic -> document without its entries
+	content       map[Topic]*entryIndex          // topic -> items ordered by updated date
+	nextSeq       map[Topic]int                  // topic -> sequence number of the next new item
+	evictedUntil  map[Topic]time.Time            // topic -> date of the newest evicted item
+	firstSeen     map[Topic]map[string]time.Time // topic -> id -> date of items without a usable date
+	opaque        map[Topic]*opaqueContent       // topic -> latest version, for topics that aren't feeds
+	aggregates    map[Topic][]Topic              // aggregate topic -> its sources
+
+	logger *slog.Logger
+}
+
+// Topics that aren't feeds (JSON documents, HTML pages, images...)
+// can't be split into entries; we keep their latest version as is and
+// distribute it whole whenever it changes.
+type opaqueContent struct {
+	body []byte
+	hash [sha256.Size]byte
+}
+
+type storedEntry struct {
+	raw  []byte
+	seen time.Time // when we first stored it
+	seq  int       // order in which the topic's entries were first stored
+
+	undated string      // key in firstSeen, if it is dated by when we saw it
+	parsed  *feed.Entry // its fields, once they were needed by a filter
+	atom    []byte      // rendered as Atom, once it was needed by an aggregate
+}
+
+func newContentStore(logger *slog.Logger) (cs *contentStore) {
+	return &contentStore{
+		logger:        logger,
+		contentFormat: make(map[Topic]feed.Format),
+		contentType:   make(map[Topic]string),
+		contentHeader: make(map[Topic]*feed.Skeleton),
+		content:       make(map[Topic]*entryIndex),
+		nextSeq:       make(map[Topic]int),
+		evictedUntil:  make(map[Topic]time.Time),
+		firstSeen:     make(map[Topic]map[string]time.Time),
+		opaque:        make(map[Topic]*opaqueContent),
+		aggregates:    make(map[Topic][]Topic),
+	}
+}
+
+// processNewContent stores a new version of topic. ct is the
+// Content-Type it was served with. Feeds have their entries stored;
+// anything else is stored whole. Returns whether there is something new
+// to distribute.
+func (cs *contentStore) processNewContent(rawContent []byte, ct string, topic Topic) (changed bool, err error) {
+	format := feed.Detect(ct, rawContent)
+	if format == feed.FormatUnknown {
+		return cs.processOpaque(rawContent, ct, topic), nil
+	}
+
+	skeleton, entries, err := feed.Split(format, rawContent)
+	if err != nil {
+		return false, fmt.Errorf("couldn't parse %s content: %w", format, err)
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	delete(cs.opaque, topic)
+	cs.contentFormat[topic] = format
+	cs.contentType[topic] = feed.ContentType(format, ct, rawContent)
+	cs.contentHeader[topic] = skeleton
+	cs.processEntries(entries, format, topic)
+
+	return true, nil
+}
+
+func (cs *contentStore) processOpaque(rawContent []byte, ct string, topic Topic) (changed bool) {
+	hash := sha256.Sum256(rawContent)
+
+	if ct == "" {
+		ct = http.DetectContentType(rawContent)
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	// Whatever was there before isn't relevant anymore if the topic
+	// stopped being a feed
+	delete(cs.contentHeader, topic)
+	delete(cs.content, topic)
+	delete(cs.nextSeq, topic)
+	delete(cs.evictedUntil, topic)
+	delete(cs.firstSeen, topic)
+	cs.contentFormat[topic] = feed.FormatUnknown
+
+	previous, ok := cs.opaque[topic]
+	if ok && previous.hash == hash && cs.contentType[topic] == ct {
+		cs.logger.Debug("Content didn't change", logging.KeyTopic, topic)
+		return false
+	}
+
+	cs.contentType[topic] = ct
+	cs.opaque[topic] = &opaqueContent{
+		body: bytes.Clone(rawContent),
+		hash: hash,
+	}
+
+	cs.logger.Debug("Stored opaque content", logging.KeyTopic, topic, "content_type", ct, "bytes", len(rawContent))
+	return true
+}
+
+func (cs *contentStore) processEntries(entries []*feed.RawEntry, format feed.Format, topic Topic) {
+	logger := cs.logger.With(logging.KeyTopic, topic, "format", format)
+
+	items := cs.content[topic]
+	if items == nil {
+		items = newEntryIndex()
+		cs.content[topic] = items
+	}
+	now := time.Now()
+	undated := make(map[string]bool)
+	var fresh []*indexNode
+
+	for i, newItem := range entries {
+		stored := &storedEntry{raw: newItem.Raw, seen: now}
+		key := entryKey(newItem)
+
+		date, err := entryDate(newItem)
+		if err != nil {
+			// Entries without a usable date are dated by when we first
+			// saw them, so they still are distributed once
+			stored.undated = key
+			undated[stored.undated] = true
+			date = cs.firstSeenDate(topic, stored.undated, now.Add(time.Duration(i)))
+			logger.Debug("Couldn't parse entry date, using when we first saw it", "id", newItem.Id, "date", date, logging.Err(err))
+		}
+
+		// Evicted entries are still in the feed for a while; they
+		// shouldn't come back
+		if until, ok := cs.evictedUntil[topic]; ok && !date.After(until) {
+			continue
+		}
+
+		// An updated entry keeps its place in the history
+		if previous := items.find(key); previous != nil {
+			stored.seen = previous.seen
+			stored.seq = previous.seq
+		} else {
+			fresh = append(fresh, &indexNode{date: date, key: key, entry: stored})
+		}
+		items.put(date, key, stored)
+	}
+
+	// New entries are numbered in the order of the index, whatever the
+	// order of the feed
+	sort.Slice(fresh, func(i, j int) bool { return fresh[i].before(fresh[j].date, fresh[j].key) })
+	for _, n := range fresh {
+		n.entry.seq = cs.nextSeq[topic]
+		cs.nextSeq[topic]++
+	}
+
+	// Forget entries that are neither in the feed nor stored anymore. As
+	// long as they are in the feed we keep their date, even once
+	// evicted, or they would come back as new.
+	for key, date := range cs.firstSeen[topic] {
+		if undated[key] {
+			continue
+		}
+		if e := items.get(date, key); e == nil || e.undated != key {
+			delete(cs.firstSeen[topic], key)
+		}
+	}
+
+	logger.Debug("Stored entries", "entries", items.len)
+}
+
+// parsedEntry returns the fields of a stored entry of topic, to filter
+// it. The caller must hold the lock.
+func (cs *contentStore) parsedEntry(topic Topic, e *storedEntry) *feed.Entry {
+	if e.parsed != nil {
+		return e.parsed
+	}
+
+	header := cs.contentHeader[topic]
+	doc := header.Assemble([][]byte{e.raw})
+	parsed, err := feed.Parse(header.Format.MediaType(), doc)
+	if err != nil || len(parsed.Entries) != 1 {
+		// Filters see an entry we can't read as empty
+		cs.logger.Debug("Couldn't parse entry for filtering", logging.KeyTopic, topic, logging.Err(err))
+		e.parsed = &feed.Entry{}
+		return e.parsed
+	}
+
+	e.parsed = parsed.Entries[0]
+	return e.parsed
+}
+
+// entryDate is the date an entry is sorted by: when it was updated
+// (Atom's updated, JSON Feed's date_modified) or else published (Atom's
+// published, RSS's pubDate, JSON Feed's date_published).
+func entryDate(e *feed.RawEntry) (time.Time, error) {
+	date, err := feed.ParseDate(e.Updated)
+	if err != nil {
+		date, err = feed.ParseDate(e.Published)
+	}
+	return date, err
+}
+
+// entryKey identifies an entry across fetches: its id, or its content
+// if it has none.
+func entryKey(e *feed.RawEntry) string {
+	if e.Id != "" {
+		return e.Id
+	}
+	sum := sha256.Sum256(e.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// firstSeenDate returns the date we first saw the entry identified by
+// key, or records now if we never did.
+func (cs *contentStore) firstSeenDate(topic Topic, key string, now time.Time) time.Time {
+	seen := cs.firstSeen[topic]
+	if seen == nil {
+		seen = make(map[string]time.Time)
+		cs.firstSeen[topic] = seen
+	}
+
+	if date, ok := seen[key]; ok {
+		return date
+	}
+	seen[key] = now
+	return now
+}
+
+// isOpaque tells whether the latest version of topic isn't a feed.
+func (cs *contentStore) isOpaque(topic Topic) bool {
+	cs.Lock()
+	defer cs.Unlock()
+
+	_, ok := cs.opaque[topic]
+	return ok
+}
+
+// contentTypeOf returns the Content-Type topic is distributed with.
+func (cs *contentStore) contentTypeOf(topic Topic) string {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if _, ok := cs.aggregates[topic]; ok {
+		return AGGREGATE_CONTENT_TYPE
+	}
+	return cs.contentType[topic]
+}
+
+// contentAfterDate builds the document to distribute for topic: its
+// oldest entries updated since t that go through f, if any, at most
+// limit of them (0 for all), for a feed, or the whole latest version for
+// any other content. next is where the subscriber's cursor goes once it
+// received the document, or zero if there is no cursor to keep.
+// rawContent is nil if there is nothing new to distribute; the cursor
+// can still move past entries that were filtered out. Content that
+// isn't a feed has no entries to match f, so none of it goes through.
+func (cs *contentStore) contentAfterDate(topic Topic, t time.Time, limit int, f *filter.Filter) (rawContent []byte, next time.Time) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	if opaque, ok := cs.opaque[topic]; ok {
+		if f != nil {
+			return nil, time.Time{}
+		}
+		return opaque.body, time.Time{}
+	}
+	if sources, ok := cs.aggregates[topic]; ok {
+		return cs.aggregateAfterDate(topic, sources, t, limit, f)
+	}
+
+	items := cs.content[topic]
+	header := cs.contentHeader[topic]
+	if header == nil {
+		return nil, t
+	}
+
+	next = t
+	var entries [][]byte
+	for n := items.seek(t); n != nil; n = n.following() {
+		// Entries at the same date go in the same document, or the
+		// cursor would skip some
+		if limit > 0 && len(entries) >= limit && n.date.After(next.Add(-time.Nanosecond)) {
+			break
+		}
+		next = n.date.Add(time.Nanosecond)
+		if f != nil && !f.Match(cs.parsedEntry(topic, n.entry)) {
+			continue
+		}
+		entries = append(entries, n.entry.raw)
+	}
+	// A feed without any entry is still distributed: only its metadata
+	// can have changed
+	if len(entries) == 0 && (items.len > 0 || f != nil) {
+		return nil, next
+	}
+
+	return header.Assemble(entries), next
+}
@@ -0,0 +1,360 @@
+package hub
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/feed"
+	"github.com/rakoo/psgb/pkg/filter"
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+var testEpoch = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// testEntriesFeed is an Atom feed with entries numbered from first to
+// last, entry i being updated i minutes after testEpoch.
+func testEntriesFeed(first, last int) []byte {
+	return testEntriesFeedFrom(testEpoch, first, last)
+}
+
+func testEntriesFeedFrom(base time.Time, first, last int) []byte {
+	var b strings.Builder
+	b.WriteString(`<feed xmlns="http://www.w3.org/2005/Atom"><title>Many entries</title>`)
+	for i := first; i <= last; i++ {
+		fmt.Fprintf(&b, "<entry><id>entry-%d</id><updated>%s</updated></entry>",
+			i, base.Add(time.Duration(i)*time.Minute).Format(time.RFC3339))
+	}
+	b.WriteString(`</feed>`)
+	return []byte(b.String())
+}
+
+func newTestStore(t *testing.T, topic Topic, first, last int) *contentStore {
+	cs := newContentStore(logging.Discard())
+	if _, err := cs.processNewContent(testEntriesFeed(first, last), "application/atom+xml", topic); err != nil {
+		t.Fatal(err)
+	}
+	return cs
+}
+
+func countEntries(t *testing.T, cs *contentStore, topic Topic) int {
+	raw, _ := cs.contentAfterDate(topic, time.Time{}, 0, nil)
+	return strings.Count(string(raw), "<entry>")
+}
+
+func TestRetentionMaxEntries(t *testing.T) {
+	cs := newTestStore(t, "t", 1, 30)
+
+	evicted := cs.enforceRetention("t", Retention{MaxEntries: 10}, time.Time{})
+	if evicted != 20 {
+		t.Fatalf("Expected 20 evicted entries, got %d", evicted)
+	}
+
+	raw, _ := cs.contentAfterDate("t", time.Time{}, 0, nil)
+	if strings.Contains(string(raw), "entry-20<") || !strings.Contains(string(raw), "entry-21<") {
+		t.Fatalf("Didn't keep the newest entries: %s", raw)
+	}
+}
+
+func TestRetentionMaxBytes(t *testing.T) {
+	cs := newTestStore(t, "t", 1, 30)
+	maxBytes := 0
+	for n := cs.content["t"].seek(testEpoch.Add(26 * time.Minute)); n != nil; n = n.following() {
+		maxBytes += len(n.entry.raw)
+	}
+
+	cs.enforceRetention("t", Retention{MaxBytes: maxBytes}, time.Time{})
+	if n := countEntries(t, cs, "t"); n != 5 {
+		t.Fatalf("Expected 5 entries left, got %d", n)
+	}
+	if cs.content["t"].bytes > maxBytes {
+		t.Fatalf("Store still holds %d bytes", cs.content["t"].bytes)
+	}
+}
+
+func TestRetentionMaxAge(t *testing.T) {
+	cs := newTestStore(t, "t", 1, 10)
+	for n := cs.content["t"].first(); n != nil; n = n.following() {
+		n.entry.seen = time.Now().Add(-2 * time.Hour)
+	}
+	if _, err := cs.processNewContent(testEntriesFeed(11, 12), "application/atom+xml", "t"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Age wins over cursors
+	cs.enforceRetention("t", Retention{MaxAge: time.Hour}, testEpoch)
+	if n := countEntries(t, cs, "t"); n != 2 {
+		t.Fatalf("Expected 2 entries left, got %d", n)
+	}
+}
+
+func TestRetentionKeepsPendingEntries(t *testing.T) {
+	cs := newTestStore(t, "t", 1, 30)
+
+	// A subscriber hasn't received anything since entry 15
+	pending := testEpoch.Add(15 * time.Minute)
+	cs.enforceRetention("t", Retention{MaxEntries: 10}, pending)
+
+	if n := countEntries(t, cs, "t"); n != 16 {
+		t.Fatalf("Expected entries 15 to 30 to be kept, got %d entries", n)
+	}
+	raw, _ := cs.contentAfterDate("t", pending, 0, nil)
+	if !strings.Contains(string(raw), "entry-15<") {
+		t.Fatalf("Evicted an entry a subscriber still needs: %s", raw)
+	}
+}
+
+func TestContentAfterDateCursor(t *testing.T) {
+	cs := newTestStore(t, "t", 1, 3)
+
+	raw, next := cs.contentAfterDate("t", testEpoch.Add(2*time.Minute), 0, nil)
+	if n := strings.Count(string(raw), "<entry>"); n != 2 {
+		t.Fatalf("Expected 2 entries, got %d", n)
+	}
+
+	raw, _ = cs.contentAfterDate("t", next, 0, nil)
+	if raw != nil {
+		t.Fatalf("Expected nothing after the cursor, got %s", raw)
+	}
+}
+
+func TestOpaqueIsFilteredOut(t *testing.T) {
+	cs := newContentStore(logging.Discard())
+	if _, err := cs.processNewContent([]byte("hello"), "text/plain", "opaque"); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := filter.Parse("category:go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw, _ := cs.contentAfterDate("opaque", time.Time{}, 0, f); raw != nil {
+		t.Fatalf("Content that isn't a feed went through a filter: %s", raw)
+	}
+	if raw, _ := cs.contentAfterDate("opaque", time.Time{}, 0, nil); string(raw) != "hello" {
+		t.Fatalf("Expected the content without a filter, got %s", raw)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	cs := newTestStore(t, "small", 1, 2)
+	if _, err := cs.processNewContent(testEntriesFeed(1, 20), "application/atom+xml", "big"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cs.processNewContent([]byte("hello"), "text/plain", "opaque"); err != nil {
+		t.Fatal(err)
+	}
+
+	u := cs.usage()
+	if len(u.Topics) != 3 || u.Topics[0].Topic != "big" {
+		t.Fatalf("Expected 3 topics, biggest first, got %+v", u.Topics)
+	}
+	if u.Entries != 22 {
+		t.Fatalf("Expected 22 entries, got %d", u.Entries)
+	}
+	if u.Bytes != u.Topics[0].Bytes+u.Topics[1].Bytes+u.Topics[2].Bytes {
+		t.Fatalf("Total doesn't add up: %+v", u)
+	}
+}
+
+func TestEntryIndex(t *testing.T) {
+	idx := newEntryIndex()
+	for _, i := range rand.Perm(1000) {
+		idx.put(testEpoch.Add(time.Duration(i)*time.Second), fmt.Sprint(i), &storedEntry{raw: []byte{byte(i)}})
+	}
+	if idx.len != 1000 || idx.bytes != 1000 {
+		t.Fatalf("Expected 1000 entries of 1 byte, got %d entries and %d bytes", idx.len, idx.bytes)
+	}
+
+	for i := 0; i < 1000; i += 2 {
+		if idx.remove(testEpoch.Add(time.Duration(i)*time.Second), fmt.Sprint(i)) == nil {
+			t.Fatalf("Didn't find entry %d", i)
+		}
+	}
+	if idx.remove(testEpoch, "0") != nil {
+		t.Fatal("Removed an entry twice")
+	}
+
+	expected := 501
+	for n := idx.seek(testEpoch.Add(500 * time.Second)); n != nil; n = n.following() {
+		if n.date != testEpoch.Add(time.Duration(expected)*time.Second) {
+			t.Fatalf("Expected entry %d, got %s", expected, n.date)
+		}
+		expected += 2
+	}
+	if expected != 1001 || idx.len != 500 {
+		t.Fatalf("Walked up to %d with %d entries", expected, idx.len)
+	}
+
+	// Entries at the same date are kept apart by their key
+	date := testEpoch.Add(time.Hour)
+	for _, key := range []string{"b", "c", "a"} {
+		idx.put(date, key, &storedEntry{raw: []byte(key)})
+	}
+	if previous := idx.put(date, "b", &storedEntry{raw: []byte("B")}); string(previous.raw) != "b" {
+		t.Fatalf("Expected to replace b, got %v", previous)
+	}
+	var keys []string
+	for n := idx.seek(date); n != nil; n = n.following() {
+		keys = append(keys, n.key)
+	}
+	if strings.Join(keys, "") != "abc" || string(idx.get(date, "b").raw) != "B" {
+		t.Fatalf("Expected a, b and c in order, got %v", keys)
+	}
+	if idx.remove(date, "b") == nil || idx.get(date, "a") == nil || idx.get(date, "c") == nil {
+		t.Fatal("Removing b touched the other entries at the same date")
+	}
+
+	// An entry at a new date replaces the previous version
+	length := idx.len
+	if previous := idx.put(date.Add(time.Hour), "a", &storedEntry{raw: []byte("A")}); previous == nil || string(previous.raw) != "a" {
+		t.Fatalf("Expected to replace a, got %v", previous)
+	}
+	if idx.len != length || idx.get(date, "a") != nil || string(idx.find("a").raw) != "A" {
+		t.Fatal("The previous version of a is still there")
+	}
+}
+
+func TestUpdatedEntry(t *testing.T) {
+	cs := newContentStore(logging.Discard())
+	atom := func(updated string) []byte {
+		return []byte(`<feed xmlns="http://www.w3.org/2005/Atom"><title>Updates</title>` +
+			`<entry><id>e1</id><title>` + updated + `</title><updated>` + updated + `</updated></entry></feed>`)
+	}
+	for _, updated := range []string{"2024-01-01T00:00:00Z", "2024-01-02T00:00:00Z"} {
+		if _, err := cs.processNewContent(atom(updated), "application/atom+xml", "t"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := cs.content["t"].len; n != 1 {
+		t.Fatalf("Expected a single version of the entry, got %d", n)
+	}
+	doc, _ := cs.contentAfterDate("t", time.Time{}, 0, nil)
+	if n := strings.Count(string(doc), "<id>e1</id>"); n != 1 || !strings.Contains(string(doc), "2024-01-02") {
+		t.Fatalf("Expected only the updated entry, got %s", doc)
+	}
+}
+
+func TestEntriesAtTheSameDate(t *testing.T) {
+	cs := newContentStore(logging.Discard())
+	rss := `<rss version="2.0"><channel><title>Same date</title>
+<item><guid>a</guid><pubDate>Sat, 31 Dec 2022 12:00:00 GMT</pubDate></item>
+<item><guid>b</guid><pubDate>Sat, 31 Dec 2022 12:00:00 GMT</pubDate></item>
+<item><guid>c</guid><pubDate>Sat, 31 Dec 2022 13:00:00 GMT</pubDate></item>
+</channel></rss>`
+	if _, err := cs.processNewContent([]byte(rss), "application/rss+xml", "t"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A page never ends between entries at the same date, or the cursor
+	// would skip some
+	raw, next := cs.contentAfterDate("t", time.Time{}, 1, nil)
+	if !strings.Contains(string(raw), "<guid>a</guid>") || !strings.Contains(string(raw), "<guid>b</guid>") || strings.Contains(string(raw), "<guid>c</guid>") {
+		t.Fatalf("Expected both entries of the same date, got %s", raw)
+	}
+	raw, _ = cs.contentAfterDate("t", next, 1, nil)
+	if !strings.Contains(string(raw), "<guid>c</guid>") {
+		t.Fatalf("Expected the next entry, got %s", raw)
+	}
+}
+
+func benchmarkIngest(b *testing.B, entries int, order func(int) []int) {
+	raw := make([]*feed.RawEntry, entries)
+	for i := range raw {
+		raw[i] = &feed.RawEntry{
+			Id:      fmt.Sprintf("entry-%d", i),
+			Updated: testEpoch.Add(time.Duration(i) * time.Second).Format(time.RFC3339),
+			Raw:     []byte(fmt.Sprintf("<entry><id>entry-%d</id></entry>", i)),
+		}
+	}
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		cs := newContentStore(logging.Discard())
+		// One entry per publish, as a busy topic would have
+		for _, i := range order(entries) {
+			cs.processEntries(raw[i:i+1], feed.FormatAtom, "t")
+		}
+	}
+}
+
+func inOrder(n int) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+func BenchmarkIngest1000InOrder(b *testing.B)   { benchmarkIngest(b, 1000, inOrder) }
+func BenchmarkIngest10000InOrder(b *testing.B)  { benchmarkIngest(b, 10000, inOrder) }
+func BenchmarkIngest10000Shuffled(b *testing.B) { benchmarkIngest(b, 10000, rand.Perm) }
+
+func BenchmarkContentAfterDate(b *testing.B) {
+	cs := newContentStore(logging.Discard())
+	if _, err := cs.processNewContent(testEntriesFeed(1, 10000), "application/atom+xml", "t"); err != nil {
+		b.Fatal(err)
+	}
+	since := testEpoch.Add(9990 * time.Minute)
+	b.ResetTimer()
+
+	for n := 0; n < b.N; n++ {
+		cs.contentAfterDate("t", since, 0, nil)
+	}
+}
+
+func TestEntriesWithoutUsableDate(t *testing.T) {
+	rss := []byte(`<rss version="2.0"><channel><title>Dates</title>
+<item><guid>rfc822</guid><pubDate>Tue, 3 Jun 2003 05:39:21 EDT</pubDate></item>
+<item><guid>broken</guid><pubDate>sometime last week</pubDate></item>
+<item><guid>none</guid></item>
+</channel></rss>`)
+
+	cs := newContentStore(logging.Discard())
+	for i := 0; i < 2; i++ {
+		if _, err := cs.processNewContent(rss, "application/rss+xml", "t"); err != nil {
+			t.Fatal(err)
+		}
+		if n := cs.content["t"].len; n != 3 {
+			t.Fatalf("Expected 3 entries after fetch %d, got %d", i+1, n)
+		}
+	}
+
+	date := time.Date(2003, time.June, 3, 9, 39, 21, 0, time.UTC)
+	if n := cs.content["t"].seek(date); n == nil || !n.date.Equal(date) {
+		t.Error("Didn't store the RFC 822 entry at its date")
+	}
+	if len(cs.firstSeen["t"]) != 2 {
+		t.Errorf("Expected 2 entries dated by when they were first seen, got %d", len(cs.firstSeen["t"]))
+	}
+}
+
+func TestPublishedDateFallback(t *testing.T) {
+	atom := []byte(`<feed xmlns="http://www.w3.org/2005/Atom"><title>Dates</title>
+<entry><id>1</id><updated>not a date</updated><published>2003-06-03T09:39:21Z</published></entry>
+</feed>`)
+
+	cs := newContentStore(logging.Discard())
+	if _, err := cs.processNewContent(atom, "application/atom+xml", "t"); err != nil {
+		t.Fatal(err)
+	}
+	date := time.Date(2003, time.June, 3, 9, 39, 21, 0, time.UTC)
+	if n := cs.content["t"].seek(date); n == nil || !n.date.Equal(date) {
+		t.Error("Didn't store the entry at its published date")
+	}
+}
+
+func TestEvictedEntriesDontComeBack(t *testing.T) {
+	cs := newTestStore(t, "t", 1, 30)
+	cs.enforceRetention("t", Retention{MaxEntries: 10}, time.Time{})
+
+	if _, err := cs.processNewContent(testEntriesFeed(1, 31), "application/atom+xml", "t"); err != nil {
+		t.Fatal(err)
+	}
+	if n := cs.content["t"].len; n != 11 {
+		t.Fatalf("Expected the 10 kept entries and the new one, got %d entries", n)
+	}
+}
@@ -0,0 +1,34 @@
+package hub
+
+import (
+	"log/slog"
+
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+type dispatcher struct {
+	sh *subscribeHandler
+	ph *publishHandler
+
+	done chan struct{} // closed once all new content has been dispatched
+
+	logger *slog.Logger
+}
+
+func startDispatcher(sh *subscribeHandler, ph *publishHandler, logger *slog.Logger) *dispatcher {
+	d := &dispatcher{sh, ph, make(chan struct{}), logger}
+
+	go func() {
+		defer close(d.done)
+
+		for topic := range d.ph.newContent {
+			d.logger.Debug("Dispatching new content", logging.KeyTopic, topic)
+			d.sh.distributeToSubscribers(topic)
+			for _, aggregate := range d.sh.hub.store.aggregatesOf(topic) {
+				d.sh.distributeToSubscribers(aggregate)
+			}
+		}
+	}()
+
+	return d
+}
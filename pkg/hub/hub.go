@@ -0,0 +1,358 @@
+// A PubSubHubbub hub that can be embedded in any Go program.
+//
+// A Hub is an http.Handler serving /publish, /subscribe, /archive (the
+// history of topics as RFC 5005 archived feeds), /stream (topics as
+// Server-Sent Events), /ws (subscriptions over WebSocket) and /upstream
+// (deliveries from the hubs it subscribes to); mount it wherever you
+// want (use http.StripPrefix to put it under a prefix), register
+// CloseStreams with your server's RegisterOnShutdown and call Shutdown
+// once your server stopped accepting requests. Aggregate topics are
+// managed through AdminHandler, which is served separately. Several
+// hubs can act as one by sharing a Backend, see WithCluster.
+
+package hub
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/filter"
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+const (
+	MAX_PARALLEL_OUTGOING_CONNS = 20
+	CHALLENGE_SIZE              = 20
+	DEFAULT_LEASE_SECONDS       = 600
+	DEFAULT_HUB_URL             = "http://localhost:8080"
+	MAX_SECRET_BYTES            = 200
+	DEFAULT_RETENTION_ENTRIES   = 10
+	DEFAULT_PAGE_SIZE           = 5 // the default retention always keeps a whole page of it
+	MAX_PUSH_BYTES              = 10 << 20
+	MIN_LEASE_SECONDS           = 60
+	MAX_LEASE_SECONDS           = 30 * 24 * 3600
+	// Requests waiting for a fetch or a verification, per kind; more
+	// are refused with 503 until the backlog goes down
+	MAX_QUEUED_REQUESTS = 10000
+
+	// How long we wait for aborted work to persist itself once the
+	// shutdown deadline is reached
+	ABORT_GRACE = 5 * time.Second
+)
+
+var (
+	ACCEPTABLE_RANDOM_CHARS = []byte{'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h',
+		'i', 'j', 'k', 'l', 'm', 'n', 'o', 'p', 'q', 'r', 's', 't', 'u',
+		'v', 'w', 'x', 'y', 'z', '0', '1', '2', '3', '4', '5', '6', '7',
+		'8', '9'}
+)
+
+type Hub struct {
+	url         string
+	maxConns    int
+	client      *http.Client
+	pendingFile string
+	websub      bool
+	topicPolicy func(topic string) error
+	pushSecret  func(topic string) string
+	checkOrigin func(r *http.Request) bool
+	retention   func(topic string) Retention
+	pageSize    int
+	challenges  *randStringMaker // checked by New
+	logger      *slog.Logger
+	cluster     *cluster // nil if the hub is on its own
+	shards      int
+	leaseTTL    time.Duration
+
+	initialAggregates [][]string  // topic, then sources
+	upstreams         [][2]string // upstream hub, topic
+	upstreamKey       string
+
+	freeConns chan bool
+	store     *contentStore
+	watchers  *watchers
+	lc        *lifecycle
+
+	mux *http.ServeMux
+	ph  *publishHandler
+	sh  *subscribeHandler
+	ah  *archiveHandler
+	sth *streamHandler
+	soh *socketHandler
+	uh  *upstreamHandler
+	d   *dispatcher
+}
+
+type Option func(*Hub)
+
+// WithURL sets the public URL of the hub, as advertised to
+// subscribers in rel=hub links.
+func WithURL(url string) Option {
+	return func(h *Hub) { h.url = url }
+}
+
+// WithLogger sets the logger. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(h *Hub) { h.logger = logger }
+}
+
+// WithMaxConns sets the maximum number of parallel outgoing
+// connections (fetches, verifications and deliveries together).
+func WithMaxConns(n int) Option {
+	return func(h *Hub) { h.maxConns = n }
+}
+
+// WithHTTPClient sets the client used for all outgoing requests.
+func WithHTTPClient(c *http.Client) Option {
+	return func(h *Hub) { h.client = c }
+}
+
+// WithPendingFile sets where work that couldn't finish before Shutdown
+// is saved. The file is read back and its work re-queued by New.
+func WithPendingFile(path string) Option {
+	return func(h *Hub) { h.pendingFile = path }
+}
+
+// WithWebSub makes the hub follow the WebSub recommendation where it
+// differs from PubSubHubbub 0.4: publish requests get a 202, and
+// content is signed with HMAC-SHA256.
+func WithWebSub() Option {
+	return func(h *Hub) { h.websub = true }
+}
+
+// WithTopicPolicy sets the function deciding which topics can be
+// subscribed to. Subscriptions to topics it returns an error for are
+// denied, with the error as reason. By default any http(s) URL is
+// accepted.
+func WithTopicPolicy(policy func(topic string) error) Option {
+	return func(h *Hub) { h.topicPolicy = policy }
+}
+
+// WithSocketOrigins sets the function deciding which web pages can
+// open WebSockets to the hub, from the handshake's Origin header. By
+// default only pages of the hub's own host can; clients that aren't
+// browsers send no Origin and always can.
+func WithSocketOrigins(check func(r *http.Request) bool) Option {
+	return func(h *Hub) { h.checkOrigin = check }
+}
+
+// WithPushSecret sets the function giving the secret publishers sign
+// pushed content of a topic with. Content can't be pushed for topics it
+// returns an empty secret for, which is all of them by default.
+func WithPushSecret(secret func(topic string) string) Option {
+	return func(h *Hub) { h.pushSecret = secret }
+}
+
+// WithRetention sets the function deciding how much history is kept
+// for each topic. By default that's DefaultRetention.
+func WithRetention(retention func(topic string) Retention) Option {
+	return func(h *Hub) { h.retention = retention }
+}
+
+// WithPageSize sets how many entries go in one delivery and in one
+// archive document. A subscriber that is behind gets several
+// deliveries, one after the other. Archives are only served while
+// retention keeps all of their entries, so retention has to keep at
+// least 2n-1 entries for there always to be one.
+func WithPageSize(n int) Option {
+	return func(h *Hub) { h.pageSize = n }
+}
+
+// WithChallenge sets how many characters the challenges sent to
+// subscribers have, and which characters they're made of. alphabet
+// can't be longer than 256 bytes, nor have a character twice, and
+// challenges must have at least MIN_RANDOM_BITS of entropy; otherwise
+// New panics. By default challenges are CHALLENGE_SIZE characters out
+// of ACCEPTABLE_RANDOM_CHARS.
+func WithChallenge(size int, alphabet string) Option {
+	return func(h *Hub) { h.challenges = &randStringMaker{size: size, alphabet: []byte(alphabet)} }
+}
+
+// DefaultTopicPolicy accepts any absolute http or https URL.
+func DefaultTopicPolicy(topic string) error {
+	_, err := parseHttpUrl(topic)
+	return err
+}
+
+// parseHttpUrl parses an absolute http or https URL.
+func parseHttpUrl(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("no host")
+	}
+	return u, nil
+}
+
+// New creates a hub and starts its background work. It panics if the
+// options are invalid.
+func New(opts ...Option) *Hub {
+	h := &Hub{
+		url:         DEFAULT_HUB_URL,
+		maxConns:    MAX_PARALLEL_OUTGOING_CONNS,
+		client:      http.DefaultClient,
+		topicPolicy: DefaultTopicPolicy,
+		pushSecret:  func(string) string { return "" },
+		challenges:  &randStringMaker{size: CHALLENGE_SIZE, alphabet: ACCEPTABLE_RANDOM_CHARS},
+		retention:   DefaultRetention,
+		pageSize:    DEFAULT_PAGE_SIZE,
+		logger:      logging.Discard(),
+		shards:      DEFAULT_SHARDS,
+		leaseTTL:    DEFAULT_LEASE_TTL,
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+
+	var err error
+	h.challenges, err = newRandStringMaker(h.challenges.size, h.challenges.alphabet)
+	if err != nil {
+		panic(fmt.Sprintf("hub: bad challenge settings: %v", err))
+	}
+
+	h.freeConns = make(chan bool, h.maxConns)
+	for i := 0; i < h.maxConns; i++ {
+		h.freeConns <- true
+	}
+
+	h.store = newContentStore(h.logger.With("component", "contentstore"))
+	for _, def := range h.initialAggregates {
+		if err := h.SetAggregate(def[0], def[1:]); err != nil {
+			h.logger.Error("Ignoring bad aggregate", logging.KeyTopic, def[0], logging.Err(err))
+		}
+	}
+	h.watchers = newWatchers()
+	h.lc = newLifecycle(h.logger.With("component", "lifecycle"))
+	h.sh = newSubscribeHandler(h, h.logger.With("component", "subscribe"))
+	h.ph = newPublishHandler(h, h.logger.With("component", "publish"))
+	h.ah = newArchiveHandler(h, h.logger.With("component", "archive"))
+	h.sth = newStreamHandler(h, h.logger.With("component", "stream"))
+	h.soh = newSocketHandler(h, h.logger.With("component", "websocket"))
+	h.d = startDispatcher(h.sh, h.ph, h.logger.With("component", "dispatcher"))
+	h.cluster.start(h, h.logger.With("component", "cluster"))
+	h.uh = newUpstreamHandler(h, h.logger.With("component", "upstream"))
+
+	pending, err := loadPending(h.pendingFile)
+	if err != nil {
+		h.logger.Error("Couldn't load unfinished work", "path", h.pendingFile, logging.Err(err))
+	} else {
+		h.requeuePending(pending)
+	}
+
+	h.mux = http.NewServeMux()
+	h.mux.Handle("/publish", h.ph)
+	h.mux.Handle("/subscribe", h.sh)
+	h.mux.Handle("/archive", h.ah)
+	h.mux.Handle("/stream", h.sth)
+	h.mux.Handle("/ws", h.soh)
+	h.mux.Handle("/upstream", h.uh)
+
+	return h
+}
+
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mux.ServeHTTP(w, r)
+}
+
+// Shutdown stops all background work. In-flight fetches, verifications
+// and deliveries are given until ctx is done to finish; after that they
+// are aborted, and everything that didn't finish is saved to the
+// pending file, if any. The hub must not receive requests anymore when
+// this is called.
+//
+// Returns ctx.Err() if the deadline was reached.
+func (h *Hub) Shutdown(ctx context.Context) error {
+	h.watchers.close()
+	h.cluster.stop()
+	h.lc.stop()
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		h.ph.stop()
+		<-h.d.done
+		h.sh.stop()
+		h.sh.waitDeliveries()
+	}()
+
+	var err error
+	select {
+	case <-drained:
+		h.logger.Info("All in-flight work finished")
+	case <-ctx.Done():
+		err = ctx.Err()
+		h.logger.Warn("Shutdown deadline reached, aborting in-flight work")
+		h.lc.abort()
+		select {
+		case <-drained:
+		case <-time.After(ABORT_GRACE):
+			h.logger.Error("In-flight work didn't stop in time, some of it is lost")
+		}
+	}
+
+	if saveErr := h.lc.savePending(h.pendingFile); saveErr != nil {
+		h.logger.Error("Couldn't save unfinished work", "path", h.pendingFile, logging.Err(saveErr))
+		if err == nil {
+			err = saveErr
+		}
+	}
+
+	// Only now that we won't deliver anything anymore can other hubs
+	// take over
+	h.cluster.release()
+
+	return err
+}
+
+// requeuePending puts back work left over by a previous run in the
+// queues.
+func (h *Hub) requeuePending(pw *pendingWork) {
+	if err := h.ph.queueFetch(pw.Fetches...); err != nil {
+		h.logger.Error("Dropping pending fetches", "fetches", len(pw.Fetches), logging.Err(err))
+	}
+
+	for _, v := range pw.Verifications {
+		sr := &subscribeRequest{
+			callback:     v.Callback,
+			mode:         v.Mode,
+			topic:        v.Topic,
+			leaseSeconds: v.LeaseSeconds,
+			secret:       v.Secret,
+			verifyToken:  v.VerifyToken,
+			deliveryMode: v.DeliveryMode,
+		}
+		if v.Filter != "" {
+			var err error
+			sr.filter, err = filter.Parse(v.Filter)
+			if err != nil {
+				h.logger.Error("Dropping verification with a bad filter", logging.KeyTopic, v.Topic, logging.KeyCallback, v.Callback, logging.Err(err))
+				continue
+			}
+		}
+		if err := h.sh.requests.push(sr); err != nil {
+			h.logger.Error("Dropping pending verification", logging.KeyTopic, v.Topic, logging.KeyCallback, v.Callback, logging.Err(err))
+		}
+	}
+
+	for _, pd := range pw.Deliveries {
+		<-h.freeConns
+		h.sh.startDelivery(&delivery{
+			callback:    pd.Callback,
+			topic:       pd.Topic,
+			contentType: pd.ContentType,
+			secret:      pd.Secret,
+			data:        pd.Body,
+			attempt:     pd.Attempt,
+			cursor:      pd.Cursor,
+		})
+	}
+}
@@ -0,0 +1,456 @@
+package hub
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/feed"
+)
+
+const testEntryId = "urn:uuid:60a76c80-d399-11d9-b93C-0003939e0af6"
+
+func testFeed(updated time.Time) string {
+	return fmt.Sprintf(`<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Example Feed</title>
+  <id>urn:uuid:60a76c80-d399-11d9-b91C-0003939e0af6</id>
+  <updated>%s</updated>
+  <entry>
+    <title>Atom-Powered Robots Run Amok</title>
+    <id>%s</id>
+    <updated>%s</updated>
+  </entry>
+</feed>`, updated.Format(time.RFC3339), testEntryId, updated.Format(time.RFC3339))
+}
+
+// A subscriber that accepts every verification and sends what it
+// receives on deliveries.
+func newTestSubscriber(t *testing.T) (*httptest.Server, chan string) {
+	deliveries := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			fmt.Fprint(w, r.FormValue("hub.challenge"))
+		case "POST":
+			body, _ := io.ReadAll(r.Body)
+			deliveries <- string(body)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv, deliveries
+}
+
+func newTestHub(t *testing.T, opts ...Option) (*Hub, *httptest.Server) {
+	// The hub knows its URL from the start, work it picks up from a
+	// pending file already uses it
+	srv := httptest.NewUnstartedServer(nil)
+	h := New(append([]Option{WithURL("http://" + srv.Listener.Addr().String())}, opts...)...)
+	srv.Config.Handler = h
+	srv.Start()
+	t.Cleanup(func() {
+		srv.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		h.Shutdown(ctx)
+	})
+	return h, srv
+}
+
+func hasSubscriber(h *Hub, topic Topic, callback Callback) bool {
+	h.sh.subscribersMu.Lock()
+	defer h.sh.subscribersMu.Unlock()
+
+	_, ok := h.sh.subscribers[topic][callback]
+	return ok
+}
+
+func waitForSubscriber(t *testing.T, h *Hub, topic Topic, callback Callback) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if hasSubscriber(h, topic, callback) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("Subscription wasn't confirmed in time")
+}
+
+func TestSubscribePublishDeliver(t *testing.T) {
+	updated := time.Now().Add(time.Hour).UTC()
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/atom+xml")
+		fmt.Fprint(w, testFeed(updated))
+	}))
+	defer feed.Close()
+
+	sub, deliveries := newTestSubscriber(t)
+	h, hubSrv := newTestHub(t)
+
+	resp, err := http.PostForm(hubSrv.URL+"/subscribe", url.Values{
+		"hub.callback": {sub.URL},
+		"hub.mode":     {"subscribe"},
+		"hub.topic":    {feed.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Unexpected status for subscription: %s", resp.Status)
+	}
+
+	waitForSubscriber(t, h, Topic(feed.URL), Callback(sub.URL))
+
+	resp, err = http.PostForm(hubSrv.URL+"/publish", url.Values{
+		"hub.mode": {"publish"},
+		"hub.url":  {feed.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Unexpected status for publish: %s", resp.Status)
+	}
+
+	select {
+	case body := <-deliveries:
+		if !strings.Contains(body, testEntryId) {
+			t.Fatalf("Delivery doesn't contain the entry: %s", body)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't receive any delivery")
+	}
+}
+
+func TestDistributionKeepsFormat(t *testing.T) {
+	updated := time.Now().Add(time.Hour).UTC().Format(time.RFC1123Z)
+	rss := `<?xml version="1.0" encoding="ISO-8859-1"?>
+<rss version="2.0">
+  <channel>
+    <title>Liftoff News</title>
+    <item><guid>urn:item:1</guid><pubDate>` + updated + `</pubDate></item>
+  </channel>
+</rss>`
+
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/xml")
+		fmt.Fprint(w, rss)
+	}))
+	defer feed.Close()
+
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub())
+	subscribe(t, h, hubSrv.URL, ws, subscribeForm("subscribe", ws.URL, feed.URL))
+	publish(t, hubSrv.URL, feed.URL)
+
+	d := ws.nextDelivery(t)
+	if ct := d.header.Get("Content-Type"); ct != "text/xml; charset=iso-8859-1" {
+		t.Errorf("Unexpected Content-Type %q", ct)
+	}
+	if string(d.body) != rss {
+		t.Errorf("Delivered document differs from the original:\n%s", d.body)
+	}
+}
+
+func TestThinPing(t *testing.T) {
+	feed := newWebsubPublisher(t, "application/atom+xml", testFeed(time.Now().Add(time.Hour)))
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub())
+
+	form := subscribeForm("subscribe", ws.URL, feed.URL)
+	form.Set("hub.delivery_mode", "thin")
+	subscribe(t, h, hubSrv.URL, ws, form)
+	publish(t, hubSrv.URL, feed.URL)
+
+	d := ws.nextDelivery(t)
+	if len(d.body) != 0 {
+		t.Errorf("Expected an empty body, got %s", d.body)
+	}
+	checkLinks(t, d, hubSrv.URL, feed.URL)
+}
+
+func TestOnlyNewEntriesAreDelivered(t *testing.T) {
+	feed := newWebsubPublisher(t, "application/atom+xml", testFeed(time.Now().Add(time.Hour)))
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub())
+
+	subscribe(t, h, hubSrv.URL, ws, subscribeForm("subscribe", ws.URL, feed.URL))
+
+	publish(t, hubSrv.URL, feed.URL)
+	ws.nextDelivery(t)
+
+	// The subscriber already has the only entry
+	publish(t, hubSrv.URL, feed.URL)
+	ws.expectNoDelivery(t)
+}
+
+func TestFilteredSubscription(t *testing.T) {
+	future := time.Now().Add(time.Hour).UTC()
+	entry := func(i int, category string) string {
+		return fmt.Sprintf(`<entry><id>entry-%d</id><title>Entry %d</title><category term="%s"/><updated>%s</updated></entry>`,
+			i, i, category, future.Add(time.Duration(i)*time.Minute).Format(time.RFC3339))
+	}
+
+	var (
+		mu      sync.Mutex
+		entries = entry(1, "go") + entry(2, "rust") + entry(3, "go")
+	)
+	topic := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "application/atom+xml")
+		fmt.Fprintf(w, `<feed xmlns="http://www.w3.org/2005/Atom"><title>Filtered</title>%s</feed>`, entries)
+	}))
+	defer topic.Close()
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub())
+
+	form := subscribeForm("subscribe", ws.URL, topic.URL)
+	form.Set("hub.filter", "category:go")
+	subscribe(t, h, hubSrv.URL, ws, form)
+
+	publish(t, hubSrv.URL, topic.URL)
+	f, err := feed.Parse("application/atom+xml", ws.nextDelivery(t).body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Entries) != 2 || f.Entries[0].Id != "entry-1" || f.Entries[1].Id != "entry-3" {
+		t.Fatalf("Expected only the go entries, got %+v", f.Entries)
+	}
+
+	// Nothing new matches: no POST at all
+	mu.Lock()
+	entries += entry(4, "rust")
+	mu.Unlock()
+	publish(t, hubSrv.URL, topic.URL)
+	ws.expectNoDelivery(t)
+
+	mu.Lock()
+	entries += entry(5, "go")
+	mu.Unlock()
+	publish(t, hubSrv.URL, topic.URL)
+	f, err = feed.Parse("application/atom+xml", ws.nextDelivery(t).body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.Entries) != 1 || f.Entries[0].Id != "entry-5" {
+		t.Fatalf("Expected only the new go entry, got %+v", f.Entries)
+	}
+}
+
+func TestBadFilter(t *testing.T) {
+	h, hubSrv := newTestHub(t)
+
+	form := subscribeForm("subscribe", "http://example.com/cb", "http://example.com/feed")
+	form.Set("hub.filter", "(unbalanced")
+	resp := postForm(t, hubSrv.URL+"/subscribe", form)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad filter, got %s", resp.Status)
+	}
+
+	form.Set("hub.filter", "category:go")
+	form.Set("hub.delivery_mode", "thin")
+	resp = postForm(t, hubSrv.URL+"/subscribe", form)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a filter on thin deliveries, got %s", resp.Status)
+	}
+
+	if _, err := h.store.processNewContent([]byte("hello"), "text/plain", "http://example.com/text"); err != nil {
+		t.Fatal(err)
+	}
+	form = subscribeForm("subscribe", "http://example.com/cb", "http://example.com/text")
+	form.Set("hub.filter", "category:go")
+	resp = postForm(t, hubSrv.URL+"/subscribe", form)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a filter on a topic that isn't a feed, got %s", resp.Status)
+	}
+}
+
+func TestBadRequests(t *testing.T) {
+	_, hubSrv := newTestHub(t, WithWebSub())
+
+	for _, c := range []struct {
+		name string
+		path string
+		form url.Values
+	}{
+		{"relative callback", "/subscribe", subscribeForm("subscribe", "/cb", "http://example.com/feed")},
+		{"callback scheme", "/subscribe", subscribeForm("subscribe", "ftp://example.com/cb", "http://example.com/feed")},
+		{"relative topic", "/subscribe", subscribeForm("subscribe", "http://example.com/cb", "/feed")},
+		{"topic scheme", "/subscribe", subscribeForm("subscribe", "http://example.com/cb", "file:///etc/passwd")},
+		{"bad lease", "/subscribe", url.Values{
+			"hub.callback":      {"http://example.com/cb"},
+			"hub.mode":          {"subscribe"},
+			"hub.topic":         {"http://example.com/feed"},
+			"hub.lease_seconds": {"forever"},
+		}},
+		{"negative lease", "/subscribe", url.Values{
+			"hub.callback":      {"http://example.com/cb"},
+			"hub.mode":          {"subscribe"},
+			"hub.topic":         {"http://example.com/feed"},
+			"hub.lease_seconds": {"-1"},
+		}},
+		{"several topics", "/subscribe", url.Values{
+			"hub.callback": {"http://example.com/cb"},
+			"hub.mode":     {"subscribe"},
+			"hub.topic":    {"http://example.com/a", "http://example.com/b"},
+		}},
+		{"publish mode", "/publish", url.Values{"hub.mode": {"subscribe"}, "hub.topic": {"http://example.com/feed"}}},
+		{"publish without topic", "/publish", url.Values{"hub.mode": {"publish"}}},
+		{"publish scheme", "/publish", url.Values{"hub.mode": {"publish"}, "hub.topic": {"http://example.com/feed", "file:///etc/passwd"}}},
+	} {
+		resp := postForm(t, hubSrv.URL+c.path, c.form)
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s: expected 400, got %s", c.name, resp.Status)
+		}
+	}
+}
+
+func TestLeaseIsClamped(t *testing.T) {
+	h, hubSrv := newTestHub(t)
+	ws := newWebsubSubscriber(t)
+
+	form := subscribeForm("subscribe", ws.URL, "http://example.com/feed")
+	form.Set("hub.lease_seconds", "1")
+	q := subscribe(t, h, hubSrv.URL, ws, form)
+	if lease := q.Get("hub.lease_seconds"); lease != strconv.Itoa(MIN_LEASE_SECONDS) {
+		t.Fatalf("Expected the lease to be raised to %d, got %s", MIN_LEASE_SECONDS, lease)
+	}
+}
+
+func TestSyncVerification(t *testing.T) {
+	h, hubSrv := newTestHub(t)
+	ws := newWebsubSubscriber(t)
+
+	form := subscribeForm("subscribe", ws.URL, "http://example.com/feed")
+	form["hub.verify"] = []string{"sync", "async"}
+	resp := postForm(t, hubSrv.URL+"/subscribe", form)
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected 204 for a synchronous subscription, got %s", resp.Status)
+	}
+	ws.nextVerification(t)
+	h.sh.subscribersMu.Lock()
+	_, ok := h.sh.subscribers["http://example.com/feed"][Callback(ws.URL)]
+	h.sh.subscribersMu.Unlock()
+	if !ok {
+		t.Fatal("Subscription isn't active when the hub answers")
+	}
+
+	refusing := httptest.NewServer(http.NotFoundHandler())
+	defer refusing.Close()
+	form = subscribeForm("subscribe", refusing.URL, "http://example.com/feed")
+	form.Set("hub.verify", "sync")
+	resp = postForm(t, hubSrv.URL+"/subscribe", form)
+	if resp.StatusCode != http.StatusConflict {
+		t.Fatalf("Expected 409 when the callback refuses, got %s", resp.Status)
+	}
+
+	form.Set("hub.verify", "async")
+	if resp = postForm(t, hubSrv.URL+"/subscribe", form); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected 202 for an asynchronous subscription, got %s", resp.Status)
+	}
+
+	form.Set("hub.verify", "whenever")
+	if resp = postForm(t, hubSrv.URL+"/subscribe", form); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown hub.verify, got %s", resp.Status)
+	}
+}
+
+func TestSyncVerificationIsAbandoned(t *testing.T) {
+	_, hubSrv := newTestHub(t)
+
+	abandoned := make(chan struct{})
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(abandoned)
+	}))
+	defer stuck.Close()
+
+	form := subscribeForm("subscribe", stuck.URL, "http://example.com/feed")
+	form.Set("hub.verify", "sync")
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "POST", hubSrv.URL+"/subscribe", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+		t.Fatalf("Expected the subscriber to give up, got %s", resp.Status)
+	}
+
+	select {
+	case <-abandoned:
+	case <-time.After(5 * time.Second):
+		t.Fatal("The verification went on after the subscriber gave up")
+	}
+}
+
+func TestVerifyTokenIsEchoed(t *testing.T) {
+	h, hubSrv := newTestHub(t)
+	ws := newWebsubSubscriber(t)
+
+	form := subscribeForm("subscribe", ws.URL, "http://example.com/feed")
+	form.Set("hub.verify_token", "t0ken")
+	q := subscribe(t, h, hubSrv.URL, ws, form)
+	if token := q.Get("hub.verify_token"); token != "t0ken" {
+		t.Fatalf("Expected hub.verify_token to be echoed, got %q", token)
+	}
+}
+
+func TestVerificationUrl(t *testing.T) {
+	params := url.Values{"hub.mode": {"subscribe"}, "hub.challenge": {"abc"}}
+
+	for _, c := range []struct {
+		callback string
+		expected string
+	}{
+		{"http://example.com/cb", "http://example.com/cb?hub.challenge=abc&hub.mode=subscribe"},
+		{"http://example.com/cb?id=42", "http://example.com/cb?id=42&hub.challenge=abc&hub.mode=subscribe"},
+		{"http://example.com/cb?id=a%2Bb&", "http://example.com/cb?id=a%2Bb&hub.challenge=abc&hub.mode=subscribe"},
+		{"http://example.com/cb?", "http://example.com/cb?hub.challenge=abc&hub.mode=subscribe"},
+		{"http://example.com/cb?id=42#section", "http://example.com/cb?id=42&hub.challenge=abc&hub.mode=subscribe"},
+		{"http://example.com:8081/cb", "http://example.com:8081/cb?hub.challenge=abc&hub.mode=subscribe"},
+		{"http://[::1]:8081/cb", "http://[::1]:8081/cb?hub.challenge=abc&hub.mode=subscribe"},
+	} {
+		got, err := verificationUrl(Callback(c.callback), params)
+		if err != nil {
+			t.Errorf("%s: %v", c.callback, err)
+			continue
+		}
+		if got != c.expected {
+			t.Errorf("%s: expected %s, got %s", c.callback, c.expected, got)
+		}
+	}
+
+	// Whatever way the host ends up encoded, it's still the same host
+	got, err := verificationUrl("http://bücher.example:8081/cb?id=42", params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Hostname() != "bücher.example" || u.Port() != "8081" || u.Query().Get("id") != "42" || u.Query().Get("hub.challenge") != "abc" {
+		t.Fatalf("Bad verification URL for an IDN callback: %s", got)
+	}
+}
+
+func TestCallbackWithQuery(t *testing.T) {
+	h, hubSrv := newTestHub(t)
+	ws := newWebsubSubscriber(t)
+
+	q := subscribe(t, h, hubSrv.URL, ws, subscribeForm("subscribe", ws.URL+"/cb?id=42#top", "http://example.com/feed"))
+	if q.Get("id") != "42" || q.Get("hub.challenge") == "" {
+		t.Fatalf("Verification lost part of the query: %v", q)
+	}
+}
@@ -0,0 +1,164 @@
+package hub
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	// Enough for millions of entries per topic
+	INDEX_MAX_LEVEL = 24
+)
+
+// An entryIndex keeps the entries of a topic ordered by date, as a skip
+// list: insertion, removal and seeking to a date are O(log n), walking
+// from there is O(1) per entry. Feeds often give several entries the
+// same date, so entries at the same date are told apart, and ordered,
+// by their key (see entryKey). There is only one entry per key: an
+// entry updated since it was stored replaces its previous version.
+type entryIndex struct {
+	head  indexNode // before the first entry; its date is meaningless
+	level int       // number of levels in use
+	len   int
+	bytes int                  // total size of the entries
+	dates map[string]time.Time // key -> date of its entry
+}
+
+type indexNode struct {
+	date  time.Time
+	key   string
+	entry *storedEntry
+	next  []*indexNode // next node at each level
+}
+
+func newEntryIndex() *entryIndex {
+	return &entryIndex{
+		head:  indexNode{next: make([]*indexNode, INDEX_MAX_LEVEL)},
+		level: 1,
+		dates: make(map[string]time.Time),
+	}
+}
+
+// before tells whether n goes before the entry at date with key.
+func (n *indexNode) before(date time.Time, key string) bool {
+	if !n.date.Equal(date) {
+		return n.date.Before(date)
+	}
+	return n.key < key
+}
+
+// is tells whether n is the entry at date with key.
+func (n *indexNode) is(date time.Time, key string) bool {
+	return n != nil && n.date.Equal(date) && n.key == key
+}
+
+// predecessors returns, for each level, the last node before the entry
+// at date with key. An empty key is before any entry at date.
+func (idx *entryIndex) predecessors(date time.Time, key string) (prev [INDEX_MAX_LEVEL]*indexNode) {
+	n := &idx.head
+	for l := idx.level - 1; l >= 0; l-- {
+		for n.next[l] != nil && n.next[l].before(date, key) {
+			n = n.next[l]
+		}
+		prev[l] = n
+	}
+	return prev
+}
+
+// get returns the entry at date with key, or nil.
+func (idx *entryIndex) get(date time.Time, key string) *storedEntry {
+	prev := idx.predecessors(date, key)
+	if n := prev[0].next[0]; n.is(date, key) {
+		return n.entry
+	}
+	return nil
+}
+
+// find returns the entry with key, whatever its date, or nil.
+func (idx *entryIndex) find(key string) *storedEntry {
+	date, ok := idx.dates[key]
+	if !ok {
+		return nil
+	}
+	return idx.get(date, key)
+}
+
+// put stores e at date with key, replacing and returning the entry
+// with key, at that date or any other.
+func (idx *entryIndex) put(date time.Time, key string, e *storedEntry) (previous *storedEntry) {
+	if old, ok := idx.dates[key]; ok && !old.Equal(date) {
+		previous = idx.remove(old, key)
+	}
+	idx.dates[key] = date
+
+	prev := idx.predecessors(date, key)
+	if n := prev[0].next[0]; n.is(date, key) {
+		previous, n.entry = n.entry, e
+		idx.bytes += len(e.raw) - len(previous.raw)
+		return previous
+	}
+
+	level := randomLevel()
+	for l := idx.level; l < level; l++ {
+		prev[l] = &idx.head
+	}
+	idx.level = max(idx.level, level)
+
+	n := &indexNode{date: date, key: key, entry: e, next: make([]*indexNode, level)}
+	for l := 0; l < level; l++ {
+		n.next[l] = prev[l].next[l]
+		prev[l].next[l] = n
+	}
+
+	idx.len++
+	idx.bytes += len(e.raw)
+	return previous
+}
+
+// remove takes out the entry at date with key and returns it, or nil if
+// there wasn't any.
+func (idx *entryIndex) remove(date time.Time, key string) *storedEntry {
+	prev := idx.predecessors(date, key)
+	n := prev[0].next[0]
+	if !n.is(date, key) {
+		return nil
+	}
+
+	for l := 0; l < len(n.next); l++ {
+		prev[l].next[l] = n.next[l]
+	}
+	for idx.level > 1 && idx.head.next[idx.level-1] == nil {
+		idx.level--
+	}
+
+	delete(idx.dates, key)
+	idx.len--
+	idx.bytes -= len(n.entry.raw)
+	return n.entry
+}
+
+// first returns the oldest node, or nil.
+func (idx *entryIndex) first() *indexNode {
+	return idx.head.next[0]
+}
+
+// seek returns the first node dated t or later, or nil.
+func (idx *entryIndex) seek(t time.Time) *indexNode {
+	prev := idx.predecessors(t, "")
+	return prev[0].next[0]
+}
+
+// following returns the node after n, or nil.
+func (n *indexNode) following() *indexNode {
+	return n.next[0]
+}
+
+// randomLevel draws how many levels a new node goes in: each level has
+// a quarter of the nodes of the one below.
+func randomLevel() int {
+	level := 1
+	for level < INDEX_MAX_LEVEL && rand.Intn(4) == 0 {
+		level++
+	}
+	return level
+}
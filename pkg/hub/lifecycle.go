@@ -0,0 +1,186 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+// The lifecycle is shared by every piece of background work in the
+// hub. It carries two signals:
+//   - stopping is closed as soon as the hub stops accepting new work;
+//     things that would otherwise wait (retry backoffs) persist
+//     themselves instead of waiting
+//   - ctx is canceled when the shutdown deadline is reached; in-flight
+//     network calls are aborted and persisted
+//
+// Everything that gets persisted ends up in pending, which is written
+// to disk before exiting and re-queued at next start.
+type lifecycle struct {
+	stopping chan struct{}
+	stopOnce sync.Once
+
+	ctx   context.Context
+	abort context.CancelFunc
+
+	pendingMu sync.Mutex
+	pending   pendingWork
+
+	logger *slog.Logger
+}
+
+type pendingWork struct {
+	Fetches       []Topic                `json:"fetches,omitempty"`
+	Verifications []*pendingVerification `json:"verifications,omitempty"`
+	Deliveries    []*pendingDelivery     `json:"deliveries,omitempty"`
+}
+
+type pendingVerification struct {
+	Callback     Callback     `json:"callback"`
+	Mode         string       `json:"mode"`
+	Topic        Topic        `json:"topic"`
+	LeaseSeconds int          `json:"lease_seconds"`
+	Secret       string       `json:"secret,omitempty"`
+	DeliveryMode DeliveryMode `json:"delivery_mode,omitempty"`
+	Filter       string       `json:"filter,omitempty"`
+	VerifyToken  string       `json:"verify_token,omitempty"`
+}
+
+type pendingDelivery struct {
+	Callback    Callback `json:"callback"`
+	Topic       Topic    `json:"topic"`
+	ContentType string   `json:"content_type,omitempty"`
+	Secret      string   `json:"secret,omitempty"`
+	Body        []byte   `json:"body"`
+	Attempt     int      `json:"attempt"`
+
+	// Where the subscriber's cursor goes once delivered
+	Cursor time.Time `json:"cursor"`
+}
+
+func newLifecycle(logger *slog.Logger) *lifecycle {
+	ctx, abort := context.WithCancel(context.Background())
+	return &lifecycle{
+		stopping: make(chan struct{}),
+		ctx:      ctx,
+		abort:    abort,
+		logger:   logger,
+	}
+}
+
+func (lc *lifecycle) stop() {
+	lc.stopOnce.Do(func() { close(lc.stopping) })
+}
+
+// sleep waits for d, unless the hub starts stopping before. Returns
+// false in the latter case.
+func (lc *lifecycle) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-lc.stopping:
+		return false
+	}
+}
+
+func (lc *lifecycle) persistFetch(topic Topic) {
+	lc.pendingMu.Lock()
+	lc.pending.Fetches = append(lc.pending.Fetches, topic)
+	lc.pendingMu.Unlock()
+	lc.logger.Info("Persisting unfinished fetch", logging.KeyTopic, topic)
+}
+
+func (lc *lifecycle) persistVerification(sr *subscribeRequest) {
+	lc.pendingMu.Lock()
+	lc.pending.Verifications = append(lc.pending.Verifications, &pendingVerification{
+		Callback:     sr.callback,
+		Mode:         sr.mode,
+		Topic:        sr.topic,
+		LeaseSeconds: sr.leaseSeconds,
+		Secret:       sr.secret,
+		DeliveryMode: sr.deliveryMode,
+		Filter:       sr.filter.String(),
+		VerifyToken:  sr.verifyToken,
+	})
+	lc.pendingMu.Unlock()
+	lc.logger.Info("Persisting unfinished verification", logging.KeyTopic, sr.topic, logging.KeyCallback, sr.callback)
+}
+
+func (lc *lifecycle) persistDelivery(d *delivery) {
+	lc.pendingMu.Lock()
+	lc.pending.Deliveries = append(lc.pending.Deliveries, &pendingDelivery{
+		Callback:    d.callback,
+		Topic:       d.topic,
+		ContentType: d.contentType,
+		Secret:      d.secret,
+		Body:        d.data,
+		Attempt:     d.attempt,
+		Cursor:      d.cursor,
+	})
+	lc.pendingMu.Unlock()
+	lc.logger.Info("Persisting unfinished delivery", logging.KeyTopic, d.topic, logging.KeyCallback, d.callback, logging.KeyAttempt, d.attempt)
+}
+
+// savePending writes everything that was persisted to path. Without a
+// path the work is only logged as lost.
+func (lc *lifecycle) savePending(path string) error {
+	lc.pendingMu.Lock()
+	defer lc.pendingMu.Unlock()
+
+	total := len(lc.pending.Fetches) + len(lc.pending.Verifications) + len(lc.pending.Deliveries)
+	if total == 0 {
+		if path != "" {
+			os.Remove(path)
+		}
+		return nil
+	}
+
+	if path == "" {
+		lc.logger.Warn("No pending file configured, dropping unfinished work", "items", total)
+		return nil
+	}
+
+	raw, err := json.Marshal(&lc.pending)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+
+	lc.logger.Info("Saved unfinished work", "path", path, "items", total)
+	return os.Rename(tmp, path)
+}
+
+// loadPending reads the work left over by a previous run at path and
+// removes the file. A missing file isn't an error.
+func loadPending(path string) (*pendingWork, error) {
+	pw := &pendingWork{}
+	if path == "" {
+		return pw, nil
+	}
+
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return pw, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(raw, pw); err != nil {
+		return nil, err
+	}
+
+	return pw, os.Remove(path)
+}
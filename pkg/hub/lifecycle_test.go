@@ -0,0 +1,178 @@
+package hub
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A subscriber that can hold deliveries until the hub gives up on them.
+type holdingSubscriber struct {
+	*httptest.Server
+	hold       atomic.Bool
+	deliveries chan []byte
+	release    chan struct{}
+}
+
+func newHoldingSubscriber(t *testing.T) *holdingSubscriber {
+	hs := &holdingSubscriber{
+		deliveries: make(chan []byte, 10),
+		release:    make(chan struct{}),
+	}
+	hs.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			fmt.Fprint(w, r.FormValue("hub.challenge"))
+		case "POST":
+			body, _ := io.ReadAll(r.Body)
+			hs.deliveries <- body
+			if hs.hold.Load() {
+				select {
+				case <-hs.release:
+				case <-r.Context().Done():
+				}
+			}
+		}
+	}))
+	t.Cleanup(hs.Close)
+	return hs
+}
+
+func (hs *holdingSubscriber) nextDelivery(t *testing.T) []byte {
+	select {
+	case body := <-hs.deliveries:
+		return body
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't receive any delivery")
+	}
+	return nil
+}
+
+// startHubWithDelivery starts a hub and has it deliver to hs, which
+// holds the delivery.
+func startHubWithDelivery(t *testing.T, hs *holdingSubscriber, pendingFile string) (*Hub, *httptest.Server) {
+	publisher := newWebsubPublisher(t, "application/atom+xml", testFeed(time.Now().Add(time.Hour)))
+
+	srv := httptest.NewUnstartedServer(nil)
+	h := New(WithURL("http://"+srv.Listener.Addr().String()), WithWebSub(), WithPendingFile(pendingFile))
+	srv.Config.Handler = h
+	srv.Start()
+	t.Cleanup(srv.Close)
+
+	postForm(t, srv.URL+"/subscribe", subscribeForm("subscribe", hs.URL, publisher.URL))
+	waitForSubscriber(t, h, Topic(publisher.URL), Callback(hs.URL))
+
+	hs.hold.Store(true)
+	publish(t, srv.URL, publisher.URL)
+	hs.nextDelivery(t)
+	return h, srv
+}
+
+func TestShutdownDrainsDeliveries(t *testing.T) {
+	pendingFile := filepath.Join(t.TempDir(), "pending.json")
+	hs := newHoldingSubscriber(t)
+	h, _ := startHubWithDelivery(t, hs, pendingFile)
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(hs.release)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.Shutdown(ctx); err != nil {
+		t.Fatalf("Expected the delivery to finish in time, got %v", err)
+	}
+	if _, err := os.Stat(pendingFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected no pending file when everything finished, got %v", err)
+	}
+}
+
+func TestShutdownAbortsAndRequeues(t *testing.T) {
+	pendingFile := filepath.Join(t.TempDir(), "pending.json")
+	hs := newHoldingSubscriber(t)
+	h, _ := startHubWithDelivery(t, hs, pendingFile)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := h.Shutdown(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("Expected the deadline to be reached, got %v", err)
+	}
+
+	raw, err := os.ReadFile(pendingFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pw pendingWork
+	if err := json.Unmarshal(raw, &pw); err != nil {
+		t.Fatal(err)
+	}
+	if len(pw.Deliveries) != 1 || pw.Deliveries[0].Callback != Callback(hs.URL) {
+		t.Fatalf("Expected the aborted delivery to be saved, got %s", raw)
+	}
+
+	// The next hub picks it up where the previous one left
+	hs.hold.Store(false)
+	next, _ := newTestHub(t, WithPendingFile(pendingFile))
+	if body := hs.nextDelivery(t); string(body) != string(pw.Deliveries[0].Body) {
+		t.Fatalf("Expected the saved delivery, got %s", body)
+	}
+	if _, err := os.Stat(pendingFile); !os.IsNotExist(err) {
+		t.Fatalf("Expected the pending file to be consumed, got %v", err)
+	}
+	next.lc.pendingMu.Lock()
+	defer next.lc.pendingMu.Unlock()
+	if len(next.lc.pending.Deliveries) != 0 {
+		t.Fatal("Requeued delivery was persisted again")
+	}
+}
+
+func TestPendingFetchesAndVerificationsAreRequeued(t *testing.T) {
+	pendingFile := filepath.Join(t.TempDir(), "pending.json")
+	publisher := newWebsubPublisher(t, "application/atom+xml", testFeed(time.Now().Add(time.Hour)))
+	ws := newWebsubSubscriber(t)
+
+	raw, err := json.Marshal(&pendingWork{
+		Fetches: []Topic{Topic(publisher.URL)},
+		Verifications: []*pendingVerification{{
+			Callback:     Callback(ws.URL),
+			Mode:         "subscribe",
+			Topic:        "http://example.com/feed",
+			LeaseSeconds: 60,
+			VerifyToken:  "t0ken",
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(pendingFile, raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	h, _ := newTestHub(t, WithPendingFile(pendingFile))
+
+	if q := ws.nextVerification(t); q.Get("hub.verify_token") != "t0ken" {
+		t.Fatalf("Expected the saved verification, got %v", q)
+	}
+	waitForSubscriber(t, h, "http://example.com/feed", Callback(ws.URL))
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, ok := h.store.historyPage(Topic(publisher.URL), -1, h.pageSize); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Saved fetch wasn't done")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
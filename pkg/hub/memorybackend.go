@@ -0,0 +1,221 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A MemoryBackend is a Backend for hubs running in the same process,
+// to try out a cluster or test it.
+type MemoryBackend struct {
+	mu            sync.Mutex
+	leases        map[string]*memoryLease
+	subscriptions map[string]map[string]*SharedSubscription // topic -> callback -> subscription
+	contents      map[string]*SharedContent
+	watchers      map[*memoryWatcher]bool
+}
+
+type memoryLease struct {
+	holder  string
+	expires time.Time
+}
+
+// A memoryWatcher queues changes for one hub, so that a slow hub never
+// blocks the others.
+type memoryWatcher struct {
+	node    string
+	mu      sync.Mutex
+	queue   []*Change
+	signal  chan struct{}
+	stopped chan struct{}
+}
+
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		leases:        make(map[string]*memoryLease),
+		subscriptions: make(map[string]map[string]*SharedSubscription),
+		contents:      make(map[string]*SharedContent),
+		watchers:      make(map[*memoryWatcher]bool),
+	}
+}
+
+func (mb *MemoryBackend) Acquire(ctx context.Context, name, holder string, ttl time.Duration) (bool, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	now := time.Now()
+	if l, ok := mb.leases[name]; ok && l.holder != holder && now.Before(l.expires) {
+		return false, nil
+	}
+	mb.leases[name] = &memoryLease{holder: holder, expires: now.Add(ttl)}
+	return true, nil
+}
+
+func (mb *MemoryBackend) Release(ctx context.Context, name, holder string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if l, ok := mb.leases[name]; ok && l.holder == holder {
+		delete(mb.leases, name)
+	}
+	return nil
+}
+
+func (mb *MemoryBackend) Holders(ctx context.Context, prefix string) (map[string]string, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	now := time.Now()
+	holders := make(map[string]string)
+	for name, l := range mb.leases {
+		if strings.HasPrefix(name, prefix) && now.Before(l.expires) {
+			holders[name] = l.holder
+		}
+	}
+	return holders, nil
+}
+
+func (mb *MemoryBackend) SaveSubscription(ctx context.Context, origin string, s *SharedSubscription) error {
+	copied := *s
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if mb.subscriptions[s.Topic] == nil {
+		mb.subscriptions[s.Topic] = make(map[string]*SharedSubscription)
+	}
+	mb.subscriptions[s.Topic][s.Callback] = &copied
+	mb.broadcast(&Change{Kind: ChangeSubscription, Origin: origin, Subscription: &copied})
+	return nil
+}
+
+func (mb *MemoryBackend) DeleteSubscription(ctx context.Context, origin string, topic, callback string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	delete(mb.subscriptions[topic], callback)
+	if len(mb.subscriptions[topic]) == 0 {
+		delete(mb.subscriptions, topic)
+	}
+	mb.broadcast(&Change{Kind: ChangeUnsubscription, Origin: origin, Topic: topic, Callback: callback})
+	return nil
+}
+
+func (mb *MemoryBackend) Subscriptions(ctx context.Context) ([]*SharedSubscription, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	var subs []*SharedSubscription
+	for _, byCallback := range mb.subscriptions {
+		for _, s := range byCallback {
+			copied := *s
+			subs = append(subs, &copied)
+		}
+	}
+	return subs, nil
+}
+
+func (mb *MemoryBackend) SaveContent(ctx context.Context, origin string, c *SharedContent) error {
+	copied := &SharedContent{Topic: c.Topic, ContentType: c.ContentType, Body: bytes.Clone(c.Body)}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.contents[c.Topic] = copied
+	mb.broadcast(&Change{Kind: ChangeContent, Origin: origin, Content: copied})
+	return nil
+}
+
+func (mb *MemoryBackend) Contents(ctx context.Context) ([]*SharedContent, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	contents := make([]*SharedContent, 0, len(mb.contents))
+	for _, c := range mb.contents {
+		contents = append(contents, c)
+	}
+	return contents, nil
+}
+
+func (mb *MemoryBackend) RequestFetch(ctx context.Context, origin string, topic string) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.broadcast(&Change{Kind: ChangeFetch, Origin: origin, Topic: topic})
+	return nil
+}
+
+func (mb *MemoryBackend) Watch(node string) (<-chan *Change, func()) {
+	w := &memoryWatcher{
+		node:    node,
+		signal:  make(chan struct{}, 1),
+		stopped: make(chan struct{}),
+	}
+
+	mb.mu.Lock()
+	mb.watchers[w] = true
+	mb.mu.Unlock()
+
+	changes := make(chan *Change)
+	go w.pump(changes)
+
+	var once sync.Once
+	stop := func() {
+		once.Do(func() {
+			mb.mu.Lock()
+			delete(mb.watchers, w)
+			mb.mu.Unlock()
+			close(w.stopped)
+		})
+	}
+	return changes, stop
+}
+
+// broadcast queues change for every hub but its origin. The caller
+// must hold the lock.
+func (mb *MemoryBackend) broadcast(change *Change) {
+	for w := range mb.watchers {
+		if w.node == change.Origin {
+			continue
+		}
+
+		w.mu.Lock()
+		w.queue = append(w.queue, change)
+		w.mu.Unlock()
+
+		select {
+		case w.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// pump sends the queued changes, in order, until the watcher is
+// stopped.
+func (w *memoryWatcher) pump(changes chan<- *Change) {
+	defer close(changes)
+
+	for {
+		w.mu.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.mu.Unlock()
+
+		for _, change := range queue {
+			select {
+			case changes <- change:
+			case <-w.stopped:
+				return
+			}
+		}
+
+		select {
+		case <-w.signal:
+		case <-w.stopped:
+			return
+		}
+	}
+}
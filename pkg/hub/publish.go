@@ -0,0 +1,334 @@
+package hub
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"sync"
+
+	"github.com/rakoo/psgb/pkg/feed"
+	"github.com/rakoo/psgb/pkg/link"
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+type publishHandler struct {
+	toFetch    *workQueue[Topic]
+	toIngest   *workQueue[*receivedContent]
+	newContent chan Topic // topic URI added in db
+
+	hub        *Hub
+	fetches    sync.WaitGroup
+	loopDone   chan struct{}
+	ingestDone chan struct{}
+
+	logger *slog.Logger
+}
+
+// Content we were given instead of fetching it, waiting to be stored.
+type receivedContent struct {
+	topic       Topic
+	contentType string
+	body        []byte
+}
+
+func newPublishHandler(h *Hub, logger *slog.Logger) *publishHandler {
+	ph := &publishHandler{
+		toFetch:    newWorkQueue[Topic](MAX_QUEUED_REQUESTS),
+		toIngest:   newWorkQueue[*receivedContent](MAX_QUEUED_REQUESTS),
+		newContent: make(chan Topic),
+		hub:        h,
+		loopDone:   make(chan struct{}),
+		ingestDone: make(chan struct{}),
+		logger:     logger,
+	}
+
+	go ph.start()
+	go ph.ingestLoop()
+
+	return ph
+}
+
+func (p *publishHandler) start() {
+	defer close(p.loopDone)
+
+	for {
+		topic, ok := p.toFetch.pop()
+		if !ok {
+			return
+		}
+		<-p.hub.freeConns
+		p.fetches.Add(1)
+		go func(topic Topic) {
+			defer p.fetches.Done()
+			if p.hub.cluster.requestFetch(topic) {
+				p.hub.freeConns <- true
+				p.logger.Debug("Fetch requested from the owner", logging.KeyTopic, topic)
+				return
+			}
+			p.fetchContent(topic)
+		}(topic)
+	}
+}
+
+func (p *publishHandler) ingestLoop() {
+	defer close(p.ingestDone)
+
+	for {
+		c, ok := p.toIngest.pop()
+		if !ok {
+			return
+		}
+		p.ingest(c.topic, c.contentType, c.body, p.logger.With(logging.KeyTopic, c.topic))
+	}
+}
+
+// stop makes the handler stop fetching new topics and waits until
+// in-flight fetches are done. Fetches still waiting are persisted;
+// content still waiting is stored. newContent is closed afterwards.
+func (p *publishHandler) stop() {
+	for _, topic := range p.toFetch.close() {
+		p.hub.lc.persistFetch(topic)
+	}
+	left := p.toIngest.close()
+	<-p.ingestDone
+	for _, c := range left {
+		p.ingest(c.topic, c.contentType, c.body, p.logger.With(logging.KeyTopic, c.topic))
+	}
+	<-p.loopDone
+	p.fetches.Wait()
+	close(p.newContent)
+}
+
+// As specified by 0.3. The topics are given in hub.url; WebSub
+// publishers use hub.topic, which is accepted too.
+func (p *publishHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := p.logger.With(logging.KeyRequestID, logging.RequestID(r))
+
+	if r.Method != "POST" {
+		logger.Debug("Bad method on publish", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct != "application/x-www-form-urlencoded" {
+		p.servePush(w, r, logger)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		logger.Warn("Error when parsing POST on publish", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Couldn't parse the form"))
+		return
+	}
+
+	mode := r.FormValue("hub.mode")
+	if mode != "publish" {
+		logger.Warn("Bad mode", "mode", mode, "expected", "publish")
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown hub.mode %s", mode)
+		return
+	}
+
+	rawUrls := append(r.Form["hub.url"], r.Form["hub.topic"]...)
+	if len(rawUrls) == 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Didn't find hub.topic"))
+		return
+	}
+
+	// Nothing is fetched unless all topics are fine
+	var topics []Topic
+	seen := make(map[Topic]bool)
+	for _, rawUrl := range rawUrls {
+		parsedUrl, err := parseHttpUrl(rawUrl)
+		if err != nil {
+			logger.Warn("Bad url", "url", rawUrl, logging.Err(err))
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad topic %s: %s", rawUrl, err)
+			return
+		}
+		topic := Topic(parsedUrl.String())
+		if !seen[topic] {
+			seen[topic] = true
+			topics = append(topics, topic)
+		}
+	}
+
+	if err := p.queueFetch(topics...); err != nil {
+		refuseWork(w, err)
+		return
+	}
+	for _, topic := range topics {
+		logger.Info("Got new content notification", logging.KeyTopic, topic)
+	}
+
+	p.accepted(w)
+}
+
+func (p *publishHandler) accepted(w http.ResponseWriter) {
+	if p.hub.websub {
+		w.WriteHeader(http.StatusAccepted)
+	} else {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// Publishers can push the new content of a topic themselves (a fat
+// ping) instead of having us fetch it: the body is the content, the
+// topic is in hub.topic or a rel=self Link, and the body is signed with
+// the topic's push secret in X-Hub-Signature, as for deliveries.
+func (p *publishHandler) servePush(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	topic := r.URL.Query().Get("hub.topic")
+	if topic == "" {
+		for _, rawLink := range r.Header.Values("Link") {
+			for _, l := range link.Parse(rawLink) {
+				if l.Rel == "self" {
+					topic = l.Uri
+				}
+			}
+		}
+	}
+	if topic == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Didn't find hub.topic"))
+		return
+	}
+	parsedUrl, err := parseHttpUrl(topic)
+	if err != nil {
+		logger.Warn("Bad url", "url", topic, logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad topic %s: %s", topic, err)
+		return
+	}
+	topic = parsedUrl.String()
+	logger = logger.With(logging.KeyTopic, topic)
+
+	secret := p.hub.pushSecret(topic)
+	if secret == "" {
+		logger.Warn("Refusing pushed content")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Content can't be pushed for this topic"))
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_PUSH_BYTES))
+	if err != nil {
+		logger.Warn("Error when reading pushed content", logging.Err(err))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+
+	if !validSignature(r.Header.Get("X-Hub-Signature"), secret, body) {
+		logger.Warn("Bad signature on pushed content")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Bad X-Hub-Signature"))
+		return
+	}
+
+	// Unreadable content is refused now; storing it is done later
+	ct := r.Header.Get("Content-Type")
+	if format := feed.Detect(ct, body); format != feed.FormatUnknown {
+		if _, _, err := feed.Split(format, body); err != nil {
+			logger.Warn("Not parsing pushed content", logging.Err(err))
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Couldn't parse %s content: %s", format, err)
+			return
+		}
+	}
+
+	if err := p.queueIngest(Topic(topic), ct, body); err != nil {
+		refuseWork(w, err)
+		return
+	}
+	logger.Info("Got pushed content", "bytes", len(body))
+
+	p.accepted(w)
+}
+
+// queueFetch has topics fetched, by this hub or by the ones owning
+// them in a cluster; owners are asked from the fetching goroutines. It
+// never blocks: if the fetches can't be queued, none of them is.
+func (p *publishHandler) queueFetch(topics ...Topic) error {
+	return p.toFetch.push(topics...)
+}
+
+// queueIngest has content we were given for topic stored and
+// distributed. It never blocks.
+func (p *publishHandler) queueIngest(topic Topic, contentType string, body []byte) error {
+	return p.toIngest.push(&receivedContent{topic: topic, contentType: contentType, body: body})
+}
+
+func (p *publishHandler) fetchContent(topic Topic) {
+	logger := p.logger.With(logging.KeyTopic, topic)
+
+	// TODO: User-Agent, If-None-Match, If-Modified-Since
+	req, err := http.NewRequestWithContext(p.hub.lc.ctx, "GET", string(topic), nil)
+	if err != nil {
+		p.hub.freeConns <- true
+		logger.Warn("Couldn't create a GET request", logging.Err(err))
+		return
+	}
+
+	resp, err := p.hub.client.Do(req)
+	p.hub.freeConns <- true
+
+	if err != nil {
+		if p.hub.lc.ctx.Err() != nil {
+			p.hub.lc.persistFetch(topic)
+			return
+		}
+		logger.Warn("Error when retrieving topic", logging.Err(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	// An error page isn't a new version of the topic
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logger.Warn("Topic couldn't be retrieved, keeping what we have", "status", resp.Status)
+		return
+	}
+
+	var c bytes.Buffer
+	_, err = io.Copy(&c, resp.Body)
+	if err != nil {
+		if p.hub.lc.ctx.Err() != nil {
+			p.hub.lc.persistFetch(topic)
+			return
+		}
+		logger.Warn("Error when reading topic", logging.Err(err))
+		return
+	}
+	p.ingest(topic, resp.Header.Get("Content-Type"), c.Bytes(), logger)
+}
+
+// ingest stores a new version of topic, served with contentType, and
+// distributes it if anything changed. Returns an error if the content
+// couldn't be read.
+func (p *publishHandler) ingest(topic Topic, contentType string, body []byte, logger *slog.Logger) error {
+	changed, err := p.hub.store.processNewContent(body, contentType, topic)
+	if err != nil {
+		logger.Warn("Not parsing", logging.Err(err))
+		return err
+	}
+	if !changed {
+		logger.Info("Content didn't change, nothing to distribute")
+		return nil
+	}
+
+	logger.Info("Got new content", "bytes", len(body))
+	p.hub.cluster.saveContent(topic, contentType, body)
+	p.newContent <- topic
+	return nil
+}
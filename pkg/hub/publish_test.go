@@ -0,0 +1,130 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func push(t *testing.T, hubUrl, topic, signature string, body []byte) *http.Response {
+	req, _ := http.NewRequest("POST", hubUrl+"/publish?hub.topic="+url.QueryEscape(topic), bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/atom+xml")
+	if signature != "" {
+		req.Header.Set("X-Hub-Signature", signature)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func TestPushedContent(t *testing.T) {
+	const topic = "http://publisher.invalid/feed"
+	h, hubSrv := newTestHub(t, WithWebSub(), WithPushSecret(func(t string) string {
+		if t == topic {
+			return "s3cret"
+		}
+		return ""
+	}))
+
+	ws := newWebsubSubscriber(t)
+	subscribe(t, h, hubSrv.URL, ws, subscribeForm("subscribe", ws.URL, topic))
+
+	body := []byte(testFeed(time.Now().Add(time.Hour)))
+	signature := "sha256=" + hmacHex(sha256.New, "s3cret", body)
+
+	if resp := push(t, hubSrv.URL, topic, "sha256=0000", body); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a bad signature, got %s", resp.Status)
+	}
+	if resp := push(t, hubSrv.URL, "http://other.invalid/feed", signature, body); resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("Expected 403 for a topic without secret, got %s", resp.Status)
+	}
+	ws.expectNoDelivery(t)
+
+	// The publisher can't be reached: the content has to come from the
+	// push
+	if resp := push(t, hubSrv.URL, topic, signature, body); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected 202 for pushed content, got %s", resp.Status)
+	}
+	d := ws.nextDelivery(t)
+	if !strings.Contains(string(d.body), testEntryId) {
+		t.Fatalf("Delivery doesn't contain the entry: %s", d.body)
+	}
+	checkLinks(t, d, hubSrv.URL, topic)
+
+	bad := []byte("<feed")
+	if resp := push(t, hubSrv.URL, topic, "sha256="+hmacHex(sha256.New, "s3cret", bad), bad); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for unreadable content, got %s", resp.Status)
+	}
+}
+
+func TestPushedContentErrors(t *testing.T) {
+	h := New(WithPushSecret(func(string) string { return "s3cret" }))
+	hubSrv := httptest.NewServer(h)
+	defer hubSrv.Close()
+
+	body := []byte(testFeed(time.Now()))
+	signature := "sha256=" + hmacHex(sha256.New, "s3cret", body)
+
+	if resp := push(t, hubSrv.URL, "ftp://publisher.invalid/feed", signature, body); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad topic, got %s", resp.Status)
+	}
+
+	big := bytes.Repeat([]byte("a"), MAX_PUSH_BYTES+1)
+	if resp := push(t, hubSrv.URL, "http://publisher.invalid/feed", "sha256=0000", big); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected 413 for too much content, got %s", resp.Status)
+	}
+
+	// Pushes are refused, not stored, once the hub is stopped
+	if err := h.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if resp := push(t, hubSrv.URL, "http://publisher.invalid/feed", signature, body); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("Expected 503 once the hub is stopping, got %s", resp.Status)
+	}
+}
+
+func TestFailedFetchKeepsContent(t *testing.T) {
+	var failing atomic.Bool
+	topic := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			w.Header().Set("Content-Type", "text/html")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("<html>Internal Server Error</html>"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/atom+xml")
+		w.Write([]byte(testFeed(time.Now().Add(time.Hour))))
+	}))
+	defer topic.Close()
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub())
+
+	subscribe(t, h, hubSrv.URL, ws, subscribeForm("subscribe", ws.URL, topic.URL))
+	publish(t, hubSrv.URL, topic.URL)
+	if d := ws.nextDelivery(t); !strings.Contains(string(d.body), testEntryId) {
+		t.Fatalf("Delivery doesn't contain the entry: %s", d.body)
+	}
+
+	failing.Store(true)
+	publish(t, hubSrv.URL, topic.URL)
+	ws.expectNoDelivery(t)
+
+	h.store.Lock()
+	defer h.store.Unlock()
+	if items := h.store.content[Topic(topic.URL)]; items == nil || items.len != 1 {
+		t.Fatal("The stored entries were lost")
+	}
+	if _, ok := h.store.opaque[Topic(topic.URL)]; ok {
+		t.Fatal("The error page was stored")
+	}
+}
@@ -0,0 +1,114 @@
+package hub
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// How long clients are told to wait before trying again when their
+// request can't be queued
+const QUEUE_RETRY_AFTER = 60
+
+var (
+	errQueueFull   = errors.New("too many requests are waiting already")
+	errQueueClosed = errors.New("the hub is shutting down")
+)
+
+// A workQueue holds the work waiting for a handler's loop, so that HTTP
+// handlers never block: they answer as soon as the work is queued, or
+// refuse it right away when too much of it is waiting.
+type workQueue[T comparable] struct {
+	mu     sync.Mutex
+	items  []T
+	queued map[T]bool
+	max    int
+	closed bool
+	signal chan struct{}
+}
+
+func newWorkQueue[T comparable](max int) *workQueue[T] {
+	return &workQueue[T]{
+		queued: make(map[T]bool),
+		max:    max,
+		signal: make(chan struct{}, 1),
+	}
+}
+
+// push queues all items, or none of them if there isn't room for all.
+// Items already waiting in the queue aren't added twice.
+func (q *workQueue[T]) push(items ...T) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return errQueueClosed
+	}
+
+	var added []T
+	seen := make(map[T]bool)
+	for _, item := range items {
+		if !q.queued[item] && !seen[item] {
+			seen[item] = true
+			added = append(added, item)
+		}
+	}
+	if len(q.items)+len(added) > q.max {
+		return errQueueFull
+	}
+
+	for _, item := range added {
+		q.queued[item] = true
+		q.items = append(q.items, item)
+	}
+
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// pop blocks until there is an item and returns it. It returns false
+// once the queue is closed.
+func (q *workQueue[T]) pop() (T, bool) {
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			var zero T
+			return zero, false
+		}
+		if len(q.items) > 0 {
+			item := q.items[0]
+			q.items = q.items[1:]
+			delete(q.queued, item)
+			q.mu.Unlock()
+			return item, true
+		}
+		q.mu.Unlock()
+
+		<-q.signal
+	}
+}
+
+// close makes pop return false and push fail, and returns the items
+// that were still waiting.
+func (q *workQueue[T]) close() []T {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = true
+	close(q.signal)
+	left := q.items
+	q.items = nil
+	return left
+}
+
+// refuseWork answers a request whose work couldn't be queued.
+func refuseWork(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", strconv.Itoa(QUEUE_RETRY_AFTER))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte(err.Error()))
+}
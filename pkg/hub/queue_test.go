@@ -0,0 +1,36 @@
+package hub
+
+import "testing"
+
+func TestWorkQueue(t *testing.T) {
+	q := newWorkQueue[string](2)
+
+	if err := q.push("a", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.push("b", "c"); err != errQueueFull {
+		t.Fatalf("Expected the queue to be full, got %v", err)
+	}
+	if err := q.push("a", "b"); err != nil {
+		t.Fatal(err)
+	}
+
+	if item, ok := q.pop(); !ok || item != "a" {
+		t.Fatalf("Expected a, got %q", item)
+	}
+	// a isn't waiting anymore, it can be queued again
+	if err := q.push("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	left := q.close()
+	if len(left) != 2 || left[0] != "b" || left[1] != "a" {
+		t.Fatalf("Expected b and a to be left, got %v", left)
+	}
+	if _, ok := q.pop(); ok {
+		t.Fatal("Popped from a closed queue")
+	}
+	if err := q.push("d"); err != errQueueClosed {
+		t.Fatalf("Expected the queue to be closed, got %v", err)
+	}
+}
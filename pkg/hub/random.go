@@ -0,0 +1,66 @@
+package hub
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Random strings must be at least that hard to guess
+const MIN_RANDOM_BITS = 64
+
+// A randStringMaker makes unpredictable strings, such as challenges,
+// out of an alphabet of at most 256 characters.
+type randStringMaker struct {
+	size     int
+	alphabet []byte
+}
+
+// newRandStringMaker returns a maker of strings of size characters out
+// of alphabet, which must be 1 to 256 different bytes. Together they
+// must give at least MIN_RANDOM_BITS of entropy.
+func newRandStringMaker(size int, alphabet []byte) (*randStringMaker, error) {
+	if len(alphabet) == 0 || len(alphabet) > 256 {
+		return nil, fmt.Errorf("alphabet must have 1 to 256 characters, got %d", len(alphabet))
+	}
+	var seen [256]bool
+	for _, c := range alphabet {
+		if seen[c] {
+			return nil, fmt.Errorf("alphabet has %q twice", c)
+		}
+		seen[c] = true
+	}
+	if size <= 0 {
+		return nil, errors.New("size must be positive")
+	}
+	if bits := float64(size) * math.Log2(float64(len(alphabet))); bits < MIN_RANDOM_BITS {
+		return nil, fmt.Errorf("%d characters out of %d only give %.0f bits of entropy, expected at least %d", size, len(alphabet), bits, MIN_RANDOM_BITS)
+	}
+
+	return &randStringMaker{
+		size:     size,
+		alphabet: alphabet,
+	}, nil
+}
+
+func (r *randStringMaker) RandomString() string {
+	// Random bytes past the last multiple of the alphabet's size are
+	// dropped, so that every character is as likely
+	limit := 256 - 256%len(r.alphabet)
+
+	s := make([]byte, 0, r.size)
+	buf := make([]byte, r.size)
+	for len(s) < r.size {
+		if _, err := rand.Read(buf); err != nil {
+			panic(err)
+		}
+		for _, b := range buf {
+			if int(b) < limit && len(s) < r.size {
+				s = append(s, r.alphabet[int(b)%len(r.alphabet)])
+			}
+		}
+	}
+
+	return string(s)
+}
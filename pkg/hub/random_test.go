@@ -0,0 +1,90 @@
+package hub
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRandomString(t *testing.T) {
+	for _, alphabet := range [][]byte{ACCEPTABLE_RANDOM_CHARS, []byte("ab"), []byte("0123456789")} {
+		r, err := newRandStringMaker(64, alphabet)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		seen := make(map[string]bool)
+		for i := 0; i < 100; i++ {
+			s := r.RandomString()
+			if len(s) != 64 {
+				t.Fatalf("Expected 64 characters, got %d", len(s))
+			}
+			for _, c := range []byte(s) {
+				if bytes.IndexByte(alphabet, c) < 0 {
+					t.Fatalf("Got %q, which isn't in %s", c, alphabet)
+				}
+			}
+			if seen[s] {
+				t.Fatalf("Got %s twice", s)
+			}
+			seen[s] = true
+		}
+	}
+}
+
+func TestChallengeOption(t *testing.T) {
+	h, hubSrv := newTestHub(t, WithChallenge(48, "xyz"))
+	ws := newWebsubSubscriber(t)
+
+	q := subscribe(t, h, hubSrv.URL, ws, subscribeForm("subscribe", ws.URL, "http://example.com/feed"))
+	challenge := q.Get("hub.challenge")
+	if len(challenge) != 48 || len(bytes.Trim([]byte(challenge), "xyz")) != 0 {
+		t.Fatalf("Challenge doesn't follow the option: %s", challenge)
+	}
+}
+
+func TestRandomStringLimits(t *testing.T) {
+	all := make([]byte, 256)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	if r, err := newRandStringMaker(8, all); err != nil || len(r.RandomString()) != 8 {
+		t.Fatalf("Expected 256 characters to be fine, got %v", err)
+	}
+
+	for _, c := range []struct {
+		size     int
+		alphabet []byte
+	}{
+		{20, nil},
+		{20, append(all, 'a')},
+		{20, []byte("abca")},
+		{0, ACCEPTABLE_RANDOM_CHARS},
+		{-1, ACCEPTABLE_RANDOM_CHARS},
+		{100, []byte("a")},
+		{63, []byte("ab")},
+	} {
+		if _, err := newRandStringMaker(c.size, c.alphabet); err == nil {
+			t.Errorf("Expected an error for %d characters out of %q", c.size, c.alphabet)
+		}
+	}
+}
+
+func TestBadChallengeOption(t *testing.T) {
+	for _, c := range []struct {
+		size     int
+		alphabet string
+	}{
+		{10, ""},
+		{10, "aab"},
+		{4, "ab"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Expected New to refuse a challenge of %d out of %q", c.size, c.alphabet)
+				}
+			}()
+			New(WithChallenge(c.size, c.alphabet))
+		}()
+	}
+}
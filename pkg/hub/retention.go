@@ -0,0 +1,128 @@
+package hub
+
+import (
+	"sort"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+// A Retention bounds the history kept for a topic. Zero means no
+// limit.
+//
+// Entries that a subscriber hasn't received yet are kept past
+// MaxEntries and MaxBytes; MaxAge is a hard limit, so that a subscriber
+// that stopped answering doesn't keep content around forever.
+type Retention struct {
+	MaxEntries int
+	MaxAge     time.Duration
+	MaxBytes   int
+}
+
+// DefaultRetention keeps the last DEFAULT_RETENTION_ENTRIES entries of
+// every topic.
+func DefaultRetention(topic string) Retention {
+	return Retention{MaxEntries: DEFAULT_RETENTION_ENTRIES}
+}
+
+// TopicUsage is what the store holds for one topic.
+type TopicUsage struct {
+	Topic   string
+	Entries int
+	Bytes   int
+}
+
+// Usage is what the store holds overall. Bytes only count content:
+// entries, feed skeletons and non-feed documents.
+type Usage struct {
+	Topics  []TopicUsage
+	Entries int
+	Bytes   int
+}
+
+// Usage reports how much content the hub keeps, biggest topics first.
+func (h *Hub) Usage() *Usage {
+	return h.store.usage()
+}
+
+// enforceRetention evicts the oldest entries of topic until it fits in
+// r. Entries updated after pending, the oldest cursor of its
+// subscribers, are only evicted because of their age. A zero pending
+// means nobody waits for anything.
+func (cs *contentStore) enforceRetention(topic Topic, r Retention, pending time.Time) (evicted int) {
+	cs.Lock()
+	defer cs.Unlock()
+
+	items := cs.content[topic]
+	if items == nil {
+		return 0
+	}
+
+	if r.MaxAge > 0 {
+		limit := time.Now().Add(-r.MaxAge)
+		for n := items.first(); n != nil; {
+			next := n.following()
+			if n.entry.seen.Before(limit) {
+				cs.evict(topic, n)
+				evicted++
+			}
+			n = next
+		}
+	}
+
+	tooMany := func() bool {
+		return (r.MaxEntries > 0 && items.len > r.MaxEntries) ||
+			(r.MaxBytes > 0 && items.bytes > r.MaxBytes)
+	}
+	for n := items.first(); n != nil && tooMany(); n = items.first() {
+		if !pending.IsZero() && !n.date.Before(pending) {
+			cs.logger.Debug("Keeping entries over retention for late subscribers", logging.KeyTopic, topic, "entries", items.len)
+			break
+		}
+		cs.evict(topic, n)
+		evicted++
+	}
+
+	return evicted
+}
+
+// evict removes the entry of n from topic. The caller must hold the
+// lock.
+func (cs *contentStore) evict(topic Topic, n *indexNode) {
+	cs.content[topic].remove(n.date, n.key)
+	if n.date.After(cs.evictedUntil[topic]) {
+		cs.evictedUntil[topic] = n.date
+	}
+}
+
+func (cs *contentStore) usage() *Usage {
+	cs.Lock()
+	defer cs.Unlock()
+
+	u := &Usage{}
+	for topic := range cs.contentFormat {
+		tu := TopicUsage{Topic: string(topic)}
+		if items := cs.content[topic]; items != nil {
+			tu.Entries = items.len
+			tu.Bytes = items.bytes
+		}
+		if header := cs.contentHeader[topic]; header != nil {
+			tu.Bytes += len(header.Head) + len(header.Tail)
+		}
+		if opaque := cs.opaque[topic]; opaque != nil {
+			tu.Bytes += len(opaque.body)
+		}
+
+		u.Topics = append(u.Topics, tu)
+		u.Entries += tu.Entries
+		u.Bytes += tu.Bytes
+	}
+
+	sort.Slice(u.Topics, func(i, j int) bool {
+		if u.Topics[i].Bytes != u.Topics[j].Bytes {
+			return u.Topics[i].Bytes > u.Topics[j].Bytes
+		}
+		return u.Topics[i].Topic < u.Topics[j].Topic
+	})
+	return u
+}
@@ -0,0 +1,345 @@
+package hub
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rakoo/psgb/pkg/filter"
+	"github.com/rakoo/psgb/pkg/logging"
+	"github.com/rakoo/psgb/pkg/websocket"
+)
+
+// How many topics one WebSocket connection can be subscribed to; more
+// subscriptions are refused with an error
+const MAX_SOCKET_SUBSCRIPTIONS = 100
+
+// Serves subscriptions over WebSocket at /ws: a client subscribes to
+// up to MAX_SOCKET_SUBSCRIPTIONS topics over one connection, and new content is pushed
+// to it as it arrives. Every message is a JSON object, a socketMessage.
+//
+// The client sends:
+//
+//	{"type": "subscribe", "topic": ..., "filter": ..., "id": ...}
+//	{"type": "unsubscribe", "topic": ...}
+//	{"type": "ack", "topic": ..., "id": ...}
+//
+// and gets "subscribed", "unsubscribed" and "error" replies, and the
+// content of its topics:
+//
+//	{"type": "entry", "topic": ..., "id": ..., "content_type": ..., "data": ...}
+//	{"type": "content", "topic": ..., "content_type": ..., "data": ...}
+//
+// Entries work as on /stream: one per message, ids are their dates, and
+// subscribing with an id resumes after that entry. Each entry must be
+// acknowledged, which moves the connection's cursor on the topic; acks
+// are cumulative. At most a page of entries is sent on a topic until
+// they are acknowledged.
+type socketHandler struct {
+	hub      *Hub
+	upgrader *websocket.Upgrader
+	logger   *slog.Logger
+}
+
+type socketMessage struct {
+	Type        string `json:"type"`
+	Topic       string `json:"topic,omitempty"`
+	Filter      string `json:"filter,omitempty"`
+	Id          string `json:"id,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+	Data        string `json:"data,omitempty"`
+	Message     string `json:"message,omitempty"`
+}
+
+// A topic a connection is subscribed to.
+type socketSubscription struct {
+	watcher *watcher
+	filter  *filter.Filter
+
+	sent     time.Time   // entries updated before it were sent
+	inFlight []time.Time // dates of the entries sent but not acknowledged
+
+	contentHash [sha256.Size]byte // of the last document sent, for topics that aren't feeds
+}
+
+// A socketConn is the state of one connection. It is only used by the
+// goroutine serving it.
+type socketConn struct {
+	handler *socketHandler
+	conn    *websocket.Conn
+	subs    map[Topic]*socketSubscription
+	wake    chan struct{}
+	logger  *slog.Logger
+}
+
+func newSocketHandler(h *Hub, logger *slog.Logger) *socketHandler {
+	return &socketHandler{
+		hub:      h,
+		upgrader: &websocket.Upgrader{CheckOrigin: h.checkOrigin},
+		logger:   logger,
+	}
+}
+
+func (soh *socketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := soh.logger.With(logging.KeyRequestID, logging.RequestID(r))
+
+	conn, err := soh.upgrader.Upgrade(w, r)
+	if err != nil {
+		logger.Debug("Couldn't upgrade to WebSocket", logging.Err(err))
+		return
+	}
+
+	sc := &socketConn{
+		handler: soh,
+		conn:    conn,
+		subs:    make(map[Topic]*socketSubscription),
+		wake:    make(chan struct{}, 1),
+		logger:  logger,
+	}
+	logger.Info("WebSocket opened")
+	sc.serve()
+	logger.Info("WebSocket closed")
+}
+
+func (sc *socketConn) serve() {
+	defer func() {
+		for _, sub := range sc.subs {
+			sc.handler.hub.watchers.unwatch(sub.watcher)
+		}
+	}()
+
+	incoming := make(chan *socketMessage)
+	readDone := make(chan struct{})
+	go sc.read(incoming, readDone)
+	defer close(readDone)
+
+	keepalive := time.NewTicker(STREAM_KEEPALIVE)
+	defer keepalive.Stop()
+
+	var err error
+	for err == nil {
+		select {
+		case msg, ok := <-incoming:
+			if !ok {
+				return
+			}
+			err = sc.handle(msg)
+		case <-sc.wake:
+			for topic, sub := range sc.subs {
+				if err = sc.sendNew(topic, sub); err != nil {
+					break
+				}
+			}
+		case <-keepalive.C:
+			err = sc.conn.Ping()
+		case <-sc.handler.hub.watchers.closed:
+			sc.conn.Close(websocket.CloseGoingAway, "hub is shutting down")
+			return
+		}
+	}
+
+	sc.logger.Debug("Couldn't write to WebSocket", logging.Err(err))
+	sc.conn.Close(websocket.CloseNormal, "")
+}
+
+// read decodes the client's messages until the connection is closed.
+func (sc *socketConn) read(incoming chan<- *socketMessage, done <-chan struct{}) {
+	defer close(incoming)
+
+	for {
+		op, data, err := sc.conn.ReadMessage()
+		if err != nil {
+			var closeErr *websocket.CloseError
+			if !errors.As(err, &closeErr) {
+				sc.conn.Close(websocket.CloseNormal, "")
+			}
+			return
+		}
+
+		msg := &socketMessage{}
+		if op != websocket.OpText || json.Unmarshal(data, msg) != nil {
+			sc.conn.Close(websocket.CloseInvalidData, "expected a JSON object")
+			return
+		}
+
+		select {
+		case incoming <- msg:
+		case <-done:
+			return
+		}
+	}
+}
+
+func (sc *socketConn) handle(msg *socketMessage) error {
+	topic := Topic(msg.Topic)
+	if topic == "" {
+		return sc.sendError(msg, "Didn't find topic")
+	}
+
+	switch msg.Type {
+	case "subscribe":
+		return sc.subscribe(topic, msg)
+
+	case "unsubscribe":
+		if sub, ok := sc.subs[topic]; ok {
+			sc.handler.hub.watchers.unwatch(sub.watcher)
+			delete(sc.subs, topic)
+		}
+		sc.logger.Debug("Unsubscribed on WebSocket", logging.KeyTopic, topic)
+		return sc.send(&socketMessage{Type: "unsubscribed", Topic: msg.Topic})
+
+	case "ack":
+		sub, ok := sc.subs[topic]
+		if !ok {
+			return sc.sendError(msg, "Not subscribed to this topic")
+		}
+		date, err := parseEntryId(msg.Id)
+		if err != nil || !date.Before(sub.sent) {
+			return sc.sendError(msg, "Bad id")
+		}
+		sc.acknowledge(sub, date)
+		return sc.sendNew(topic, sub)
+
+	default:
+		return sc.sendError(msg, "Unknown type "+msg.Type)
+	}
+}
+
+func (sc *socketConn) subscribe(topic Topic, msg *socketMessage) error {
+	hub := sc.handler.hub
+
+	if !hub.store.isAggregate(topic) {
+		if err := hub.topicPolicy(string(topic)); err != nil {
+			return sc.sendError(msg, err.Error())
+		}
+	}
+
+	if _, ok := sc.subs[topic]; !ok && len(sc.subs) >= MAX_SOCKET_SUBSCRIPTIONS {
+		return sc.sendError(msg, fmt.Sprintf("Too many subscriptions, at most %d per connection", MAX_SOCKET_SUBSCRIPTIONS))
+	}
+
+	sub := &socketSubscription{sent: time.Now()}
+	if msg.Filter != "" {
+		var err error
+		sub.filter, err = filter.Parse(msg.Filter)
+		if err != nil {
+			return sc.sendError(msg, "Bad filter: "+err.Error())
+		}
+	}
+	if msg.Id != "" {
+		date, err := parseEntryId(msg.Id)
+		if err != nil {
+			return sc.sendError(msg, "Bad id")
+		}
+		sub.sent = date.Add(time.Nanosecond)
+	}
+
+	if previous, ok := sc.subs[topic]; ok {
+		hub.watchers.unwatch(previous.watcher)
+	}
+	sub.watcher = hub.watchers.watch(topic, sub.sent, sc.wake)
+	sc.subs[topic] = sub
+
+	sc.logger.Debug("Subscribed on WebSocket", logging.KeyTopic, topic, "cursor", sub.sent)
+	if err := sc.send(&socketMessage{Type: "subscribed", Topic: msg.Topic}); err != nil {
+		return err
+	}
+	return sc.sendNew(topic, sub)
+}
+
+// acknowledge records that the client received everything up to the
+// entry at date.
+func (sc *socketConn) acknowledge(sub *socketSubscription, date time.Time) {
+	acked := 0
+	for acked < len(sub.inFlight) && !sub.inFlight[acked].After(date) {
+		acked++
+	}
+	sub.inFlight = sub.inFlight[acked:]
+
+	cursor := date.Add(time.Nanosecond)
+	if len(sub.inFlight) == 0 {
+		// Entries filtered out since don't need an ack
+		cursor = sub.sent
+	}
+	sc.handler.hub.watchers.advance(sub.watcher, cursor)
+}
+
+// sendNew sends what the client hasn't received yet on topic, as far
+// as the acknowledgement window allows.
+func (sc *socketConn) sendNew(topic Topic, sub *socketSubscription) error {
+	hub := sc.handler.hub
+	contentType := hub.store.contentTypeOf(topic)
+
+	for len(sub.inFlight) < hub.pageSize {
+		data, next := hub.store.contentAfterDate(topic, sub.sent, 1, sub.filter)
+		if next.IsZero() {
+			// Not a feed: the whole document, if it changed
+			hash := sha256.Sum256(data)
+			if data == nil || hash == sub.contentHash {
+				return nil
+			}
+			sub.contentHash = hash
+			if !utf8.Valid(data) {
+				data = nil
+			}
+			return sc.send(&socketMessage{Type: "content", Topic: string(topic), ContentType: contentType, Data: string(data)})
+		}
+		if !next.After(sub.sent) {
+			return nil
+		}
+
+		date := next.Add(-time.Nanosecond)
+		sub.sent = next
+		if data == nil {
+			if len(sub.inFlight) == 0 {
+				hub.watchers.advance(sub.watcher, next)
+			}
+			continue
+		}
+
+		sub.inFlight = append(sub.inFlight, date)
+		err := sc.send(&socketMessage{
+			Type:        "entry",
+			Topic:       string(topic),
+			Id:          formatEntryId(date),
+			ContentType: contentType,
+			Data:        string(data),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (sc *socketConn) send(msg *socketMessage) error {
+	raw, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return sc.conn.WriteMessage(websocket.OpText, raw)
+}
+
+func (sc *socketConn) sendError(about *socketMessage, message string) error {
+	return sc.send(&socketMessage{Type: "error", Topic: about.Topic, Id: about.Id, Message: message})
+}
+
+// Entries are identified on /stream and /ws by their date, in
+// nanoseconds since the epoch.
+func formatEntryId(date time.Time) string {
+	return strconv.FormatInt(date.UnixNano(), 10)
+}
+
+func parseEntryId(id string) (time.Time, error) {
+	nanos, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, nanos), nil
+}
@@ -0,0 +1,130 @@
+package hub
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/websocket"
+)
+
+func dialSocket(t *testing.T, hubUrl string) *websocket.Conn {
+	conn, err := websocket.Dial("ws" + strings.TrimPrefix(hubUrl, "http") + "/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close(websocket.CloseNormal, "") })
+	return conn
+}
+
+func sendSocket(t *testing.T, conn *websocket.Conn, msg *socketMessage) {
+	raw, _ := json.Marshal(msg)
+	if err := conn.WriteMessage(websocket.OpText, raw); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readSocket(t *testing.T, conn *websocket.Conn) *socketMessage {
+	received := make(chan *socketMessage, 1)
+	go func() {
+		defer close(received)
+		_, raw, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		msg := &socketMessage{}
+		if json.Unmarshal(raw, msg) == nil {
+			received <- msg
+		}
+	}()
+
+	select {
+	case msg, ok := <-received:
+		if !ok {
+			t.Fatal("Couldn't read a message")
+		}
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't receive any message")
+	}
+	return nil
+}
+
+func expectSocketEntry(t *testing.T, conn *websocket.Conn, topic string, n int) *socketMessage {
+	msg := readSocket(t, conn)
+	if msg.Type != "entry" || msg.Topic != topic || !strings.Contains(msg.Data, fmt.Sprintf("<id>entry-%d</id>", n)) {
+		t.Fatalf("Expected entry-%d of %s, got %+v", n, topic, msg)
+	}
+	return msg
+}
+
+func TestSocketSubscriptions(t *testing.T) {
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	first := newWebsubPublisher(t, "application/atom+xml", string(testEntriesFeedFrom(future, 1, 3)))
+	second := newWebsubPublisher(t, "application/atom+xml", string(testEntriesFeedFrom(future, 4, 4)))
+	_, hubSrv := newTestHub(t, WithWebSub(), WithPageSize(2), WithRetention(noRetention))
+
+	conn := dialSocket(t, hubSrv.URL)
+	for _, topic := range []string{first.URL, second.URL} {
+		sendSocket(t, conn, &socketMessage{Type: "subscribe", Topic: topic})
+		if msg := readSocket(t, conn); msg.Type != "subscribed" || msg.Topic != topic {
+			t.Fatalf("Expected a subscription confirmation, got %+v", msg)
+		}
+	}
+
+	publish(t, hubSrv.URL, second.URL)
+	expectSocketEntry(t, conn, second.URL, 4)
+
+	// Only a page of entries until they are acknowledged
+	publish(t, hubSrv.URL, first.URL)
+	expectSocketEntry(t, conn, first.URL, 1)
+	last := expectSocketEntry(t, conn, first.URL, 2)
+	sendSocket(t, conn, &socketMessage{Type: "ack", Topic: first.URL, Id: last.Id})
+	expectSocketEntry(t, conn, first.URL, 3)
+
+	// Another connection resumes after what was acknowledged
+	other := dialSocket(t, hubSrv.URL)
+	sendSocket(t, other, &socketMessage{Type: "subscribe", Topic: first.URL, Id: last.Id})
+	readSocket(t, other)
+	expectSocketEntry(t, other, first.URL, 3)
+
+	sendSocket(t, conn, &socketMessage{Type: "unsubscribe", Topic: first.URL})
+	if msg := readSocket(t, conn); msg.Type != "unsubscribed" {
+		t.Fatalf("Expected an unsubscription confirmation, got %+v", msg)
+	}
+	sendSocket(t, conn, &socketMessage{Type: "ack", Topic: first.URL, Id: last.Id})
+	if msg := readSocket(t, conn); msg.Type != "error" {
+		t.Fatalf("Expected an error for an ack without subscription, got %+v", msg)
+	}
+}
+
+func TestSocketSubscriptionLimit(t *testing.T) {
+	_, hubSrv := newTestHub(t)
+
+	conn := dialSocket(t, hubSrv.URL)
+	subscribe := func(topic string) *socketMessage {
+		sendSocket(t, conn, &socketMessage{Type: "subscribe", Topic: topic})
+		return readSocket(t, conn)
+	}
+	for i := 0; i < MAX_SOCKET_SUBSCRIPTIONS; i++ {
+		if msg := subscribe(fmt.Sprintf("http://example.com/feed-%d", i)); msg.Type != "subscribed" {
+			t.Fatalf("Expected a subscription confirmation, got %+v", msg)
+		}
+	}
+
+	if msg := subscribe("http://example.com/one-too-many"); msg.Type != "error" {
+		t.Fatalf("Expected an error past the limit, got %+v", msg)
+	}
+	// Subscribing again to a topic doesn't add a subscription
+	if msg := subscribe("http://example.com/feed-0"); msg.Type != "subscribed" {
+		t.Fatalf("Expected a subscription confirmation, got %+v", msg)
+	}
+
+	sendSocket(t, conn, &socketMessage{Type: "unsubscribe", Topic: "http://example.com/feed-0"})
+	readSocket(t, conn)
+	if msg := subscribe("http://example.com/one-too-many"); msg.Type != "subscribed" {
+		t.Fatalf("Expected a subscription once there is room, got %+v", msg)
+	}
+}
@@ -0,0 +1,180 @@
+package hub
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rakoo/psgb/pkg/filter"
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+const (
+	// How often an idle stream gets a comment, so that proxies don't
+	// close it
+	STREAM_KEEPALIVE = 30 * time.Second
+)
+
+// Streams topics as Server-Sent Events, for clients that can't receive
+// callbacks (browsers, services behind NAT):
+//
+//	GET /stream?hub.topic=...[&hub.filter=...]
+//
+// Each new entry of a feed is an "entry" event whose data is a
+// document of the topic's format with only this entry. Its id is the
+// entry's date in nanoseconds since the epoch, so that a client
+// reconnecting with Last-Event-ID gets the entries it missed, as long
+// as the hub still has them. Topics that aren't feeds send a "content"
+// event with the whole document when the stream opens and whenever it
+// changes; its data is empty if the document isn't text.
+//
+// Without Last-Event-ID, the stream starts with what arrives after the
+// connection.
+type streamHandler struct {
+	hub    *Hub
+	logger *slog.Logger
+}
+
+func newStreamHandler(h *Hub, logger *slog.Logger) *streamHandler {
+	return &streamHandler{hub: h, logger: logger}
+}
+
+func (sth *streamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := sth.logger.With(logging.KeyRequestID, logging.RequestID(r))
+
+	if r.Method != "GET" {
+		logger.Debug("Bad method on stream", "method", r.Method)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	topic := Topic(r.FormValue("hub.topic"))
+	if topic == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Didn't find hub.topic"))
+		return
+	}
+	if !sth.hub.store.isAggregate(topic) {
+		if err := sth.hub.topicPolicy(string(topic)); err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(err.Error()))
+			return
+		}
+	}
+
+	var entryFilter *filter.Filter
+	if rawFilter := r.FormValue("hub.filter"); rawFilter != "" {
+		var err error
+		entryFilter, err = filter.Parse(rawFilter)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad hub.filter: %s", err)
+			return
+		}
+	}
+
+	cursor := time.Now()
+	if lastId := r.Header.Get("Last-Event-ID"); lastId != "" {
+		date, err := parseEntryId(lastId)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Bad Last-Event-ID"))
+			return
+		}
+		cursor = date.Add(time.Nanosecond)
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		logger.Error("Response can't be streamed")
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	watcher := sth.hub.watchers.watch(topic, cursor, make(chan struct{}, 1))
+	defer sth.hub.watchers.unwatch(watcher)
+
+	logger = logger.With(logging.KeyTopic, topic)
+	logger.Info("Stream opened", "cursor", cursor)
+	defer logger.Info("Stream closed")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(STREAM_KEEPALIVE)
+	defer keepalive.Stop()
+
+	err := sth.sendNew(w, watcher, entryFilter)
+	for err == nil {
+		flusher.Flush()
+
+		select {
+		case <-watcher.wake:
+			err = sth.sendNew(w, watcher, entryFilter)
+		case <-keepalive.C:
+			_, err = io.WriteString(w, ": keepalive\n\n")
+		case <-r.Context().Done():
+			return
+		case <-sth.hub.watchers.closed:
+			return
+		}
+	}
+	logger.Debug("Couldn't write to stream", logging.Err(err))
+}
+
+// sendNew writes the events for everything the stream hasn't received
+// yet.
+func (sth *streamHandler) sendNew(w io.Writer, watcher *watcher, f *filter.Filter) error {
+	for {
+		// One entry at a time, each is its own event
+		data, next := sth.hub.store.contentAfterDate(watcher.topic, watcher.cursor, 1, f)
+		if next.IsZero() {
+			// Not a feed: the whole document
+			if data == nil {
+				return nil
+			}
+			if !utf8.Valid(data) {
+				data = nil
+			}
+			return writeEvent(w, "", "content", data)
+		}
+		if !next.After(watcher.cursor) {
+			return nil
+		}
+
+		if data != nil {
+			if err := writeEvent(w, formatEntryId(next.Add(-time.Nanosecond)), "entry", data); err != nil {
+				return err
+			}
+		}
+		sth.hub.watchers.advance(watcher, next)
+	}
+}
+
+// writeEvent writes one Server-Sent Event. Every line of data goes in
+// its own data field.
+func writeEvent(w io.Writer, id, event string, data []byte) error {
+	var b bytes.Buffer
+	if id != "" {
+		fmt.Fprintf(&b, "id: %s\n", id)
+	}
+	fmt.Fprintf(&b, "event: %s\n", event)
+
+	data = bytes.ReplaceAll(data, []byte("\r\n"), []byte("\n"))
+	data = bytes.ReplaceAll(data, []byte("\r"), []byte("\n"))
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		b.WriteString("data: ")
+		b.Write(line)
+		b.WriteString("\n")
+	}
+	b.WriteString("\n")
+
+	_, err := w.Write(b.Bytes())
+	return err
+}
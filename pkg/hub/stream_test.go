@@ -0,0 +1,140 @@
+package hub
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/feed"
+)
+
+type streamEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+// openStream connects to the stream of topic and sends its events on
+// the returned channel.
+func openStream(t *testing.T, hubUrl, topic, lastId string) <-chan *streamEvent {
+	req, err := http.NewRequest("GET", hubUrl+"/stream?"+url.Values{"hub.topic": {topic}}.Encode(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lastId != "" {
+		req.Header.Set("Last-Event-ID", lastId)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected 200 for stream, got %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Unexpected Content-Type %q", ct)
+	}
+
+	events := make(chan *streamEvent, 10)
+	go func() {
+		defer close(events)
+		scanner := bufio.NewScanner(resp.Body)
+		ev := &streamEvent{}
+		var data []string
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case line == "":
+				ev.data = strings.Join(data, "\n")
+				events <- ev
+				ev, data = &streamEvent{}, nil
+			case strings.HasPrefix(line, "id: "):
+				ev.id = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				ev.event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				data = append(data, strings.TrimPrefix(line, "data: "))
+			}
+		}
+	}()
+	return events
+}
+
+func nextEntryEvent(t *testing.T, events <-chan *streamEvent) (id, entryId string) {
+	select {
+	case ev, ok := <-events:
+		if !ok {
+			t.Fatal("Stream closed")
+		}
+		if ev.event != "entry" || ev.id == "" {
+			t.Fatalf("Unexpected event %+v", ev)
+		}
+		f, err := feed.Parse("application/atom+xml", []byte(ev.data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(f.Entries) != 1 {
+			t.Fatalf("Expected one entry per event, got %d", len(f.Entries))
+		}
+		return ev.id, f.Entries[0].Id
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't receive any event")
+	}
+	return "", ""
+}
+
+func TestStream(t *testing.T) {
+	future := time.Now().Add(time.Hour).Truncate(time.Second)
+	topic := newWebsubPublisher(t, "application/atom+xml", string(testEntriesFeedFrom(future, 1, 3)))
+	_, hubSrv := newTestHub(t, WithWebSub())
+
+	events := openStream(t, hubSrv.URL, topic.URL, "")
+	publish(t, hubSrv.URL, topic.URL)
+
+	var ids []string
+	for i := 1; i <= 3; i++ {
+		id, entryId := nextEntryEvent(t, events)
+		if entryId != fmt.Sprintf("entry-%d", i) {
+			t.Fatalf("Expected entry-%d, got %s", i, entryId)
+		}
+		ids = append(ids, id)
+	}
+
+	// A client coming back gets what it missed
+	resumed := openStream(t, hubSrv.URL, topic.URL, ids[0])
+	for i := 2; i <= 3; i++ {
+		id, _ := nextEntryEvent(t, resumed)
+		if id != ids[i-1] {
+			t.Fatalf("Expected event %s after resuming, got %s", ids[i-1], id)
+		}
+	}
+}
+
+func TestStreamBadRequests(t *testing.T) {
+	_, hubSrv := newTestHub(t)
+
+	for _, u := range []string{"/stream", "/stream?hub.topic=ftp://example.com/"} {
+		resp, err := http.Get(hubSrv.URL + u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			t.Errorf("Expected an error for %s", u)
+		}
+	}
+}
+
+func TestWriteEvent(t *testing.T) {
+	var b strings.Builder
+	writeEvent(&b, "42", "entry", []byte("<a>\r\n<b/>\r</a>"))
+	expected := "id: 42\nevent: entry\ndata: <a>\ndata: <b/>\ndata: </a>\n\n"
+	if b.String() != expected {
+		t.Fatalf("Unexpected event:\n%q", b.String())
+	}
+}
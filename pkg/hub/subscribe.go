@@ -0,0 +1,829 @@
+package hub
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/filter"
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+type Callback string
+
+// How new content is sent to a subscriber, chosen with
+// hub.delivery_mode at subscription time.
+type DeliveryMode string
+
+const (
+	// The new entries are POSTed (fat ping). This is the default.
+	DeliveryFat DeliveryMode = "fat"
+	// Only Link headers are POSTed, with an empty body (thin ping);
+	// the subscriber fetches the topic itself.
+	DeliveryThin DeliveryMode = "thin"
+)
+
+type subscribeRequest struct {
+	callback     Callback
+	mode         string
+	topic        Topic
+	leaseSeconds int
+	secret       string
+	deliveryMode DeliveryMode
+	filter       *filter.Filter
+	sync         bool   // the subscriber waits for the verification's outcome
+	verifyToken  string // echoed in the verification, as specified by 0.3
+}
+
+// A verificationError tells why intent couldn't be verified, and which
+// status a synchronous subscription request gets for it.
+type verificationError struct {
+	status int
+	reason string
+}
+
+func (e *verificationError) Error() string { return e.reason }
+
+type subscriber struct {
+	callback     Callback
+	topic        Topic
+	lastNotified time.Time
+	leaseSeconds int
+	expires      time.Time
+	secret       string
+	deliveryMode DeliveryMode
+	filter       *filter.Filter // only entries that go through it are delivered, if any
+
+	// A subscriber gets its backlog one page at a time. While pages are
+	// being delivered, new content is picked up by the last page instead
+	// of starting another delivery.
+	delivering bool
+	missed     bool // new content arrived while delivering
+}
+
+// As specified by 0.4
+type subscribeHandler struct {
+	requests        *workQueue[*subscribeRequest]
+	subscribers     map[Topic]map[Callback]*subscriber // topic -> subscriber's callback -> subscriber
+	subscribersMu   sync.Mutex
+	challengeSource *randStringMaker
+
+	hub           *Hub
+	confirmations sync.WaitGroup
+	deliveries    sync.WaitGroup
+	loopDone      chan struct{}
+
+	logger *slog.Logger
+}
+
+func newSubscribeHandler(h *Hub, logger *slog.Logger) *subscribeHandler {
+
+	sh := &subscribeHandler{
+		requests:        newWorkQueue[*subscribeRequest](MAX_QUEUED_REQUESTS),
+		subscribers:     make(map[Topic]map[Callback]*subscriber),
+		challengeSource: h.challenges,
+		hub:             h,
+		loopDone:        make(chan struct{}),
+		logger:          logger,
+	}
+
+	go sh.start()
+
+	return sh
+}
+
+func (sh *subscribeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := sh.logger.With(logging.KeyRequestID, logging.RequestID(r))
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		logger.Warn("Error when parsing POST on subscribe", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Couldn't parse the form"))
+		return
+	}
+
+	for _, param := range []string{"hub.callback", "hub.mode", "hub.topic", "hub.lease_seconds", "hub.secret", "hub.verify_token"} {
+		if len(r.PostForm[param]) > 1 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Only one %s can be given", param)
+			return
+		}
+	}
+
+	callback := Callback(r.FormValue("hub.callback"))
+	if callback == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Didn't find hub.callback"))
+		return
+	}
+	if _, err := parseHttpUrl(string(callback)); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Bad hub.callback: %s", err)
+		return
+	}
+
+	mode := r.FormValue("hub.mode")
+	if mode == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Didn't find hub.mode"))
+		return
+	}
+	if mode != "subscribe" && mode != "unsubscribe" {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown hub.mode %s", mode)
+		return
+	}
+
+	topic := Topic(r.FormValue("hub.topic"))
+	if topic == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Didn't find hub.topic"))
+		return
+	}
+	// Aggregates are named by us and don't have to be URLs; anything
+	// else is fetched, and can't be unless it is an http URL
+	if !sh.hub.store.isAggregate(topic) {
+		if _, err := parseHttpUrl(string(topic)); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad hub.topic: %s", err)
+			return
+		}
+	}
+
+	leaseSeconds := DEFAULT_LEASE_SECONDS
+	if leaseSecondsRaw := r.FormValue("hub.lease_seconds"); leaseSecondsRaw != "" {
+		leaseSeconds, err = strconv.Atoi(leaseSecondsRaw)
+		if err != nil || leaseSeconds <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad hub.lease_seconds %s", leaseSecondsRaw)
+			return
+		}
+		// The hub has the final say on the lease, the verification
+		// tells the subscriber which one it got
+		leaseSeconds = min(max(leaseSeconds, MIN_LEASE_SECONDS), MAX_LEASE_SECONDS)
+	}
+
+	secret := r.FormValue("hub.secret")
+	if len(secret) >= MAX_SECRET_BYTES {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "hub.secret must be less than %d bytes", MAX_SECRET_BYTES)
+		return
+	}
+
+	verifyToken := r.FormValue("hub.verify_token")
+	if len(verifyToken) >= MAX_SECRET_BYTES {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "hub.verify_token must be less than %d bytes", MAX_SECRET_BYTES)
+		return
+	}
+
+	deliveryMode := DeliveryMode(r.FormValue("hub.delivery_mode"))
+	if deliveryMode == "" {
+		deliveryMode = DeliveryFat
+	}
+	if deliveryMode != DeliveryFat && deliveryMode != DeliveryThin {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Unknown hub.delivery_mode %s", deliveryMode)
+		return
+	}
+
+	// As specified by 0.3, hub.verify lists the modes the subscriber
+	// supports, by order of preference. Without it, we verify
+	// asynchronously as 0.4 does.
+	sync := false
+	if verifyModes := r.Form["hub.verify"]; len(verifyModes) > 0 {
+		known := false
+		for _, verifyMode := range verifyModes {
+			if verifyMode == "sync" || verifyMode == "async" {
+				sync = verifyMode == "sync"
+				known = true
+				break
+			}
+		}
+		if !known {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Unknown hub.verify %v", verifyModes)
+			return
+		}
+	}
+
+	var entryFilter *filter.Filter
+	if rawFilter := r.FormValue("hub.filter"); rawFilter != "" {
+		entryFilter, err = filter.Parse(rawFilter)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad hub.filter: %s", err)
+			return
+		}
+		if deliveryMode == DeliveryThin {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("hub.filter needs content to filter, it can't be used with thin deliveries"))
+			return
+		}
+		// Content that isn't a feed never goes through a filter
+		if sh.hub.store.isOpaque(topic) {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("hub.filter needs a feed to filter, the topic isn't one"))
+			return
+		}
+	}
+
+	sr := &subscribeRequest{
+		callback:     callback,
+		mode:         mode,
+		topic:        topic,
+		leaseSeconds: leaseSeconds,
+		secret:       secret,
+		deliveryMode: deliveryMode,
+		filter:       entryFilter,
+		sync:         sync,
+		verifyToken:  verifyToken,
+	}
+	if sync {
+		sh.verifyNow(w, r, sr, logger)
+		return
+	}
+
+	err = sh.requests.push(sr)
+	if err != nil {
+		logger.Warn("Refusing subscription request", logging.Err(err))
+		refuseWork(w, err)
+		return
+	}
+	logger.Info("Got subscription request", "mode", mode, logging.KeyTopic, topic, logging.KeyCallback, callback, "lease_seconds", leaseSeconds, "delivery_mode", deliveryMode)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// verifyNow verifies intent while the subscriber waits, and answers
+// with the outcome.
+func (sh *subscribeHandler) verifyNow(w http.ResponseWriter, r *http.Request, sr *subscribeRequest, logger *slog.Logger) {
+	logger.Info("Got synchronous subscription request", "mode", sr.mode, logging.KeyTopic, sr.topic, logging.KeyCallback, sr.callback, "lease_seconds", sr.leaseSeconds, "delivery_mode", sr.deliveryMode)
+
+	select {
+	case <-sh.hub.freeConns:
+	case <-r.Context().Done():
+		return
+	case <-sh.hub.lc.stopping:
+		refuseWork(w, errQueueClosed)
+		return
+	}
+
+	// The verification is abandoned if the subscriber stops waiting, as
+	// well as when the hub stops
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stop := context.AfterFunc(sh.hub.lc.ctx, cancel)
+	defer stop()
+
+	err := sh.confirmSubscription(ctx, sr)
+	if err == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var verr *verificationError
+	if errors.As(err, &verr) {
+		w.WriteHeader(verr.status)
+	} else {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	w.Write([]byte(err.Error()))
+}
+
+func (sh *subscribeHandler) start() {
+	defer close(sh.loopDone)
+
+	for {
+		sr, ok := sh.requests.pop()
+		if !ok {
+			return
+		}
+		<-sh.hub.freeConns
+		sh.confirmations.Add(1)
+		go func(sr *subscribeRequest) {
+			defer sh.confirmations.Done()
+			sh.confirmSubscription(sh.hub.lc.ctx, sr)
+		}(sr)
+	}
+}
+
+// stop makes the handler stop verifying new subscriptions and waits
+// until in-flight verifications are done. Verifications still waiting
+// are persisted.
+func (sh *subscribeHandler) stop() {
+	for _, sr := range sh.requests.close() {
+		sh.hub.lc.persistVerification(sr)
+	}
+	<-sh.loopDone
+	sh.confirmations.Wait()
+}
+
+// waitDeliveries blocks until all deliveries are either done or
+// persisted. No new content must be distributed once this is called.
+func (sh *subscribeHandler) waitDeliveries() {
+	sh.deliveries.Wait()
+}
+
+// verificationUrl builds the URL the hub GETs on the callback to
+// verify intent or notify denial. The callback's own query is kept as
+// is, since subscribers may rely on its exact encoding, and params are
+// appended to it. Fragments are never sent.
+func verificationUrl(callback Callback, params url.Values) (string, error) {
+	u, err := url.Parse(string(callback))
+	if err != nil {
+		return "", err
+	}
+
+	query := strings.TrimRight(u.RawQuery, "&")
+	if query != "" {
+		query += "&"
+	}
+	u.RawQuery = query + params.Encode()
+	u.ForceQuery = false
+	u.Fragment = ""
+	u.RawFragment = ""
+	return u.String(), nil
+}
+
+// confirmSubscription verifies intent with the subscriber, until ctx is
+// done, and applies the request if it is confirmed. The caller must
+// have taken a connection from the pool; it is given back.
+func (sh *subscribeHandler) confirmSubscription(ctx context.Context, sr *subscribeRequest) error {
+	logger := sh.logger.With(logging.KeyTopic, sr.topic, logging.KeyCallback, sr.callback, "mode", sr.mode)
+
+	if sr.mode == "subscribe" && !sh.hub.store.isAggregate(sr.topic) {
+		if err := sh.hub.topicPolicy(string(sr.topic)); err != nil {
+			sh.denySubscription(ctx, sr, err.Error(), logger)
+			return &verificationError{http.StatusForbidden, err.Error()}
+		}
+	}
+
+	challenge := sh.challengeSource.RandomString()
+
+	params := url.Values{}
+	params.Set("hub.mode", sr.mode)
+	params.Set("hub.topic", string(sr.topic))
+	params.Set("hub.challenge", challenge)
+	if sr.mode == "subscribe" {
+		params.Set("hub.lease_seconds", strconv.Itoa(sr.leaseSeconds))
+	}
+	if sr.verifyToken != "" {
+		params.Set("hub.verify_token", sr.verifyToken)
+	}
+	requestURI, err := verificationUrl(sr.callback, params)
+	var req *http.Request
+	if err == nil {
+		logger.Debug("Confirming subscription", "url", requestURI)
+		req, err = http.NewRequestWithContext(ctx, "GET", requestURI, nil)
+	}
+	if err != nil {
+		sh.hub.freeConns <- true
+		logger.Warn("Couldn't create a GET request", logging.Err(err))
+		return &verificationError{http.StatusBadRequest, "Bad hub.callback"}
+	}
+
+	resp, err := sh.hub.client.Do(req)
+	sh.hub.freeConns <- true
+
+	// TODO: put back the request in the stack to re-process it later
+
+	if err != nil {
+		if sh.hub.lc.ctx.Err() != nil {
+			// A synchronous subscriber knows it has to try again
+			if !sr.sync {
+				sh.hub.lc.persistVerification(sr)
+			}
+			return &verificationError{http.StatusServiceUnavailable, errQueueClosed.Error()}
+		}
+		logger.Warn("Error when confirming subscription", logging.Err(err))
+		return &verificationError{http.StatusBadGateway, "Couldn't reach hub.callback"}
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var errBuffer bytes.Buffer
+		io.Copy(&errBuffer, resp.Body)
+		logger.Warn("Error from subscriber", "status", resp.Status)
+		return &verificationError{http.StatusConflict, fmt.Sprintf("Verification refused by hub.callback with %s", resp.Status)}
+	}
+
+	var bodyBuf bytes.Buffer
+	io.Copy(&bodyBuf, resp.Body)
+	subscriberChallenge := bodyBuf.String()
+
+	if subtle.ConstantTimeCompare([]byte(subscriberChallenge), []byte(challenge)) != 1 {
+		logger.Warn("Bad challenge from subscriber", "expected_length", len(challenge), "got_length", len(subscriberChallenge))
+		return &verificationError{http.StatusConflict, "hub.callback didn't echo hub.challenge"}
+	}
+
+	if sr.mode == "unsubscribe" {
+		sh.removeSubscriber(sr.topic, sr.callback)
+		sh.hub.cluster.deleteSubscription(sr.topic, sr.callback)
+		logger.Info("Unsubscription confirmed")
+		return nil
+	}
+
+	sh.subscribersMu.Lock()
+	if _, ok := sh.subscribers[sr.topic]; !ok {
+		sh.subscribers[sr.topic] = make(map[Callback]*subscriber)
+	}
+
+	now := time.Now()
+	sub := &subscriber{
+		callback:     Callback(sr.callback),
+		topic:        Topic(sr.topic),
+		lastNotified: now,
+		leaseSeconds: sr.leaseSeconds,
+		expires:      now.Add(time.Duration(sr.leaseSeconds) * time.Second),
+		secret:       sr.secret,
+		deliveryMode: sr.deliveryMode,
+		filter:       sr.filter,
+	}
+	if previous, ok := sh.subscribers[sr.topic][sr.callback]; ok {
+		// A renewal doesn't make the subscriber miss anything
+		sub.lastNotified = previous.lastNotified
+		sub.delivering = previous.delivering
+		sub.missed = previous.missed
+	}
+	sh.subscribers[sr.topic][sr.callback] = sub
+	sh.subscribersMu.Unlock()
+	sh.shareSubscription(sr.topic, sr.callback)
+
+	logger.Info("Subscription confirmed", "lease_seconds", sr.leaseSeconds)
+	return nil
+}
+
+// denySubscription tells the subscriber the hub won't accept its
+// subscription. The caller must have taken a connection from the
+// hub's free connections.
+func (sh *subscribeHandler) denySubscription(ctx context.Context, sr *subscribeRequest, reason string, logger *slog.Logger) {
+	params := url.Values{}
+	params.Set("hub.mode", "denied")
+	params.Set("hub.topic", string(sr.topic))
+	params.Set("hub.reason", reason)
+
+	logger.Info("Denying subscription", "reason", reason)
+
+	requestURI, err := verificationUrl(sr.callback, params)
+	var req *http.Request
+	if err == nil {
+		req, err = http.NewRequestWithContext(ctx, "GET", requestURI, nil)
+	}
+	if err != nil {
+		sh.hub.freeConns <- true
+		logger.Warn("Couldn't create a GET request", logging.Err(err))
+		return
+	}
+
+	resp, err := sh.hub.client.Do(req)
+	sh.hub.freeConns <- true
+	if err != nil {
+		logger.Warn("Error when notifying denial", logging.Err(err))
+		return
+	}
+	resp.Body.Close()
+}
+
+func (sh *subscribeHandler) removeSubscriber(topic Topic, callback Callback) {
+	sh.subscribersMu.Lock()
+	defer sh.subscribersMu.Unlock()
+
+	delete(sh.subscribers[topic], callback)
+	if len(sh.subscribers[topic]) == 0 {
+		delete(sh.subscribers, topic)
+	}
+}
+
+func (sh *subscribeHandler) distributeToSubscribers(topic Topic) {
+	now := time.Now()
+	owner := sh.hub.cluster.owns(topic)
+
+	sh.subscribersMu.Lock()
+	subs := make([]*subscriber, 0, len(sh.subscribers[topic]))
+	var expired []Callback
+	for callback, sub := range sh.subscribers[topic] {
+		if now.After(sub.expires) {
+			sh.logger.Info("Subscription expired", logging.KeyTopic, topic, logging.KeyCallback, callback)
+			delete(sh.subscribers[topic], callback)
+			expired = append(expired, callback)
+			continue
+		}
+		subs = append(subs, sub)
+	}
+	sh.subscribersMu.Unlock()
+
+	sh.hub.watchers.notify(topic)
+
+	var pending time.Time
+	if owner {
+		for _, callback := range expired {
+			sh.hub.cluster.deleteSubscription(topic, callback)
+		}
+	} else {
+		// Another hub of the cluster delivers; we only keep what its
+		// subscribers still miss
+		pending, _ = sh.oldestCursor(topic)
+		subs = nil
+	}
+
+	contentType := sh.hub.store.contentTypeOf(topic)
+	for _, sub := range subs {
+		d := &delivery{
+			callback: sub.callback,
+			topic:    topic,
+			secret:   sub.secret,
+		}
+		if sub.deliveryMode != DeliveryThin {
+			cursor, claimed := sh.claimDelivery(sub)
+			if pending.IsZero() || cursor.Before(pending) {
+				pending = cursor
+			}
+			if !claimed {
+				sh.logger.Debug("Delivery in progress, it will pick up new content", logging.KeyTopic, topic, logging.KeyCallback, sub.callback)
+				continue
+			}
+
+			d.contentType = contentType
+			d.data, d.cursor = sh.hub.store.contentAfterDate(topic, cursor, sh.hub.pageSize, sub.filter)
+			if d.data == nil {
+				sh.logger.Debug("Nothing new for subscriber", logging.KeyTopic, topic, logging.KeyCallback, sub.callback)
+				sh.advanceCursor(topic, sub.callback, d.cursor)
+				sh.releaseDelivery(topic, sub.callback)
+				continue
+			}
+		}
+
+		<-sh.hub.freeConns
+		sh.startDelivery(d)
+	}
+
+	// Streams, and aggregates which read their sources' entries, count
+	// too
+	if cursor, ok := sh.hub.watchers.oldestCursor(topic); ok && (pending.IsZero() || cursor.Before(pending)) {
+		pending = cursor
+	}
+	for _, aggregate := range sh.hub.store.aggregatesOf(topic) {
+		if cursor, ok := sh.oldestCursor(aggregate); ok && (pending.IsZero() || cursor.Before(pending)) {
+			pending = cursor
+		}
+		if cursor, ok := sh.hub.watchers.oldestCursor(aggregate); ok && (pending.IsZero() || cursor.Before(pending)) {
+			pending = cursor
+		}
+	}
+
+	evicted := sh.hub.store.enforceRetention(topic, sh.hub.retention(string(topic)), pending)
+	if evicted > 0 {
+		sh.logger.Debug("Evicted old entries", logging.KeyTopic, topic, "entries", evicted)
+	}
+}
+
+// oldestCursor returns the oldest cursor of the fat subscribers of
+// topic, if there are any.
+func (sh *subscribeHandler) oldestCursor(topic Topic) (cursor time.Time, ok bool) {
+	sh.subscribersMu.Lock()
+	defer sh.subscribersMu.Unlock()
+
+	for _, sub := range sh.subscribers[topic] {
+		if sub.deliveryMode == DeliveryThin {
+			continue
+		}
+		if !ok || sub.lastNotified.Before(cursor) {
+			cursor = sub.lastNotified
+			ok = true
+		}
+	}
+	return cursor, ok
+}
+
+// claimDelivery marks sub as being delivered to, unless it already
+// is. Returns its cursor either way.
+func (sh *subscribeHandler) claimDelivery(sub *subscriber) (cursor time.Time, claimed bool) {
+	sh.subscribersMu.Lock()
+	defer sh.subscribersMu.Unlock()
+
+	if sub.delivering {
+		sub.missed = true
+		return sub.lastNotified, false
+	}
+	sub.delivering = true
+	return sub.lastNotified, true
+}
+
+func (sh *subscribeHandler) releaseDelivery(topic Topic, callback Callback) {
+	sh.subscribersMu.Lock()
+	defer sh.subscribersMu.Unlock()
+
+	if sub, ok := sh.subscribers[topic][callback]; ok {
+		sub.delivering = false
+		sub.missed = false
+	}
+}
+
+// nextPage continues with what the subscriber still misses once d was
+// delivered, or marks it as not being delivered to anymore.
+func (sh *subscribeHandler) nextPage(d *delivery) {
+	sh.subscribersMu.Lock()
+	sub, ok := sh.subscribers[d.topic][d.callback]
+	if !ok {
+		sh.subscribersMu.Unlock()
+		return
+	}
+
+	// Looking for more content and releasing the subscriber happen
+	// together, so that distribution can't skip the subscriber after we
+	// looked.
+	var next *delivery
+	if !d.cursor.IsZero() || sub.missed {
+		next = &delivery{
+			callback:    d.callback,
+			topic:       d.topic,
+			contentType: sh.hub.store.contentTypeOf(d.topic),
+			secret:      sub.secret,
+		}
+		next.data, next.cursor = sh.hub.store.contentAfterDate(d.topic, sub.lastNotified, sh.hub.pageSize, sub.filter)
+		if next.data == nil {
+			// Whatever is left was filtered out
+			if next.cursor.After(sub.lastNotified) {
+				sub.lastNotified = next.cursor
+			}
+			next = nil
+		}
+	}
+	sub.missed = false
+	if next == nil {
+		sub.delivering = false
+	}
+	sh.subscribersMu.Unlock()
+
+	if next != nil {
+		sh.logger.Debug("Delivering next page", logging.KeyTopic, d.topic, logging.KeyCallback, d.callback)
+		<-sh.hub.freeConns
+		sh.startDelivery(next)
+	}
+}
+
+// advanceCursor records that the subscriber doesn't need anything
+// updated before cursor anymore.
+func (sh *subscribeHandler) advanceCursor(topic Topic, callback Callback, cursor time.Time) {
+	if cursor.IsZero() {
+		return
+	}
+
+	sh.subscribersMu.Lock()
+	sub, ok := sh.subscribers[topic][callback]
+	advanced := ok && cursor.After(sub.lastNotified)
+	if advanced {
+		sub.lastNotified = cursor
+	}
+	sh.subscribersMu.Unlock()
+
+	if advanced {
+		sh.shareSubscription(topic, callback)
+	}
+}
+
+// A delivery is one piece of content to be POSTed to one subscriber.
+type delivery struct {
+	callback    Callback
+	topic       Topic
+	contentType string
+	secret      string
+	data        []byte
+	attempt     int
+	cursor      time.Time // where the subscriber's cursor goes once delivered
+}
+
+// startDelivery runs the delivery in the background. The caller must
+// have taken a connection from the hub's free connections.
+func (sh *subscribeHandler) startDelivery(d *delivery) {
+	sh.deliveries.Add(1)
+	go func() {
+		defer sh.deliveries.Done()
+		sh.doDistribute(d)
+	}()
+}
+
+func (sh *subscribeHandler) doDistribute(d *delivery) {
+	logger := sh.logger.With(logging.KeyTopic, d.topic, logging.KeyCallback, d.callback, logging.KeyAttempt, d.attempt)
+
+	if d.attempt >= 5 {
+		logger.Error("Failed to deliver after 5 attempts. All hope is lost.")
+		sh.hub.freeConns <- true
+		// Don't hold back history for content that will never be delivered
+		sh.advanceCursor(d.topic, d.callback, d.cursor)
+		sh.releaseDelivery(d.topic, d.callback)
+		return
+	}
+
+	req, err := sh.buildRequest(d)
+	if err != nil {
+		logger.Error("Couldn't create a POST request", logging.Err(err))
+		sh.hub.freeConns <- true
+		sh.releaseDelivery(d.topic, d.callback)
+		return
+	}
+
+	resp, err := sh.hub.client.Do(req)
+	sh.hub.freeConns <- true
+
+	if err == nil {
+		resp.Body.Close()
+
+		switch {
+		case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+			logger.Debug("Delivered content", "status", resp.Status)
+			sh.advanceCursor(d.topic, d.callback, d.cursor)
+			sh.nextPage(d)
+			return
+		case resp.StatusCode == http.StatusGone:
+			// The subscriber tells us it doesn't want anything anymore
+			logger.Info("Subscriber is gone, removing subscription")
+			sh.removeSubscriber(d.topic, d.callback)
+			sh.hub.cluster.deleteSubscription(d.topic, d.callback)
+			return
+		}
+
+		err = fmt.Errorf("subscriber answered %s", resp.Status)
+	}
+
+	if sh.hub.lc.ctx.Err() != nil {
+		sh.hub.lc.persistDelivery(d)
+		return
+	}
+
+	logger.Warn("Error when distributing content", logging.Err(err))
+
+	// Wait 2 ^ attempt minutes before next try
+	multiplier := math.Pow(2, float64(d.attempt))
+	d.attempt++
+	if !sh.hub.lc.sleep(time.Duration(int(math.Ceil(multiplier))) * time.Minute) {
+		sh.hub.lc.persistDelivery(d)
+		return
+	}
+
+	<-sh.hub.freeConns
+	sh.startDelivery(d)
+}
+
+func (sh *subscribeHandler) buildRequest(d *delivery) (req *http.Request, err error) {
+	req, err = http.NewRequestWithContext(sh.hub.lc.ctx, "POST", string(d.callback), bytes.NewReader(d.data))
+	if err != nil {
+		return
+	}
+
+	if d.contentType != "" {
+		req.Header.Set("Content-Type", d.contentType)
+	}
+
+	var linkBuff bytes.Buffer
+	fmt.Fprintf(&linkBuff, "<%s>; rel=\"hub\", ", sh.hub.url)
+	fmt.Fprintf(&linkBuff, "<%s>; rel=\"self\"", d.topic)
+	req.Header.Add("Link", linkBuff.String())
+
+	if d.secret != "" {
+		req.Header.Set("X-Hub-Signature", sh.signature(d.secret, d.data))
+	}
+
+	return
+}
+
+// signature computes the X-Hub-Signature of data: HMAC-SHA1 as
+// specified by 0.4, HMAC-SHA256 in WebSub mode.
+func (sh *subscribeHandler) signature(secret string, data []byte) string {
+	algo, h := "sha1", sha1.New
+	if sh.hub.websub {
+		algo, h = "sha256", sha256.New
+	}
+
+	return algo + "=" + hmacHex(h, secret, data)
+}
+
+func hmacHex(h func() hash.Hash, secret string, data []byte) string {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,329 @@
+package hub
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/link"
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+// A hub can be the subscriber of other hubs, its upstreams, for some
+// topics: what they deliver is stored and distributed as if it had been
+// fetched here. This chains hubs across networks that can't reach each
+// other's publishers.
+//
+// Upstreams deliver to /upstream on this hub. Subscriptions are
+// requested again until they are verified, and renewed before they
+// expire.
+//
+// The secret of each subscription is derived from the key set with
+// WithUpstreamSecret, so that all the hubs of a cluster, which share
+// the callback, use the same one. Without a key, it is random and only
+// works for a hub on its own.
+
+const (
+	// How often upstream subscriptions are checked
+	UPSTREAM_CHECK_INTERVAL = time.Minute
+	// Subscriptions expiring sooner than that are renewed
+	UPSTREAM_RENEW_MARGIN = 5 * time.Minute
+)
+
+type upstreamState string
+
+const (
+	upstreamPending upstreamState = "pending" // never verified yet
+	upstreamActive  upstreamState = "active"
+	upstreamDenied  upstreamState = "denied" // not requested anymore
+)
+
+type upstreamSubscription struct {
+	hub     string // where subscription requests are POSTed
+	topic   Topic
+	secret  string
+	state   upstreamState
+	expires time.Time
+
+	requested bool // we expect a verification
+}
+
+type upstreamHandler struct {
+	hub  *Hub
+	mu   sync.Mutex
+	subs map[Topic]*upstreamSubscription
+
+	badSignatures atomic.Int64 // deliveries ignored since we started
+
+	logger *slog.Logger
+}
+
+// WithUpstream makes the hub subscribe to topics on another hub, whose
+// subscription endpoint is hubUrl.
+func WithUpstream(hubUrl string, topics ...string) Option {
+	return func(h *Hub) {
+		for _, topic := range topics {
+			h.upstreams = append(h.upstreams, [2]string{hubUrl, topic})
+		}
+	}
+}
+
+// WithUpstreamSecret sets the key the secrets of upstream
+// subscriptions are derived from. All the hubs of a cluster must use
+// the same.
+func WithUpstreamSecret(key string) Option {
+	return func(h *Hub) { h.upstreamKey = key }
+}
+
+func newUpstreamHandler(h *Hub, logger *slog.Logger) *upstreamHandler {
+	uh := &upstreamHandler{
+		hub:    h,
+		subs:   make(map[Topic]*upstreamSubscription),
+		logger: logger,
+	}
+
+	key := h.upstreamKey
+	if key == "" && len(h.upstreams) > 0 {
+		if h.cluster != nil {
+			logger.Warn("No upstream secret set, deliveries to other hubs of the cluster will be ignored")
+		}
+		random := make([]byte, 16)
+		rand.Read(random)
+		key = hex.EncodeToString(random)
+	}
+
+	for _, def := range h.upstreams {
+		uh.subs[Topic(def[1])] = &upstreamSubscription{
+			hub:    def[0],
+			topic:  Topic(def[1]),
+			secret: hmacHex(sha256.New, key, []byte(def[0]+" "+def[1])),
+			state:  upstreamPending,
+		}
+	}
+
+	if len(uh.subs) > 0 {
+		go uh.maintain()
+	}
+
+	return uh
+}
+
+func (uh *upstreamHandler) callbackUrl() string {
+	return uh.hub.url + "/upstream"
+}
+
+// maintain requests and renews subscriptions until the hub stops.
+func (uh *upstreamHandler) maintain() {
+	for {
+		now := time.Now()
+
+		uh.mu.Lock()
+		var due []*upstreamSubscription
+		for _, sub := range uh.subs {
+			switch {
+			case sub.state == upstreamPending:
+				due = append(due, sub)
+			case sub.state == upstreamActive && sub.expires.Sub(now) < UPSTREAM_RENEW_MARGIN:
+				due = append(due, sub)
+			}
+		}
+		uh.mu.Unlock()
+
+		for _, sub := range due {
+			uh.request(sub)
+		}
+
+		if !uh.hub.lc.sleep(UPSTREAM_CHECK_INTERVAL) {
+			return
+		}
+	}
+}
+
+// request asks the upstream for a subscription, or its renewal.
+func (uh *upstreamHandler) request(sub *upstreamSubscription) {
+	logger := uh.logger.With(logging.KeyTopic, sub.topic, "upstream", sub.hub)
+
+	form := url.Values{
+		"hub.callback":      {uh.callbackUrl()},
+		"hub.mode":          {"subscribe"},
+		"hub.topic":         {string(sub.topic)},
+		"hub.lease_seconds": {strconv.Itoa(DEFAULT_LEASE_SECONDS)},
+		"hub.secret":        {sub.secret},
+	}
+	req, err := http.NewRequestWithContext(uh.hub.lc.ctx, "POST", sub.hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		logger.Error("Couldn't create a POST request", logging.Err(err))
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	uh.mu.Lock()
+	sub.requested = true
+	uh.mu.Unlock()
+
+	<-uh.hub.freeConns
+	resp, err := uh.hub.client.Do(req)
+	uh.hub.freeConns <- true
+	if err != nil {
+		logger.Warn("Error when subscribing upstream", logging.Err(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		logger.Warn("Upstream refused subscription request", "status", resp.Status, "body", strings.TrimSpace(string(body)))
+		return
+	}
+	logger.Info("Subscription requested upstream")
+}
+
+func (uh *upstreamHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	logger := uh.logger.With(logging.KeyRequestID, logging.RequestID(r))
+
+	switch r.Method {
+	case "GET":
+		uh.handleVerification(w, r, logger)
+	case "POST":
+		uh.handleDelivery(w, r, logger)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (uh *upstreamHandler) handleVerification(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	topic := Topic(r.FormValue("hub.topic"))
+	mode := r.FormValue("hub.mode")
+	logger = logger.With(logging.KeyTopic, topic, "mode", mode)
+
+	uh.mu.Lock()
+	defer uh.mu.Unlock()
+
+	sub, ok := uh.subs[topic]
+	if !ok {
+		logger.Warn("Verification for a topic we don't want from upstream")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch mode {
+	case "denied":
+		sub.state = upstreamDenied
+		sub.requested = false
+		logger.Error("Upstream denied subscription", "reason", r.FormValue("hub.reason"))
+		w.WriteHeader(http.StatusOK)
+
+	case "subscribe":
+		if !sub.requested {
+			logger.Warn("Unexpected verification from upstream")
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		leaseSeconds, err := strconv.Atoi(r.FormValue("hub.lease_seconds"))
+		if err != nil || leaseSeconds <= 0 {
+			leaseSeconds = DEFAULT_LEASE_SECONDS
+		}
+		sub.state = upstreamActive
+		sub.requested = false
+		sub.expires = time.Now().Add(time.Duration(leaseSeconds) * time.Second)
+
+		logger.Info("Subscribed upstream", "lease_seconds", leaseSeconds)
+		w.WriteHeader(http.StatusOK)
+		fmt.Fprint(w, r.FormValue("hub.challenge"))
+
+	default:
+		// We never unsubscribe
+		logger.Warn("Unexpected verification from upstream")
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (uh *upstreamHandler) handleDelivery(w http.ResponseWriter, r *http.Request, logger *slog.Logger) {
+	var topic Topic
+	for _, rawLink := range r.Header.Values("Link") {
+		for _, l := range link.Parse(rawLink) {
+			if l.Rel == "self" {
+				topic = Topic(l.Uri)
+			}
+		}
+	}
+	logger = logger.With(logging.KeyTopic, topic)
+
+	uh.mu.Lock()
+	sub, ok := uh.subs[topic]
+	active := ok && sub.state == upstreamActive
+	uh.mu.Unlock()
+	if !active {
+		logger.Warn("Delivery for a topic we aren't subscribed to upstream")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_PUSH_BYTES))
+	if err != nil {
+		logger.Warn("Error when reading delivery", logging.Err(err))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+
+	if !validSignature(r.Header.Get("X-Hub-Signature"), sub.secret, body) {
+		// As specified by 0.4, the delivery is acknowledged but ignored
+		logger.Warn("Bad signature on delivery from upstream", "bad_signatures", uh.badSignatures.Add(1))
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	if len(body) == 0 {
+		// A thin ping: there is no content to ingest
+		err = uh.hub.ph.queueFetch(topic)
+	} else {
+		err = uh.hub.ph.queueIngest(topic, r.Header.Get("Content-Type"), body)
+	}
+	if err != nil {
+		// The upstream tries again later
+		logger.Warn("Couldn't queue delivery from upstream", logging.Err(err))
+		refuseWork(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validSignature checks an X-Hub-Signature, either HMAC-SHA1 or
+// HMAC-SHA256.
+func validSignature(signature, secret string, data []byte) bool {
+	algo, sum, ok := strings.Cut(signature, "=")
+	if !ok {
+		return false
+	}
+
+	var h func() hash.Hash
+	switch algo {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	default:
+		return false
+	}
+
+	return hmac.Equal([]byte(hmacHex(h, secret, data)), []byte(strings.ToLower(sum)))
+}
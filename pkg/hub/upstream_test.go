@@ -0,0 +1,114 @@
+package hub
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestUpstream(t *testing.T) {
+	var fetches atomic.Int32
+	topic := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches.Add(1)
+		w.Header().Set("Content-Type", "application/atom+xml")
+		w.Write([]byte(testFeed(time.Now().Add(time.Hour))))
+	}))
+	defer topic.Close()
+
+	parent, parentSrv := newTestHub(t, WithWebSub())
+
+	// The child must know its URL before it starts subscribing
+	childSrv := httptest.NewUnstartedServer(nil)
+	childUrl := "http://" + childSrv.Listener.Addr().String()
+	child := New(WithURL(childUrl), WithWebSub(), WithUpstream(parentSrv.URL+"/subscribe", topic.URL))
+	childSrv.Config.Handler = child
+	childSrv.Start()
+	t.Cleanup(func() {
+		childSrv.Close()
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		child.Shutdown(ctx)
+	})
+
+	waitForSubscriber(t, parent, Topic(topic.URL), Callback(childUrl+"/upstream"))
+
+	ws := newWebsubSubscriber(t)
+	subscribe(t, child, childUrl, ws, subscribeForm("subscribe", ws.URL, topic.URL))
+
+	publish(t, parentSrv.URL, topic.URL)
+	d := ws.nextDelivery(t)
+	if !strings.Contains(string(d.body), testEntryId) {
+		t.Fatalf("Delivery doesn't contain the entry: %s", d.body)
+	}
+	checkLinks(t, d, childUrl, topic.URL)
+	if n := fetches.Load(); n != 1 {
+		t.Fatalf("Expected only the parent to fetch the topic, got %d fetches", n)
+	}
+}
+
+func TestUpstreamRejectsUnsignedDeliveries(t *testing.T) {
+	h, hubSrv := newTestHub(t, WithUpstream("http://upstream.invalid/subscribe", "http://example.com/feed"))
+
+	h.uh.mu.Lock()
+	h.uh.subs["http://example.com/feed"].state = upstreamActive
+	h.uh.mu.Unlock()
+
+	req, _ := http.NewRequest("POST", hubSrv.URL+"/upstream", strings.NewReader(testFeed(time.Now())))
+	req.Header.Set("Link", `<http://example.com/feed>; rel="self"`)
+	req.Header.Set("X-Hub-Signature", "sha1=0000")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if _, ok := h.store.historyPage("http://example.com/feed", -1, h.pageSize); ok {
+		t.Fatal("Content with a bad signature was stored")
+	}
+	if n := h.uh.badSignatures.Load(); n != 1 {
+		t.Fatalf("Expected the bad signature to be counted, got %d", n)
+	}
+}
+
+func TestUpstreamRejectsLargeDeliveries(t *testing.T) {
+	h, hubSrv := newTestHub(t, WithUpstream("http://upstream.invalid/subscribe", "http://example.com/feed"))
+
+	h.uh.mu.Lock()
+	h.uh.subs["http://example.com/feed"].state = upstreamActive
+	h.uh.mu.Unlock()
+
+	req, _ := http.NewRequest("POST", hubSrv.URL+"/upstream", strings.NewReader(strings.Repeat("a", MAX_PUSH_BYTES+1)))
+	req.Header.Set("Link", `<http://example.com/feed>; rel="self"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected 413 for a delivery that is too large, got %s", resp.Status)
+	}
+}
+
+func TestUpstreamSecretIsShared(t *testing.T) {
+	secret := func(opts ...Option) string {
+		h, _ := newTestHub(t, append(opts, WithUpstream("http://upstream.invalid/subscribe", "http://example.com/feed"))...)
+		h.uh.mu.Lock()
+		defer h.uh.mu.Unlock()
+		return h.uh.subs["http://example.com/feed"].secret
+	}
+
+	if secret(WithUpstreamSecret("k3y")) != secret(WithUpstreamSecret("k3y")) {
+		t.Fatal("Hubs with the same key should use the same secret")
+	}
+	if secret(WithUpstreamSecret("k3y")) == secret(WithUpstreamSecret("other")) {
+		t.Fatal("The secret doesn't depend on the key")
+	}
+	if secret() == secret() {
+		t.Fatal("Hubs without a key should have their own secret")
+	}
+}
@@ -0,0 +1,105 @@
+package hub
+
+import (
+	"sync"
+	"time"
+)
+
+// watchers wakes up the streaming connections (as opposed to callback
+// subscribers) when there is new content on their topics. A wake-up
+// only says there is something new; the stream reads it from the store
+// with its own cursor.
+type watchers struct {
+	sync.Mutex
+	byTopic map[Topic]map[*watcher]bool
+
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+type watcher struct {
+	topic  Topic
+	wake   chan struct{}
+	cursor time.Time // entries updated before it were sent
+}
+
+func newWatchers() *watchers {
+	return &watchers{
+		byTopic: make(map[Topic]map[*watcher]bool),
+		closed:  make(chan struct{}),
+	}
+}
+
+// watch registers a stream of topic starting at cursor. wake receives a
+// value when topic gets new content; it can be shared by several
+// watchers. Wake-ups are coalesced: a slow reader gets a single one.
+func (ws *watchers) watch(topic Topic, cursor time.Time, wake chan struct{}) *watcher {
+	ws.Lock()
+	defer ws.Unlock()
+
+	w := &watcher{topic: topic, wake: wake, cursor: cursor}
+	if ws.byTopic[topic] == nil {
+		ws.byTopic[topic] = make(map[*watcher]bool)
+	}
+	ws.byTopic[topic][w] = true
+	return w
+}
+
+func (ws *watchers) unwatch(w *watcher) {
+	ws.Lock()
+	defer ws.Unlock()
+
+	delete(ws.byTopic[w.topic], w)
+	if len(ws.byTopic[w.topic]) == 0 {
+		delete(ws.byTopic, w.topic)
+	}
+}
+
+func (ws *watchers) notify(topic Topic) {
+	ws.Lock()
+	defer ws.Unlock()
+
+	for w := range ws.byTopic[topic] {
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// advance records that w was sent everything updated before cursor.
+func (ws *watchers) advance(w *watcher, cursor time.Time) {
+	ws.Lock()
+	defer ws.Unlock()
+
+	if cursor.After(w.cursor) {
+		w.cursor = cursor
+	}
+}
+
+// oldestCursor returns the oldest cursor of the streams of topic, if
+// there are any.
+func (ws *watchers) oldestCursor(topic Topic) (cursor time.Time, ok bool) {
+	ws.Lock()
+	defer ws.Unlock()
+
+	for w := range ws.byTopic[topic] {
+		if !ok || w.cursor.Before(cursor) {
+			cursor = w.cursor
+			ok = true
+		}
+	}
+	return cursor, ok
+}
+
+// close tells all streams to end.
+func (ws *watchers) close() {
+	ws.closeOnce.Do(func() { close(ws.closed) })
+}
+
+// CloseStreams ends all streaming connections, on /stream and /ws. An
+// http.Server waits for the former when shutting down, so register it
+// with RegisterOnShutdown.
+func (h *Hub) CloseStreams() {
+	h.watchers.close()
+}
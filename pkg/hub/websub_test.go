@@ -0,0 +1,375 @@
+package hub
+
+// Compliance tests mirroring the hub checks of https://websub.rocks,
+// run against an in-process hub in WebSub mode.
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/link"
+)
+
+type receivedDelivery struct {
+	header http.Header
+	body   []byte
+}
+
+// A subscriber recording what the hub sends it. It verifies intent by
+// echoing the challenge.
+type websubSubscriber struct {
+	*httptest.Server
+	verifications chan url.Values
+	deliveries    chan *receivedDelivery
+}
+
+func newWebsubSubscriber(t *testing.T) *websubSubscriber {
+	ws := &websubSubscriber{
+		verifications: make(chan url.Values, 10),
+		deliveries:    make(chan *receivedDelivery, 10),
+	}
+	ws.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET":
+			q := r.URL.Query()
+			ws.verifications <- q
+			fmt.Fprint(w, q.Get("hub.challenge"))
+		case "POST":
+			body, _ := io.ReadAll(r.Body)
+			ws.deliveries <- &receivedDelivery{header: r.Header, body: body}
+		}
+	}))
+	t.Cleanup(ws.Close)
+	return ws
+}
+
+func (ws *websubSubscriber) nextVerification(t *testing.T) url.Values {
+	select {
+	case q := <-ws.verifications:
+		return q
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't receive any verification")
+	}
+	return nil
+}
+
+func (ws *websubSubscriber) nextDelivery(t *testing.T) *receivedDelivery {
+	select {
+	case d := <-ws.deliveries:
+		return d
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't receive any delivery")
+	}
+	return nil
+}
+
+func (ws *websubSubscriber) expectNoDelivery(t *testing.T) {
+	select {
+	case d := <-ws.deliveries:
+		t.Fatalf("Unexpected delivery: %s", d.body)
+	case <-time.After(300 * time.Millisecond):
+	}
+}
+
+// A publisher serving a single document at its root.
+func newWebsubPublisher(t *testing.T, contentType, body string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", contentType)
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func postForm(t *testing.T, u string, form url.Values) *http.Response {
+	resp, err := http.PostForm(u, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func subscribeForm(mode, callback, topic string) url.Values {
+	return url.Values{
+		"hub.callback": {callback},
+		"hub.mode":     {mode},
+		"hub.topic":    {topic},
+	}
+}
+
+// subscribe goes through a full subscription and returns the
+// verification request.
+func subscribe(t *testing.T, h *Hub, hubUrl string, ws *websubSubscriber, form url.Values) url.Values {
+	resp := postForm(t, hubUrl+"/subscribe", form)
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected 202 for subscription, got %s", resp.Status)
+	}
+
+	q := ws.nextVerification(t)
+	waitForSubscriber(t, h, Topic(form.Get("hub.topic")), Callback(form.Get("hub.callback")))
+	return q
+}
+
+func publish(t *testing.T, hubUrl, topic string) {
+	resp := postForm(t, hubUrl+"/publish", url.Values{
+		"hub.mode":  {"publish"},
+		"hub.topic": {topic},
+	})
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected 202 for publish, got %s", resp.Status)
+	}
+}
+
+func checkLinks(t *testing.T, d *receivedDelivery, hubUrl, topic string) {
+	rels := make(map[string]string)
+	for _, raw := range d.header["Link"] {
+		for _, l := range link.Parse(raw) {
+			rels[l.Rel] = l.Uri
+		}
+	}
+
+	if rels["hub"] != hubUrl {
+		t.Errorf("Expected rel=hub link to %s, got %q", hubUrl, rels["hub"])
+	}
+	if rels["self"] != topic {
+		t.Errorf("Expected rel=self link to %s, got %q", topic, rels["self"])
+	}
+}
+
+func TestWebSub100TypicalSubscriberRequest(t *testing.T) {
+	feed := newWebsubPublisher(t, "application/atom+xml", testFeed(time.Now().Add(time.Hour)))
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub())
+
+	q := subscribe(t, h, hubSrv.URL, ws, subscribeForm("subscribe", ws.URL, feed.URL))
+
+	if q.Get("hub.mode") != "subscribe" {
+		t.Errorf("Expected hub.mode=subscribe in verification, got %q", q.Get("hub.mode"))
+	}
+	if q.Get("hub.topic") != feed.URL {
+		t.Errorf("Expected hub.topic=%s in verification, got %q", feed.URL, q.Get("hub.topic"))
+	}
+	if q.Get("hub.challenge") == "" {
+		t.Error("Missing hub.challenge in verification")
+	}
+	if lease, err := strconv.Atoi(q.Get("hub.lease_seconds")); err != nil || lease <= 0 {
+		t.Errorf("Expected a positive hub.lease_seconds in verification, got %q", q.Get("hub.lease_seconds"))
+	}
+
+	publish(t, hubSrv.URL, feed.URL)
+
+	d := ws.nextDelivery(t)
+	if ct, _, _ := mime.ParseMediaType(d.header.Get("Content-Type")); ct != "application/atom+xml" {
+		t.Errorf("Expected the original Content-Type, got %q", ct)
+	}
+	checkLinks(t, d, hubSrv.URL, feed.URL)
+}
+
+func TestWebSub101SubscriberIncludesSecret(t *testing.T) {
+	feed := newWebsubPublisher(t, "application/atom+xml", testFeed(time.Now().Add(time.Hour)))
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub())
+
+	form := subscribeForm("subscribe", ws.URL, feed.URL)
+	form.Set("hub.secret", "mysecret")
+	subscribe(t, h, hubSrv.URL, ws, form)
+
+	publish(t, hubSrv.URL, feed.URL)
+
+	d := ws.nextDelivery(t)
+	mac := hmac.New(sha256.New, []byte("mysecret"))
+	mac.Write(d.body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if sig := d.header.Get("X-Hub-Signature"); sig != expected {
+		t.Errorf("Bad signature: expected %s, got %s", expected, sig)
+	}
+}
+
+func TestWebSub102SubscriberSendsAdditionalParameters(t *testing.T) {
+	feed := newWebsubPublisher(t, "application/atom+xml", testFeed(time.Now().Add(time.Hour)))
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub())
+
+	form := subscribeForm("subscribe", ws.URL, feed.URL)
+	form.Set("foo", "bar")
+	form.Set("hub.unknown", "ignored")
+	subscribe(t, h, hubSrv.URL, ws, form)
+
+	publish(t, hubSrv.URL, feed.URL)
+	ws.nextDelivery(t)
+}
+
+func TestWebSub103SubscriberResubscribes(t *testing.T) {
+	feed := newWebsubPublisher(t, "application/atom+xml", testFeed(time.Now().Add(time.Hour)))
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub())
+
+	form := subscribeForm("subscribe", ws.URL, feed.URL)
+	subscribe(t, h, hubSrv.URL, ws, form)
+	subscribe(t, h, hubSrv.URL, ws, form)
+
+	publish(t, hubSrv.URL, feed.URL)
+	ws.nextDelivery(t)
+	ws.expectNoDelivery(t)
+}
+
+func TestWebSub104Unsubscribe(t *testing.T) {
+	feed := newWebsubPublisher(t, "application/atom+xml", testFeed(time.Now().Add(time.Hour)))
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub())
+
+	subscribe(t, h, hubSrv.URL, ws, subscribeForm("subscribe", ws.URL, feed.URL))
+
+	resp := postForm(t, hubSrv.URL+"/subscribe", subscribeForm("unsubscribe", ws.URL, feed.URL))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected 202 for unsubscription, got %s", resp.Status)
+	}
+
+	q := ws.nextVerification(t)
+	if q.Get("hub.mode") != "unsubscribe" {
+		t.Errorf("Expected hub.mode=unsubscribe in verification, got %q", q.Get("hub.mode"))
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for hasSubscriber(h, Topic(feed.URL), Callback(ws.URL)) {
+		if time.Now().After(deadline) {
+			t.Fatal("Subscription wasn't removed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	publish(t, hubSrv.URL, feed.URL)
+	ws.expectNoDelivery(t)
+}
+
+// checkOpaqueDelivery subscribes to a topic serving a document that
+// isn't a feed, and checks that it is distributed as is.
+func checkOpaqueDelivery(t *testing.T, contentType, body string) {
+	topic := newWebsubPublisher(t, contentType, body)
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub())
+
+	subscribe(t, h, hubSrv.URL, ws, subscribeForm("subscribe", ws.URL, topic.URL))
+	publish(t, hubSrv.URL, topic.URL)
+
+	d := ws.nextDelivery(t)
+	if ct := d.header.Get("Content-Type"); ct != contentType {
+		t.Errorf("Expected Content-Type %q, got %q", contentType, ct)
+	}
+	if string(d.body) != body {
+		t.Errorf("Expected the topic content as is, got %q", d.body)
+	}
+	checkLinks(t, d, hubSrv.URL, topic.URL)
+}
+
+func TestWebSub105PlaintextContent(t *testing.T) {
+	checkOpaqueDelivery(t, "text/plain", "Hello, world\n")
+}
+
+func TestWebSub106JSONContent(t *testing.T) {
+	checkOpaqueDelivery(t, "application/json", `{"hello":"world","count":2}`)
+}
+
+func TestOpaqueContentOnlyDistributedWhenChanged(t *testing.T) {
+	var (
+		mu   sync.Mutex
+		body = "<html><body>first</body></html>"
+	)
+	topic := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, body)
+	}))
+	defer topic.Close()
+	ws := newWebsubSubscriber(t)
+	h, hubSrv := newTestHub(t, WithWebSub())
+
+	subscribe(t, h, hubSrv.URL, ws, subscribeForm("subscribe", ws.URL, topic.URL))
+
+	publish(t, hubSrv.URL, topic.URL)
+	if d := ws.nextDelivery(t); string(d.body) != "<html><body>first</body></html>" {
+		t.Fatalf("Unexpected first delivery: %q", d.body)
+	}
+
+	publish(t, hubSrv.URL, topic.URL)
+	ws.expectNoDelivery(t)
+
+	mu.Lock()
+	body = "<html><body>second</body></html>"
+	mu.Unlock()
+
+	publish(t, hubSrv.URL, topic.URL)
+	if d := ws.nextDelivery(t); string(d.body) != "<html><body>second</body></html>" {
+		t.Fatalf("Expected the whole new version, got %q", d.body)
+	}
+}
+
+func TestWebSubDenial(t *testing.T) {
+	ws := newWebsubSubscriber(t)
+	_, hubSrv := newTestHub(t, WithWebSub(), WithTopicPolicy(func(topic string) error {
+		return errors.New("not on my watch")
+	}))
+
+	resp := postForm(t, hubSrv.URL+"/subscribe", subscribeForm("subscribe", ws.URL, "http://example.com/feed"))
+	if resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("Expected 202 for subscription, got %s", resp.Status)
+	}
+
+	q := ws.nextVerification(t)
+	if q.Get("hub.mode") != "denied" {
+		t.Errorf("Expected hub.mode=denied, got %q", q.Get("hub.mode"))
+	}
+	if q.Get("hub.topic") != "http://example.com/feed" {
+		t.Errorf("Expected hub.topic in denial, got %q", q.Get("hub.topic"))
+	}
+	if q.Get("hub.reason") != "not on my watch" {
+		t.Errorf("Expected hub.reason in denial, got %q", q.Get("hub.reason"))
+	}
+}
+
+func TestWebSubIntentNotVerified(t *testing.T) {
+	// This subscriber doesn't echo the challenge
+	verifications := make(chan struct{}, 1)
+	sub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "not the challenge")
+		verifications <- struct{}{}
+	}))
+	defer sub.Close()
+	h, hubSrv := newTestHub(t, WithWebSub())
+
+	postForm(t, hubSrv.URL+"/subscribe", subscribeForm("subscribe", sub.URL, "http://example.com/feed"))
+
+	select {
+	case <-verifications:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't receive any verification")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if hasSubscriber(h, "http://example.com/feed", Callback(sub.URL)) {
+		t.Fatal("Subscription was accepted without verification of intent")
+	}
+}
+
+func TestWebSubBadMode(t *testing.T) {
+	_, hubSrv := newTestHub(t, WithWebSub())
+
+	resp := postForm(t, hubSrv.URL+"/subscribe", subscribeForm("bogus", "http://example.com/cb", "http://example.com/feed"))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for a bad mode, got %s", resp.Status)
+	}
+}
@@ -0,0 +1,79 @@
+// Leveled, structured logging shared by the hub and the subscriber.
+// This is a thin layer over log/slog so that both binaries agree on
+// flags, output formats and the names of common fields.
+
+package logging
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// Names of the fields used across components, so that log lines can be
+// grepped/queried the same way everywhere.
+const (
+	KeyTopic     = "topic"
+	KeyCallback  = "callback"
+	KeyAttempt   = "attempt"
+	KeyRequestID = "request_id"
+	KeyError     = "err"
+)
+
+// New builds a logger writing to w. format is either "text" or "json",
+// level is one of "debug", "info", "warn" or "error".
+func New(w io.Writer, format, level string) (*slog.Logger, error) {
+	var lvl slog.Level
+	switch strings.ToLower(level) {
+	case "debug":
+		lvl = slog.LevelDebug
+	case "", "info":
+		lvl = slog.LevelInfo
+	case "warn", "warning":
+		lvl = slog.LevelWarn
+	case "error":
+		lvl = slog.LevelError
+	default:
+		return nil, fmt.Errorf("unknown log level %q", level)
+	}
+
+	opts := &slog.HandlerOptions{Level: lvl}
+
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	default:
+		return nil, fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// Discard returns a logger that drops everything. Useful as a default
+// when the caller didn't provide any.
+func Discard() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+// Err is a shorthand for the error field.
+func Err(err error) slog.Attr {
+	return slog.String(KeyError, err.Error())
+}
+
+// RequestID returns the id the client sent us in X-Request-Id, or a new
+// random one.
+func RequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" {
+		return id
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,153 @@
+package subscriber
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/feed"
+)
+
+// A Record is what sinks receive: one entry, along with where it comes
+// from.
+type Record struct {
+	Topic    string      `json:"topic"`
+	Hub      string      `json:"hub,omitempty"`
+	Received time.Time   `json:"received"`
+	Entry    *feed.Entry `json:"entry"`
+}
+
+// A Sink is somewhere entries are sent to once they are delivered.
+type Sink interface {
+	Send(ctx context.Context, rec *Record) error
+}
+
+// A JSONLSink appends records to one file per topic in a directory,
+// one JSON document per line.
+type JSONLSink struct {
+	dir string
+
+	mu sync.Mutex
+}
+
+func NewJSONLSink(dir string) (*JSONLSink, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &JSONLSink{dir: dir}, nil
+}
+
+// Path returns the file records for topic are appended to. The name
+// is made safe for the filesystem, and a hash of the topic keeps
+// different topics from ending up in the same file.
+func (js *JSONLSink) Path(topic string) string {
+	safe := strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+			return r
+		}
+		return '_'
+	}, topic)
+	if len(safe) > 100 {
+		safe = safe[:100]
+	}
+
+	sum := sha1.Sum([]byte(topic))
+	return filepath.Join(js.dir, safe+"-"+hex.EncodeToString(sum[:4])+".jsonl")
+}
+
+func (js *JSONLSink) Send(ctx context.Context, rec *Record) error {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	js.mu.Lock()
+	defer js.mu.Unlock()
+
+	f, err := os.OpenFile(js.Path(rec.Topic), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(line)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// An ExecSink runs a command for each record, with the record as JSON
+// on its standard input. The topic is also in PSGB_TOPIC.
+type ExecSink struct {
+	name string
+	args []string
+}
+
+func NewExecSink(name string, args ...string) *ExecSink {
+	return &ExecSink{name: name, args: args}
+}
+
+func (es *ExecSink) Send(ctx context.Context, rec *Record) error {
+	input, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	cmd := exec.CommandContext(ctx, es.name, es.args...)
+	cmd.Stdin = bytes.NewReader(input)
+	cmd.Env = append(os.Environ(), "PSGB_TOPIC="+rec.Topic, "PSGB_HUB="+rec.Hub)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %w: %s", es.name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// A WebhookSink POSTs each record as JSON to a URL.
+type WebhookSink struct {
+	url    string
+	client *http.Client
+}
+
+func NewWebhookSink(url string, client *http.Client) *WebhookSink {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &WebhookSink{url: url, client: client}
+}
+
+func (ws *WebhookSink) Send(ctx context.Context, rec *Record) error {
+	body, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", ws.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ws.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook %s answered %s", ws.url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package subscriber
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rakoo/psgb/pkg/feed"
+)
+
+const testAtom = `<feed xmlns="http://www.w3.org/2005/Atom">
+  <title>Example Feed</title>
+  <id>urn:feed</id>
+  <entry><id>urn:entry:1</id><title>First</title></entry>
+  <entry><id>urn:entry:2</id><title>Second</title></entry>
+</feed>`
+
+func deliver(t *testing.T, s *Subscriber, topic string) {
+	s.store.Put(&Subscription{Topic: topic, State: StateActive, Secret: "s3cret"})
+
+	req := httptest.NewRequest("POST", "/callback", strings.NewReader(testAtom))
+	req.Header.Set("Content-Type", "application/atom+xml")
+	req.Header.Set("X-Hub-Signature", sign("s3cret", testAtom))
+	req.Header.Set("Link", "<"+topic+">; rel=self, <http://hub.example>; rel=hub")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("Unexpected status for delivery: %d", w.Code)
+	}
+}
+
+func TestJSONLSink(t *testing.T) {
+	sink, err := NewJSONLSink(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := "http://example.com/feed.atom"
+	deliver(t, New("http://localhost/callback", WithSinks(sink)), topic)
+
+	f, err := os.Open(sink.Path(topic))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var ids []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var rec Record
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Topic != topic {
+			t.Errorf("Unexpected topic %s", rec.Topic)
+		}
+		ids = append(ids, rec.Entry.Id)
+	}
+
+	if len(ids) != 2 || ids[0] != "urn:entry:1" || ids[1] != "urn:entry:2" {
+		t.Fatalf("Unexpected entries in file: %v", ids)
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	received := make(chan *Record, 2)
+	downstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec Record
+		json.NewDecoder(r.Body).Decode(&rec)
+		received <- &rec
+	}))
+	defer downstream.Close()
+
+	deliver(t, New("http://localhost/callback", WithSinks(NewWebhookSink(downstream.URL, nil))), "http://example.com/feed.atom")
+
+	if len(received) != 2 {
+		t.Fatalf("Expected 2 entries forwarded, got %d", len(received))
+	}
+}
+
+func TestExecSink(t *testing.T) {
+	out := t.TempDir() + "/out"
+	sink := NewExecSink("/bin/sh", "-c", "cat >> "+out)
+
+	err := sink.Send(context.Background(), &Record{Topic: "t", Entry: &feed.Entry{Id: "urn:entry:1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(raw), "urn:entry:1") {
+		t.Fatalf("Command didn't get the entry: %s", raw)
+	}
+}
@@ -0,0 +1,158 @@
+package subscriber
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+type State string
+
+const (
+	// We asked the hub for a subscription and wait for its verification
+	StatePending State = "pending"
+	// The hub verified the subscription
+	StateActive State = "active"
+	// We asked the hub to unsubscribe and wait for its verification
+	StateUnsubscribing State = "unsubscribing"
+)
+
+type Subscription struct {
+	Topic        string    `json:"topic"`
+	Hub          string    `json:"hub"`
+	State        State     `json:"state"`
+	LeaseSeconds int       `json:"lease_seconds,omitempty"`
+	Expires      time.Time `json:"expires,omitempty"`
+	// Sent with the last request to the hub, which echoes it when
+	// verifying, as specified by 0.3
+	VerifyToken string `json:"verify_token,omitempty"`
+	// Given to the hub, which signs deliveries with it
+	Secret string `json:"secret,omitempty"`
+}
+
+// A Store keeps track of subscriptions, indexed by topic. It must be
+// safe for concurrent use.
+type Store interface {
+	// Get returns the subscription for topic, or nil if there is none.
+	Get(topic string) (*Subscription, error)
+	Put(sub *Subscription) error
+	Delete(topic string) error
+	List() ([]*Subscription, error)
+}
+
+// A MemoryStore keeps subscriptions in memory only.
+type MemoryStore struct {
+	sync.Mutex
+	subs map[string]*Subscription
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{subs: make(map[string]*Subscription)}
+}
+
+func (ms *MemoryStore) Get(topic string) (*Subscription, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	sub, ok := ms.subs[topic]
+	if !ok {
+		return nil, nil
+	}
+	cp := *sub
+	return &cp, nil
+}
+
+func (ms *MemoryStore) Put(sub *Subscription) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	cp := *sub
+	ms.subs[sub.Topic] = &cp
+	return nil
+}
+
+func (ms *MemoryStore) Delete(topic string) error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	delete(ms.subs, topic)
+	return nil
+}
+
+func (ms *MemoryStore) List() ([]*Subscription, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	subs := make([]*Subscription, 0, len(ms.subs))
+	for _, sub := range ms.subs {
+		cp := *sub
+		subs = append(subs, &cp)
+	}
+	return subs, nil
+}
+
+// A FileStore keeps subscriptions in memory and writes all of them to
+// a JSON file after every change, so they survive restarts.
+type FileStore struct {
+	*MemoryStore
+	path string
+
+	saveMu sync.Mutex // serializes changes so the file is always the latest state
+}
+
+// NewFileStore loads the subscriptions in path, if it exists.
+func NewFileStore(path string) (*FileStore, error) {
+	fs := &FileStore{
+		MemoryStore: NewMemoryStore(),
+		path:        path,
+	}
+
+	raw, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return fs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var subs []*Subscription
+	if err := json.Unmarshal(raw, &subs); err != nil {
+		return nil, err
+	}
+	for _, sub := range subs {
+		fs.subs[sub.Topic] = sub
+	}
+
+	return fs, nil
+}
+
+func (fs *FileStore) Put(sub *Subscription) error {
+	fs.saveMu.Lock()
+	defer fs.saveMu.Unlock()
+
+	fs.MemoryStore.Put(sub)
+	return fs.save()
+}
+
+func (fs *FileStore) Delete(topic string) error {
+	fs.saveMu.Lock()
+	defer fs.saveMu.Unlock()
+
+	fs.MemoryStore.Delete(topic)
+	return fs.save()
+}
+
+func (fs *FileStore) save() error {
+	subs, _ := fs.List()
+	raw, err := json.MarshalIndent(subs, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := fs.path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, fs.path)
+}
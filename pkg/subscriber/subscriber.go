@@ -0,0 +1,491 @@
+// A PubSubHubbub subscriber that can be embedded in any Go program.
+//
+// A Subscriber asks hubs for subscriptions with Subscribe and
+// Unsubscribe, and is an http.Handler to be mounted at its callback
+// URL, where hubs verify subscriptions and deliver new content.
+
+package subscriber
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/feed"
+	"github.com/rakoo/psgb/pkg/link"
+	"github.com/rakoo/psgb/pkg/logging"
+)
+
+const (
+	DEFAULT_LEASE_SECONDS = 600
+
+	// How long sinks have to process one delivery
+	SINK_TIMEOUT = 30 * time.Second
+
+	// Bigger deliveries are refused with 413
+	MAX_DELIVERY_BYTES = 10 << 20
+)
+
+// A Notification is content delivered by a hub for a topic we're
+// subscribed to.
+type Notification struct {
+	Topic       string
+	Hub         string
+	ContentType string
+	Body        []byte
+
+	// The parsed content, or nil if it isn't a feed we understand
+	Feed *feed.Feed
+}
+
+// A NotificationHandler is called for every delivery on a topic we are
+// subscribed to.
+type NotificationHandler func(n *Notification)
+
+type Subscriber struct {
+	callbackUrl  string
+	leaseSeconds int
+	thin         bool
+	client       *http.Client
+	store        Store
+	onNotify     NotificationHandler
+	sinks        []Sink
+	logger       *slog.Logger
+}
+
+type Option func(*Subscriber)
+
+// WithLeaseSeconds sets the lease we ask hubs for.
+func WithLeaseSeconds(n int) Option {
+	return func(s *Subscriber) { s.leaseSeconds = n }
+}
+
+// WithThinPings asks hubs to only notify us that topics changed,
+// without the content. Notifications then have an empty Body and no
+// Feed.
+func WithThinPings() Option {
+	return func(s *Subscriber) { s.thin = true }
+}
+
+// WithHTTPClient sets the client used for requests to hubs.
+func WithHTTPClient(c *http.Client) Option {
+	return func(s *Subscriber) { s.client = c }
+}
+
+// WithStore sets where subscriptions are kept. Defaults to a
+// MemoryStore.
+func WithStore(store Store) Option {
+	return func(s *Subscriber) { s.store = store }
+}
+
+// WithNotificationHandler sets the function called for new content.
+func WithNotificationHandler(f NotificationHandler) Option {
+	return func(s *Subscriber) { s.onNotify = f }
+}
+
+// WithSinks adds sinks every delivered entry is sent to.
+func WithSinks(sinks ...Sink) Option {
+	return func(s *Subscriber) { s.sinks = append(s.sinks, sinks...) }
+}
+
+// WithLogger sets the logger. By default nothing is logged.
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Subscriber) { s.logger = logger }
+}
+
+// New creates a subscriber. callbackUrl is the public URL where the
+// Subscriber is mounted, as given to hubs.
+func New(callbackUrl string, opts ...Option) *Subscriber {
+	s := &Subscriber{
+		callbackUrl:  callbackUrl,
+		leaseSeconds: DEFAULT_LEASE_SECONDS,
+		client:       http.DefaultClient,
+		store:        NewMemoryStore(),
+		onNotify:     func(*Notification) {},
+		logger:       logging.Discard(),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// Subscriptions returns all known subscriptions, whatever their state.
+func (s *Subscriber) Subscriptions() ([]*Subscription, error) {
+	return s.store.List()
+}
+
+// Subscribe asks hub for a subscription to topic. The subscription is
+// pending until the hub verifies it.
+func (s *Subscriber) Subscribe(ctx context.Context, hub, topic string) error {
+	previous, err := s.store.Get(topic)
+	if err != nil {
+		return err
+	}
+
+	sub := &Subscription{
+		Topic:       topic,
+		Hub:         hub,
+		State:       StatePending,
+		VerifyToken: newVerifyToken(),
+		Secret:      newVerifyToken(),
+	}
+	if previous != nil && previous.State == StateActive {
+		// A renewal: deliveries keep being accepted until it's verified,
+		// so they keep being signed with the same secret
+		renewal := *previous
+		renewal.Hub = hub
+		renewal.VerifyToken = sub.VerifyToken
+		if renewal.Secret == "" {
+			renewal.Secret = sub.Secret
+		}
+		sub = &renewal
+	}
+	err = s.store.Put(sub)
+	if err != nil {
+		return err
+	}
+
+	err = s.request(ctx, "subscribe", sub)
+	if err != nil {
+		// A renewal that fails leaves the current subscription as it was
+		if previous != nil {
+			s.store.Put(previous)
+		} else {
+			s.store.Delete(topic)
+		}
+	}
+	return err
+}
+
+// Unsubscribe asks the hub of topic to stop the subscription. It is
+// removed once the hub verifies it.
+func (s *Subscriber) Unsubscribe(ctx context.Context, topic string) error {
+	sub, err := s.store.Get(topic)
+	if err != nil {
+		return err
+	}
+	if sub == nil {
+		return fmt.Errorf("not subscribed to %s", topic)
+	}
+
+	previous := *sub
+	sub.State = StateUnsubscribing
+	sub.VerifyToken = newVerifyToken()
+	if err := s.store.Put(sub); err != nil {
+		return err
+	}
+
+	err = s.request(ctx, "unsubscribe", sub)
+	if err != nil {
+		s.store.Put(&previous)
+	}
+	return err
+}
+
+func (s *Subscriber) request(ctx context.Context, mode string, sub *Subscription) error {
+	logger := s.logger.With(logging.KeyTopic, sub.Topic, "hub", sub.Hub, "mode", mode)
+
+	// As specified in 0.4, with the verify token of 0.3 for the hubs
+	// that still follow it
+	form := url.Values{}
+	form.Set("hub.callback", s.callbackUrl)
+	form.Set("hub.topic", sub.Topic)
+	form.Set("hub.mode", mode)
+	form.Set("hub.lease_seconds", strconv.Itoa(s.leaseSeconds))
+	form.Set("hub.verify_token", sub.VerifyToken)
+	if mode == "subscribe" {
+		form.Set("hub.secret", sub.Secret)
+	}
+	if s.thin {
+		form.Set("hub.delivery_mode", "thin")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", sub.Hub, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		logger.Warn("Error when posting form", logging.Err(err))
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		logger.Warn("Got an error with subscription request", "status", resp.Status)
+		return fmt.Errorf("hub refused %s request: %s: %s", mode, resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	logger.Info("Request accepted by hub")
+	return nil
+}
+
+func newVerifyToken() string {
+	token := make([]byte, 16)
+	rand.Read(token)
+	return hex.EncodeToString(token)
+}
+
+func (s *Subscriber) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "POST":
+		s.handleNewItem(w, r)
+	case "GET":
+		s.handleVerification(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Subscriber) handleVerification(w http.ResponseWriter, r *http.Request) {
+	logger := s.logger.With(logging.KeyRequestID, logging.RequestID(r))
+
+	err := r.ParseForm()
+	if err != nil {
+		logger.Warn("Error in parsing request", logging.Err(err))
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	topic := r.FormValue("hub.topic")
+	if topic == "" {
+		logger.Warn("Couldn't find hub.topic in verification request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	logger = logger.With(logging.KeyTopic, topic)
+
+	sub, err := s.store.Get(topic)
+	if err != nil {
+		logger.Error("Couldn't read subscription", logging.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if sub == nil {
+		logger.Warn("Spammer wanted to subscribe us")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	mode := r.FormValue("hub.mode")
+	if mode == "" {
+		logger.Warn("Couldn't find hub.mode in verification request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if mode == "denied" {
+		w.WriteHeader(http.StatusOK)
+		s.store.Delete(topic)
+
+		logger.Warn("Hub refused subscription", "reason", r.FormValue("hub.reason"))
+		return
+	}
+
+	// Only confirm what we actually asked for. An active subscription
+	// can be getting renewed.
+	if (mode == "subscribe" && sub.State != StatePending && sub.State != StateActive) ||
+		(mode == "unsubscribe" && sub.State != StateUnsubscribing) ||
+		(mode != "subscribe" && mode != "unsubscribe") {
+		logger.Warn("Unexpected verification", "mode", mode, "state", sub.State)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// We always send a token, so the hub must echo it: without it,
+	// anyone knowing the callback could confirm a subscription
+	if sub.VerifyToken != "" && subtle.ConstantTimeCompare([]byte(r.FormValue("hub.verify_token")), []byte(sub.VerifyToken)) != 1 {
+		logger.Warn("Bad or missing hub.verify_token in verification request")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	challenge := r.FormValue("hub.challenge")
+	if challenge == "" {
+		logger.Warn("Couldn't find hub.challenge in verification request")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if mode == "unsubscribe" {
+		err = s.store.Delete(topic)
+	} else {
+		sub.State = StateActive
+		sub.LeaseSeconds, _ = strconv.Atoi(r.FormValue("hub.lease_seconds"))
+		if sub.LeaseSeconds > 0 {
+			sub.Expires = time.Now().Add(time.Duration(sub.LeaseSeconds) * time.Second)
+		}
+		err = s.store.Put(sub)
+	}
+	if err != nil {
+		logger.Error("Couldn't save subscription", logging.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprint(w, challenge)
+
+	if mode == "unsubscribe" {
+		logger.Info("Unsubscribed")
+	} else {
+		logger.Info("Subscribed", "lease_seconds", sub.LeaseSeconds)
+	}
+}
+
+func (s *Subscriber) handleNewItem(w http.ResponseWriter, r *http.Request) {
+	defer r.Body.Close()
+
+	logger := s.logger.With(logging.KeyRequestID, logging.RequestID(r))
+
+	rawLinks := r.Header[http.CanonicalHeaderKey("Link")]
+	if rawLinks == nil {
+		logger.Warn("Missing Link: headers in update")
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	topic := ""
+	hub := ""
+	for _, rawLink := range rawLinks {
+		for _, parsedLink := range link.Parse(rawLink) {
+			if parsedLink.Uri != "" && parsedLink.Rel != "" {
+				switch parsedLink.Rel {
+				case "self":
+					topic = parsedLink.Uri
+				case "hub":
+					hub = parsedLink.Uri
+				}
+			}
+		}
+	}
+
+	logger = logger.With(logging.KeyTopic, topic, "hub", hub)
+
+	sub, err := s.store.Get(topic)
+	if err != nil {
+		logger.Error("Couldn't read subscription", logging.Err(err))
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if sub == nil || sub.State == StatePending {
+		logger.Warn("Got content for a topic we're not subscribed to")
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, MAX_DELIVERY_BYTES))
+	if err != nil {
+		logger.Warn("Error when reading content", logging.Err(err))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+		} else {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+		return
+	}
+
+	if !validSignature(r.Header.Get("X-Hub-Signature"), sub.Secret, body) {
+		// As specified by 0.4, the delivery is acknowledged but ignored
+		logger.Warn("Bad or missing signature on delivery")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	n := &Notification{
+		Topic:       topic,
+		Hub:         hub,
+		ContentType: r.Header.Get("Content-Type"),
+		Body:        body,
+	}
+
+	if len(body) > 0 {
+		n.Feed, err = feed.Parse(n.ContentType, body)
+		if err != nil {
+			logger.Warn("Couldn't parse content", "content_type", n.ContentType, logging.Err(err))
+		}
+	}
+
+	entries := 0
+	if n.Feed != nil {
+		entries = len(n.Feed.Entries)
+	}
+	logger.Info("New content", "bytes", len(body), "entries", entries)
+
+	s.onNotify(n)
+	s.sendToSinks(r.Context(), n, logger)
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// validSignature checks an X-Hub-Signature, either HMAC-SHA1 or
+// HMAC-SHA256. Nothing is valid without a secret.
+func validSignature(signature, secret string, data []byte) bool {
+	algo, sum, ok := strings.Cut(signature, "=")
+	if !ok || secret == "" {
+		return false
+	}
+
+	var h func() hash.Hash
+	switch algo {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	default:
+		return false
+	}
+
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(data)
+	return hmac.Equal([]byte(hex.EncodeToString(mac.Sum(nil))), []byte(strings.ToLower(sum)))
+}
+
+// sendToSinks sends every entry of n to every sink. Failures are
+// logged but don't stop other entries or sinks.
+func (s *Subscriber) sendToSinks(ctx context.Context, n *Notification, logger *slog.Logger) {
+	if len(s.sinks) == 0 || n.Feed == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, SINK_TIMEOUT)
+	defer cancel()
+
+	received := time.Now()
+	for _, e := range n.Feed.Entries {
+		rec := &Record{
+			Topic:    n.Topic,
+			Hub:      n.Hub,
+			Received: received,
+			Entry:    e,
+		}
+
+		for _, sink := range s.sinks {
+			if err := sink.Send(ctx, rec); err != nil {
+				logger.Warn("Couldn't send entry to sink", "sink", fmt.Sprintf("%T", sink), "id", e.Id, logging.Err(err))
+			}
+		}
+	}
+}
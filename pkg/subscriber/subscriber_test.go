@@ -0,0 +1,220 @@
+package subscriber
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rakoo/psgb/pkg/hub"
+)
+
+func waitForState(t *testing.T, s *Subscriber, topic string, state State) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		sub, _ := s.store.Get(topic)
+		if sub != nil && sub.State == state {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Subscription to %s never got %s", topic, state)
+}
+
+func TestSubscribeAndReceive(t *testing.T) {
+	updated := time.Now().Add(time.Hour).UTC().Format(time.RFC3339)
+	feed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/atom+xml")
+		fmt.Fprintf(w, `<feed xmlns="http://www.w3.org/2005/Atom"><title>Example Feed</title><id>urn:feed</id><updated>%s</updated></feed>`, updated)
+	}))
+	defer feed.Close()
+
+	hubSrv := httptest.NewServer(nil)
+	defer hubSrv.Close()
+	h := hub.New(hub.WithURL(hubSrv.URL))
+	hubSrv.Config.Handler = h
+	defer h.Shutdown(context.Background())
+
+	notifications := make(chan *Notification, 1)
+	callbackSrv := httptest.NewServer(nil)
+	defer callbackSrv.Close()
+	s := New(callbackSrv.URL, WithNotificationHandler(func(n *Notification) {
+		notifications <- n
+	}))
+	callbackSrv.Config.Handler = s
+
+	err := s.Subscribe(context.Background(), hubSrv.URL+"/subscribe", feed.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForState(t, s, feed.URL, StateActive)
+
+	resp, err := http.PostForm(hubSrv.URL+"/publish", url.Values{
+		"hub.mode": {"publish"},
+		"hub.url":  {feed.URL},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	select {
+	case n := <-notifications:
+		if n.Topic != feed.URL {
+			t.Fatalf("Got notification for %s, expected %s", n.Topic, feed.URL)
+		}
+		if n.Hub != hubSrv.URL {
+			t.Fatalf("Got notification from %s, expected %s", n.Hub, hubSrv.URL)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Didn't receive any notification")
+	}
+}
+
+func TestVerificationOfUnknownTopic(t *testing.T) {
+	s := New("http://localhost/callback")
+
+	req := httptest.NewRequest("GET", "/callback?hub.mode=subscribe&hub.topic=http://spam&hub.challenge=abc", nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("Expected %d for unknown topic, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestVerificationWithVerifyToken(t *testing.T) {
+	s := New("http://localhost/callback")
+	s.store.Put(&Subscription{Topic: "http://example.com/feed", Hub: "http://hub", State: StatePending, VerifyToken: "good"})
+
+	for _, c := range []struct {
+		token string
+		code  int
+	}{
+		{"bad", http.StatusNotFound},
+		{"", http.StatusNotFound},
+		{"good", http.StatusOK},
+	} {
+		query := "hub.mode=subscribe&hub.topic=http://example.com/feed&hub.challenge=abc"
+		if c.token != "" {
+			query += "&hub.verify_token=" + c.token
+		}
+		req := httptest.NewRequest("GET", "/callback?"+query, nil)
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+
+		if w.Code != c.code {
+			t.Fatalf("Expected %d for token %s, got %d", c.code, c.token, w.Code)
+		}
+	}
+}
+
+func TestRenewalKeepsSubscription(t *testing.T) {
+	hubSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer hubSrv.Close()
+
+	s := New("http://localhost/callback")
+	s.store.Put(&Subscription{Topic: "http://example.com/feed", Hub: hubSrv.URL, State: StateActive, LeaseSeconds: 600})
+
+	if err := s.Subscribe(context.Background(), hubSrv.URL, "http://example.com/feed"); err != nil {
+		t.Fatal(err)
+	}
+	sub, _ := s.store.Get("http://example.com/feed")
+	if sub.State != StateActive {
+		t.Fatalf("Expected the subscription to stay active while being renewed, got %s", sub.State)
+	}
+
+	req := httptest.NewRequest("GET", "/callback?hub.mode=subscribe&hub.topic=http://example.com/feed&hub.challenge=abc&hub.lease_seconds=900&hub.verify_token="+sub.VerifyToken, nil)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected the renewal to be verified, got %d", w.Code)
+	}
+	if sub, _ := s.store.Get("http://example.com/feed"); sub.LeaseSeconds != 900 {
+		t.Fatalf("Expected the renewed lease, got %d", sub.LeaseSeconds)
+	}
+}
+
+func TestFailedRenewalKeepsSubscription(t *testing.T) {
+	hubSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer hubSrv.Close()
+
+	s := New("http://localhost/callback")
+	active := &Subscription{Topic: "http://example.com/feed", Hub: hubSrv.URL, State: StateActive, LeaseSeconds: 600}
+	s.store.Put(active)
+
+	if err := s.Subscribe(context.Background(), hubSrv.URL, active.Topic); err == nil {
+		t.Fatal("Expected the renewal to fail")
+	}
+	sub, _ := s.store.Get(active.Topic)
+	if sub == nil || sub.State != StateActive {
+		t.Fatalf("Expected the active subscription to be kept, got %+v", sub)
+	}
+
+	if err := s.Subscribe(context.Background(), hubSrv.URL, "http://example.com/other"); err == nil {
+		t.Fatal("Expected the subscription to fail")
+	}
+	if sub, _ := s.store.Get("http://example.com/other"); sub != nil {
+		t.Fatalf("Expected the failed subscription to be forgotten, got %+v", sub)
+	}
+}
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestDeliverySignature(t *testing.T) {
+	var notified int
+	s := New("http://localhost/callback", WithNotificationHandler(func(*Notification) { notified++ }))
+	s.store.Put(&Subscription{Topic: "http://example.com/feed", State: StateActive, Secret: "s3cret"})
+
+	for _, c := range []struct {
+		signature string
+		notified  int
+	}{
+		{"", 0},
+		{sign("wrong", testAtom), 0},
+		{"sha256=", 0},
+		{sign("s3cret", testAtom), 1},
+	} {
+		req := httptest.NewRequest("POST", "/callback", strings.NewReader(testAtom))
+		req.Header.Set("Content-Type", "application/atom+xml")
+		req.Header.Set("Link", "<http://example.com/feed>; rel=self")
+		if c.signature != "" {
+			req.Header.Set("X-Hub-Signature", c.signature)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, req)
+
+		if w.Code != http.StatusAccepted || notified != c.notified {
+			t.Fatalf("Signature %q: expected %d notifications, got %d (status %d)", c.signature, c.notified, notified, w.Code)
+		}
+	}
+}
+
+func TestDeliveryTooLarge(t *testing.T) {
+	s := New("http://localhost/callback")
+	s.store.Put(&Subscription{Topic: "http://example.com/feed", State: StateActive, Secret: "s3cret"})
+
+	req := httptest.NewRequest("POST", "/callback", strings.NewReader(strings.Repeat("a", MAX_DELIVERY_BYTES+1)))
+	req.Header.Set("Link", "<http://example.com/feed>; rel=self")
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, req)
+
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("Expected 413, got %d", w.Code)
+	}
+}
@@ -0,0 +1,417 @@
+// Minimal WebSocket (RFC 6455) connections, enough for the hub to push
+// messages to its clients and for Go programs to talk to it: no
+// extensions, no subprotocols.
+
+package websocket
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Bigger messages are refused and the connection closed
+	MAX_MESSAGE_SIZE = 1 << 20
+	// A peer that doesn't read what we send for this long is dropped
+	WRITE_TIMEOUT = 10 * time.Second
+
+	acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+// Message types
+const (
+	opContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+// Close codes
+const (
+	CloseNormal          = 1000
+	CloseGoingAway       = 1001
+	CloseProtocolError   = 1002
+	CloseNoStatus        = 1005
+	CloseInvalidData     = 1007
+	ClosePolicyViolation = 1008
+	CloseTooBig          = 1009
+)
+
+var (
+	ErrBadHandshake = errors.New("bad websocket handshake")
+	ErrBadOrigin    = errors.New("websocket origin not allowed")
+)
+
+// A CloseError is returned by ReadMessage once the connection is
+// closed, by either side.
+type CloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	return fmt.Sprintf("websocket closed: %d %s", e.Code, e.Reason)
+}
+
+// A Conn is a WebSocket connection. Only one goroutine may read from it
+// at a time; writes can come from any goroutine.
+type Conn struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool // frames we send are masked, frames we receive aren't
+
+	writeMu   sync.Mutex
+	closeSent bool
+}
+
+// An Upgrader turns requests into WebSocket connections.
+type Upgrader struct {
+	// CheckOrigin tells whether a handshake coming from a web page is
+	// accepted. Browsers send the page's origin in the Origin header and
+	// let any page connect anywhere; handshakes without Origin don't
+	// come from a browser and are always accepted. By default only pages
+	// of the same host are, see SameOrigin.
+	CheckOrigin func(r *http.Request) bool
+}
+
+// Upgrade turns the request into a WebSocket connection, with the
+// default Upgrader.
+func Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	return (&Upgrader{}).Upgrade(w, r)
+}
+
+// SameOrigin accepts handshakes from pages of the host they're sent to.
+func SameOrigin(r *http.Request) bool {
+	origin, err := url.Parse(r.Header.Get("Origin"))
+	return err == nil && strings.EqualFold(origin.Host, r.Host)
+}
+
+// Upgrade turns the request into a WebSocket connection. If it isn't a
+// valid WebSocket handshake, an error is answered and ErrBadHandshake
+// returned; if its origin isn't accepted, ErrBadOrigin.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	if r.Method != "GET" || !headerHasToken(r.Header, "Connection", "upgrade") || !headerHasToken(r.Header, "Upgrade", "websocket") {
+		http.Error(w, "Expected a WebSocket handshake", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "Unsupported WebSocket version", http.StatusUpgradeRequired)
+		return nil, ErrBadHandshake
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "Didn't find Sec-WebSocket-Key", http.StatusBadRequest)
+		return nil, ErrBadHandshake
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = SameOrigin
+	}
+	if r.Header.Get("Origin") != "" && !checkOrigin(r) {
+		http.Error(w, "Origin not allowed", http.StatusForbidden)
+		return nil, ErrBadOrigin
+	}
+
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Connection can't be upgraded", http.StatusInternalServerError)
+		return nil, errors.New("response can't be hijacked")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Fprintf(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: %s\r\n\r\n", acceptKey(key))
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &Conn{conn: conn, br: rw.Reader}, nil
+}
+
+// Dial opens a WebSocket connection to rawUrl, a ws:// or wss:// URL.
+func Dial(rawUrl string) (*Conn, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	host := u.Host
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+		conn, err = net.Dial("tcp", host)
+	case "wss":
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		}
+		conn, err = tls.Dial("tcp", host, &tls.Config{ServerName: u.Hostname()})
+	default:
+		return nil, fmt.Errorf("unsupported websocket scheme %q", u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rawKey [16]byte
+	rand.Read(rawKey[:])
+	key := base64.StdEncoding.EncodeToString(rawKey[:])
+
+	req := &http.Request{
+		Method: "GET",
+		URL:    u,
+		Host:   u.Host,
+		Header: http.Header{
+			"Upgrade":               {"websocket"},
+			"Connection":            {"Upgrade"},
+			"Sec-WebSocket-Key":     {key},
+			"Sec-WebSocket-Version": {"13"},
+		},
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key) {
+		conn.Close()
+		return nil, fmt.Errorf("%w: server answered %s", ErrBadHandshake, resp.Status)
+	}
+
+	return &Conn{conn: conn, br: br, client: true}, nil
+}
+
+func acceptKey(key string) string {
+	sum := sha1.Sum([]byte(key + acceptGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type frame struct {
+	fin     bool
+	opcode  int
+	payload []byte
+}
+
+// ReadMessage returns the next text or binary message. Pings are
+// answered on the way. Once the connection is closed, a *CloseError is
+// returned.
+func (c *Conn) ReadMessage() (opcode int, data []byte, err error) {
+	msgOp := -1
+	for {
+		f, err := c.readFrame()
+		if err != nil {
+			return 0, nil, err
+		}
+
+		switch f.opcode {
+		case opPing:
+			if err := c.writeFrame(opPong, f.payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			closeErr := &CloseError{Code: CloseNoStatus}
+			if len(f.payload) >= 2 {
+				closeErr.Code = int(binary.BigEndian.Uint16(f.payload))
+				closeErr.Reason = string(f.payload[2:])
+			}
+			c.Close(closeErr.Code, "")
+			return 0, nil, closeErr
+		case opContinuation:
+			if msgOp < 0 {
+				return 0, nil, c.fail(CloseProtocolError, "unexpected continuation frame")
+			}
+		case OpText, OpBinary:
+			if msgOp >= 0 {
+				return 0, nil, c.fail(CloseProtocolError, "expected a continuation frame")
+			}
+			msgOp = f.opcode
+		default:
+			return 0, nil, c.fail(CloseProtocolError, "unknown opcode")
+		}
+
+		if len(data)+len(f.payload) > MAX_MESSAGE_SIZE {
+			return 0, nil, c.fail(CloseTooBig, "message too big")
+		}
+		data = append(data, f.payload...)
+
+		if f.fin {
+			if msgOp == OpText && !utf8.Valid(data) {
+				return 0, nil, c.fail(CloseInvalidData, "text message isn't valid UTF-8")
+			}
+			return msgOp, data, nil
+		}
+	}
+}
+
+func (c *Conn) readFrame() (*frame, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(c.br, head[:]); err != nil {
+		return nil, err
+	}
+
+	f := &frame{fin: head[0]&0x80 != 0, opcode: int(head[0] & 0x0f)}
+	if head[0]&0x70 != 0 {
+		return nil, c.fail(CloseProtocolError, "reserved bits set")
+	}
+	masked := head[1]&0x80 != 0
+	if masked == c.client {
+		return nil, c.fail(CloseProtocolError, "bad masking")
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return nil, err
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(c.br, ext[:]); err != nil {
+			return nil, err
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if f.opcode >= opClose && (!f.fin || length > 125) {
+		return nil, c.fail(CloseProtocolError, "bad control frame")
+	}
+	if length > MAX_MESSAGE_SIZE {
+		return nil, c.fail(CloseTooBig, "message too big")
+	}
+
+	var mask [4]byte
+	if masked {
+		if _, err := io.ReadFull(c.br, mask[:]); err != nil {
+			return nil, err
+		}
+	}
+
+	f.payload = make([]byte, length)
+	if _, err := io.ReadFull(c.br, f.payload); err != nil {
+		return nil, err
+	}
+	if masked {
+		for i := range f.payload {
+			f.payload[i] ^= mask[i%4]
+		}
+	}
+
+	return f, nil
+}
+
+// WriteMessage sends data as a single text or binary message.
+func (c *Conn) WriteMessage(opcode int, data []byte) error {
+	return c.writeFrame(opcode, data)
+}
+
+// Ping sends a ping; the other side answers it while reading.
+func (c *Conn) Ping() error {
+	return c.writeFrame(opPing, nil)
+}
+
+func (c *Conn) writeFrame(opcode int, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return net.ErrClosed
+	}
+	if opcode == opClose {
+		c.closeSent = true
+	}
+
+	head := []byte{0x80 | byte(opcode), 0}
+	switch {
+	case len(payload) < 126:
+		head[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		head[1] = 126
+		head = binary.BigEndian.AppendUint16(head, uint16(len(payload)))
+	default:
+		head[1] = 127
+		head = binary.BigEndian.AppendUint64(head, uint64(len(payload)))
+	}
+
+	if c.client {
+		head[1] |= 0x80
+		var mask [4]byte
+		rand.Read(mask[:])
+		head = append(head, mask[:]...)
+
+		masked := make([]byte, len(payload))
+		for i := range payload {
+			masked[i] = payload[i] ^ mask[i%4]
+		}
+		payload = masked
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(WRITE_TIMEOUT))
+	_, err := c.conn.Write(append(head, payload...))
+	return err
+}
+
+// Close tells the other side the connection is closing, with code and
+// reason, and closes it. The reason is cut to fit in a control frame.
+func (c *Conn) Close(code int, reason string) error {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+
+	var payload []byte
+	if code != CloseNoStatus {
+		payload = binary.BigEndian.AppendUint16(nil, uint16(code))
+		payload = append(payload, reason...)
+	}
+	c.writeFrame(opClose, payload)
+	return c.conn.Close()
+}
+
+// fail closes the connection because the other side misbehaved.
+func (c *Conn) fail(code int, reason string) error {
+	c.Close(code, reason)
+	return &CloseError{Code: code, Reason: reason}
+}
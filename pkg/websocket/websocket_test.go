@@ -0,0 +1,126 @@
+package websocket
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func newEchoServer(t *testing.T) string {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		for {
+			op, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			conn.WriteMessage(op, data)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestEcho(t *testing.T) {
+	conn, err := Dial(newEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close(CloseNormal, "")
+
+	// Lengths around the limits of each size encoding
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		msg := strings.Repeat("a", size)
+		if err := conn.Ping(); err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(OpText, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+		op, data, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if op != OpText || string(data) != msg {
+			t.Fatalf("Expected a %d bytes text message back, got %d bytes of type %d", size, len(data), op)
+		}
+	}
+}
+
+func TestClose(t *testing.T) {
+	conn, err := Dial(newEchoServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid UTF-8 in a text message closes the connection
+	conn.WriteMessage(OpText, []byte{0xff, 0xfe})
+	_, _, err = conn.ReadMessage()
+	var closeErr *CloseError
+	if !errors.As(err, &closeErr) || closeErr.Code != CloseInvalidData {
+		t.Fatalf("Expected a close with code %d, got %v", CloseInvalidData, err)
+	}
+}
+
+func TestNotAHandshake(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		Upgrade(w, r)
+	}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("Expected 400, got %s", resp.Status)
+	}
+}
+
+func TestOrigin(t *testing.T) {
+	upgrader := &Upgrader{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := upgrader.Upgrade(w, r); err == nil {
+			conn.Close(CloseNormal, "")
+		}
+	}))
+	defer srv.Close()
+
+	handshake := func(origin string) int {
+		req, _ := http.NewRequest("GET", srv.URL, nil)
+		req.Header.Set("Connection", "Upgrade")
+		req.Header.Set("Upgrade", "websocket")
+		req.Header.Set("Sec-WebSocket-Version", "13")
+		req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := handshake(""); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected a handshake without Origin to be accepted, got %d", status)
+	}
+	if status := handshake(srv.URL); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected a handshake from the same origin to be accepted, got %d", status)
+	}
+	if status := handshake("http://evil.example.com"); status != http.StatusForbidden {
+		t.Errorf("Expected a handshake from another origin to be refused, got %d", status)
+	}
+
+	upgrader.CheckOrigin = func(r *http.Request) bool { return r.Header.Get("Origin") == "http://evil.example.com" }
+	if status := handshake("http://evil.example.com"); status != http.StatusSwitchingProtocols {
+		t.Errorf("Expected the allowed origin to be accepted, got %d", status)
+	}
+}
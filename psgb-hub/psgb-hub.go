@@ -1,38 +1,196 @@
 package main
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
 	"net/http"
-)
-
-const (
-	MAX_PARALLEL_OUTGOING_CONNS = 20
-	CHALLENGE_SIZE              = 20
-	DEFAULT_LEASE_SECONDS       = 600
-	HUB_URL                     = "http://localhost:8080"
-)
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
-var (
-	ACCEPTABLE_RANDOM_CHARS = []byte{'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h',
-		'i', 'j', 'k', 'l', 'm', 'n', 'o', 'p', 'q', 'r', 's', 't', 'u',
-		'v', 'w', 'x', 'y', 'z', '0', '1', '2', '3', '4', '5', '6', '7',
-		'8', '9'}
-	FREE_CONNS    = make(chan bool, MAX_PARALLEL_OUTGOING_CONNS)
-	CONTENT_STORE = newContentStore()
+	"github.com/rakoo/psgb/pkg/hub"
+	"github.com/rakoo/psgb/pkg/logging"
 )
 
 func main() {
-	for i := 0; i < MAX_PARALLEL_OUTGOING_CONNS; i++ {
-		FREE_CONNS <- true
+	addr := flag.String("addr", "localhost:8080", "address to listen on")
+	hubUrl := flag.String("url", hub.DEFAULT_HUB_URL, "public URL of the hub")
+	logFormat := flag.String("log-format", "text", "log output format: text or json")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "how long to wait for in-flight work when stopping")
+	websub := flag.Bool("websub", false, "follow the WebSub recommendation instead of PubSubHubbub 0.4")
+	pendingFile := flag.String("pending-file", "psgb-hub-pending.json", "where to save work that couldn't finish before shutdown (empty to drop it)")
+	maxEntries := flag.Int("max-entries", hub.DEFAULT_RETENTION_ENTRIES, "how many entries to keep per topic (0 for no limit)")
+	maxAge := flag.Duration("max-age", 0, "how long to keep entries (0 for no limit)")
+	maxBytes := flag.Int("max-bytes", 0, "how many bytes of entries to keep per topic (0 for no limit)")
+	pageSize := flag.Int("page-size", hub.DEFAULT_PAGE_SIZE, "how many entries go in one delivery or archive document (archives need -max-entries of at least twice that)")
+	usageInterval := flag.Duration("usage-interval", 10*time.Minute, "how often to log how much content is kept (0 to never)")
+	aggregatesFile := flag.String("aggregates", "", "JSON file mapping aggregate topics to their sources")
+	adminAddr := flag.String("admin-addr", "", "address to serve the admin API on (empty to disable it)")
+	pushSecret := flag.String("push-secret", "", "secret publishers sign pushed content with (empty to refuse pushed content)")
+	socketOrigins := flag.String("ws-origins", "", "comma-separated origins of the web pages allowed to open WebSockets, * for any (empty for the hub's own)")
+	upstreamSecret := flag.String("upstream-secret", "", "key the secrets of upstream subscriptions are derived from (empty for a random one)")
+	upstreamsFile := flag.String("upstreams", "", "JSON file mapping upstream hubs to the topics to subscribe to there")
+	flag.Parse()
+
+	logger, err := logging.New(os.Stderr, *logFormat, *logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+
+	opts := []hub.Option{
+		hub.WithURL(*hubUrl),
+		hub.WithLogger(logger),
+		hub.WithPendingFile(*pendingFile),
+		hub.WithPageSize(*pageSize),
+		hub.WithRetention(func(string) hub.Retention {
+			return hub.Retention{MaxEntries: *maxEntries, MaxAge: *maxAge, MaxBytes: *maxBytes}
+		}),
+	}
+	if *websub {
+		opts = append(opts, hub.WithWebSub())
+	}
+	if *pushSecret != "" {
+		opts = append(opts, hub.WithPushSecret(func(string) string { return *pushSecret }))
+	}
+	if *socketOrigins != "" {
+		opts = append(opts, hub.WithSocketOrigins(allowOrigins(strings.Split(*socketOrigins, ","))))
+	}
+	if *aggregatesFile != "" {
+		aggregates, err := readTopicLists(*aggregatesFile)
+		if err != nil {
+			logger.Error("Couldn't read aggregates", "file", *aggregatesFile, logging.Err(err))
+			os.Exit(2)
+		}
+		for topic, sources := range aggregates {
+			opts = append(opts, hub.WithAggregate(topic, sources...))
+		}
+	}
+	if *upstreamsFile != "" {
+		upstreams, err := readTopicLists(*upstreamsFile)
+		if err != nil {
+			logger.Error("Couldn't read upstreams", "file", *upstreamsFile, logging.Err(err))
+			os.Exit(2)
+		}
+		for upstream, topics := range upstreams {
+			opts = append(opts, hub.WithUpstream(upstream, topics...))
+		}
+		opts = append(opts, hub.WithUpstreamSecret(*upstreamSecret))
+	}
+
+	h := hub.New(opts...)
+	srv := &http.Server{Addr: *addr, Handler: h}
+	srv.RegisterOnShutdown(h.CloseStreams)
+
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+
+	serveErr := make(chan error, 1)
+	go func() {
+		logger.Info("Starting server...", "addr", srv.Addr)
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	var adminSrv *http.Server
+	if *adminAddr != "" {
+		adminSrv = &http.Server{Addr: *adminAddr, Handler: h.AdminHandler()}
+		go func() {
+			logger.Info("Starting admin server...", "addr", adminSrv.Addr)
+			if err := adminSrv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+				logger.Error("Admin server stopped", logging.Err(err))
+			}
+		}()
+	}
+
+	if *usageInterval > 0 {
+		go logUsage(ctx, h, *usageInterval, logger)
+	}
+
+	exitCode := 0
+	select {
+	case err := <-serveErr:
+		logger.Error("Server stopped", logging.Err(err))
+		exitCode = 1
+	case <-ctx.Done():
+		logger.Info("Shutting down...", "timeout", *shutdownTimeout)
+	}
+	stopSignals()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+
+	// No more incoming requests, so nothing can queue new work from now on
+	if err := srv.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Warn("Error when stopping the HTTP server", logging.Err(err))
+	}
+
+	if adminSrv != nil {
+		adminSrv.Shutdown(shutdownCtx)
 	}
 
-	subscribeHandler := newSubscribeHandler()
-	publishHandler := newPublishHandler()
-	startDispatcher(subscribeHandler, publishHandler)
+	if err := h.Shutdown(shutdownCtx); err != nil {
+		exitCode = 1
+	}
 
-	http.Handle("/publish", publishHandler)
-	http.Handle("/subscribe", subscribeHandler)
+	os.Exit(exitCode)
+}
+
+// readTopicLists reads a JSON object mapping keys to lists of topics:
+// aggregate topics to their sources, or upstream hubs to the topics
+// subscribed there.
+func readTopicLists(path string) (map[string][]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
 
-	log.Println("Starting server...")
-	log.Fatal(http.ListenAndServe("localhost:8080", nil))
+	var lists map[string][]string
+	if err := json.Unmarshal(raw, &lists); err != nil {
+		return nil, err
+	}
+	return lists, nil
+}
+
+// allowOrigins accepts WebSocket handshakes from the given origins, or
+// from anywhere if one of them is "*".
+func allowOrigins(origins []string) func(r *http.Request) bool {
+	return func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		for _, o := range origins {
+			o = strings.TrimSpace(o)
+			if o == "*" || strings.EqualFold(strings.TrimSuffix(o, "/"), origin) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// logUsage regularly logs how much content the hub keeps, with the
+// biggest topics.
+func logUsage(ctx context.Context, h *hub.Hub, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		u := h.Usage()
+		logger.Info("Content usage", "topics", len(u.Topics), "entries", u.Entries, "bytes", u.Bytes)
+		for _, tu := range u.Topics[:min(len(u.Topics), 5)] {
+			logger.Debug("Topic usage", logging.KeyTopic, tu.Topic, "entries", tu.Entries, "bytes", tu.Bytes)
+		}
+	}
 }
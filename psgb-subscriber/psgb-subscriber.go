@@ -1,213 +1,149 @@
 package main
 
 import (
+	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
-	"sync"
+	"os"
 
-	"github.com/rakoo/psgb/pkg/link"
+	"github.com/rakoo/psgb/pkg/logging"
+	"github.com/rakoo/psgb/pkg/subscriber"
 )
 
-const (
-	DEFAULT_LEASE_SECONDS = 600
-)
-
-var (
-	onHold                   = make(map[string]bool)
-	subscriptionsOnHoldMutex sync.Mutex
-)
-
-func addSubscriptionOnHold(topic string) {
-	subscriptionsOnHoldMutex.Lock()
-	onHold[topic] = true
-	subscriptionsOnHoldMutex.Unlock()
-}
-
-func removeSubscriptionOnHold(topic string) {
-	subscriptionsOnHoldMutex.Lock()
-	delete(onHold, topic)
-	subscriptionsOnHoldMutex.Unlock()
-}
-
-func isOnHold(uri string) (valid bool) {
-	subscriptionsOnHoldMutex.Lock()
-
-	if _, ok := onHold[uri]; ok {
-		valid = true
-	} else {
-		valid = false
-	}
-	subscriptionsOnHoldMutex.Unlock()
+func subscribeToHandler(s *subscriber.Subscriber) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
 
-	return
-}
+		err := r.ParseForm()
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
 
-func SubscribeToFunc(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
+		feedUriRaw := r.FormValue("feed_uri")
+		if feedUriRaw == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Didn't find feed_uri"))
+			return
+		}
 
-	err := r.ParseForm()
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		return
-	}
+		feedUri, err := url.Parse(feedUriRaw)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad feed_uri: %s", err.Error())
+			return
+		}
 
-	feedUriRaw := r.FormValue("feed_uri")
-	if feedUriRaw == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Didn't find feed_uri"))
-		return
-	}
+		hubUriRaw := r.FormValue("hub_uri")
+		if hubUriRaw == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Didn't find hub_uri"))
+			return
+		}
 
-	feedUri, err := url.Parse(feedUriRaw)
-	if err != nil {
-		log.Println("Error in parsing the feedUri")
-		return
-	}
+		hubUri, err := url.Parse(hubUriRaw)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, "Bad hub_uri: %s", err.Error())
+			return
+		}
 
-	hubUriRaw := r.FormValue("hub_uri")
-	if hubUriRaw == "" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Didn't find hub_uri"))
-		return
-	}
+		err = s.Subscribe(r.Context(), hubUri.String(), feedUri.String())
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(err.Error()))
+			return
+		}
 
-	hubUri, err := url.Parse(hubUriRaw)
-	if err != nil {
-		log.Println("Error in parsing the feedUri")
-		return
+		w.WriteHeader(http.StatusAccepted)
 	}
+}
 
-	addSubscriptionOnHold(feedUri.String())
-
-	// As specified in 0.4
-	subRequest := url.Values{}
-	subRequest.Set("hub.callback", "http://kpad.otokar.looc2011.eu:8081/subscribeCallback")
-	subRequest.Set("hub.topic", feedUri.String())
-	subRequest.Set("hub.mode", "subscribe")
-	subRequest.Set("hub.lease_seconds", fmt.Sprintf("%d", DEFAULT_LEASE_SECONDS))
-
-	resp, err := http.PostForm(hubUri.String(), subRequest)
-	if err != nil {
-		log.Println("Error when posting form: ", err.Error())
-		return
-	}
-	defer resp.Body.Close()
+func unsubscribeFromHandler(s *subscriber.Subscriber) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
 
-	if resp.StatusCode != 202 {
-		log.Println("Got an error with subscription request: ", resp.Status)
-	}
-}
+		feedUri := r.FormValue("feed_uri")
+		if feedUri == "" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Didn't find feed_uri"))
+			return
+		}
 
-func SubscribeCallbackFunc(w http.ResponseWriter, r *http.Request) {
-	if r.Method == "POST" {
-		handleNewItem(w, r)
-	}
+		err := s.Unsubscribe(r.Context(), feedUri)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			w.Write([]byte(err.Error()))
+			return
+		}
 
-	if r.Method == "GET" {
-		handleVerification(w, r)
+		w.WriteHeader(http.StatusAccepted)
 	}
 }
 
-func handleVerification(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+func main() {
+	addr := flag.String("addr", ":8081", "address to listen on")
+	callback := flag.String("callback", "http://localhost:8081/subscribeCallback", "public URL of the callback, as given to hubs")
+	storePath := flag.String("store", "", "JSON file to keep subscriptions in (in memory only if empty)")
+	jsonlDir := flag.String("jsonl-dir", "", "directory where entries are appended, one JSONL file per topic")
+	execCmd := flag.String("exec", "", "shell command run for each entry, with the entry as JSON on stdin")
+	webhook := flag.String("webhook", "", "URL each entry is POSTed to as JSON")
+	logFormat := flag.String("log-format", "text", "log output format: text or json")
+	logLevel := flag.String("log-level", "info", "minimum log level: debug, info, warn or error")
+	flag.Parse()
+
+	logger, err := logging.New(os.Stderr, *logFormat, *logLevel)
 	if err != nil {
-		log.Println("Error in parsing request: ", err.Error())
-		w.WriteHeader(http.StatusOK)
-		return
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	slog.SetDefault(logger)
 
-	topic := r.FormValue("hub.topic")
-	if topic == "" {
-		log.Println("Couldn't find hub.topic in verification request")
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	if !isOnHold(topic) {
-		log.Println("Spammer wanted to subscribe us to ", topic)
-		w.WriteHeader(http.StatusNotFound)
-		return
-	}
-
-	mode := r.FormValue("hub.mode")
-	if mode == "" {
-		log.Println("Couldn't find hub.mode in verification request")
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
-
-	if mode == "denied" {
-		w.WriteHeader(http.StatusOK)
-		removeSubscriptionOnHold(topic)
-
-		log.Println("Hub refused subscription to ", topic)
-
-		reason := r.FormValue("hub.reason")
-		if reason != "" {
-			log.Println("\t reason: ", reason)
+	var store subscriber.Store = subscriber.NewMemoryStore()
+	if *storePath != "" {
+		store, err = subscriber.NewFileStore(*storePath)
+		if err != nil {
+			logger.Error("Couldn't load subscriptions", "path", *storePath, logging.Err(err))
+			os.Exit(1)
 		}
-
-		return
 	}
 
-	challenge := r.FormValue("hub.challenge")
-	if challenge == "" {
-		log.Println("Couldn't find hub.challenge in verification request")
-		w.WriteHeader(http.StatusBadRequest)
-		return
+	var sinks []subscriber.Sink
+	if *jsonlDir != "" {
+		sink, err := subscriber.NewJSONLSink(*jsonlDir)
+		if err != nil {
+			logger.Error("Couldn't create JSONL directory", "path", *jsonlDir, logging.Err(err))
+			os.Exit(1)
+		}
+		sinks = append(sinks, sink)
 	}
-
-	leaseSeconds := r.FormValue("hub.lease_seconds")
-
-	removeSubscriptionOnHold(topic)
-	w.WriteHeader(http.StatusCreated)
-	fmt.Fprint(w, challenge)
-
-	log.Printf("Subscribed to %s for %s seconds", topic, leaseSeconds)
-
-	return
-}
-
-func handleNewItem(w http.ResponseWriter, r *http.Request) {
-	defer r.Body.Close()
-
-	rawLinks := r.Header[http.CanonicalHeaderKey("Link")]
-	if rawLinks == nil {
-		log.Println("Missing Link: headers in update")
-		return
+	if *execCmd != "" {
+		sinks = append(sinks, subscriber.NewExecSink("/bin/sh", "-c", *execCmd))
 	}
-
-	topic := ""
-	hub := ""
-	for _, rawLink := range rawLinks {
-		for _, parsedLink := range link.Parse(rawLink) {
-			if parsedLink.Uri != "" && parsedLink.Rel != "" {
-				switch parsedLink.Rel {
-				case "self":
-					topic = parsedLink.Uri
-				case "hub":
-					hub = parsedLink.Uri
-				}
-			}
-		}
+	if *webhook != "" {
+		sinks = append(sinks, subscriber.NewWebhookSink(*webhook, nil))
 	}
 
-	log.Printf("New content for %s from %s", topic, hub)
-
-	w.WriteHeader(http.StatusAccepted)
+	s := subscriber.New(*callback,
+		subscriber.WithStore(store),
+		subscriber.WithSinks(sinks...),
+		subscriber.WithLogger(logger),
+	)
 
-	return
-}
-
-func main() {
-	http.HandleFunc("/subscribeTo", SubscribeToFunc)
-	http.HandleFunc("/subscribeCallback", SubscribeCallbackFunc)
+	http.Handle("/subscribeTo", subscribeToHandler(s))
+	http.Handle("/unsubscribeFrom", unsubscribeFromHandler(s))
+	http.Handle("/subscribeCallback", s)
 
-	log.Println("Starting subscriber on port 8081...")
-	log.Fatal(http.ListenAndServe(":8081", nil))
+	logger.Info("Starting subscriber...", "addr", *addr)
+	err = http.ListenAndServe(*addr, nil)
+	logger.Error("Subscriber stopped", logging.Err(err))
+	os.Exit(1)
 }